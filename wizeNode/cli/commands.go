@@ -10,6 +10,8 @@ import (
 	"github.com/urfave/cli"
 
 	"wizeBlock/wizeNode/core/blockchain"
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/config"
 	"wizeBlock/wizeNode/core/crypto"
 	"wizeBlock/wizeNode/core/log"
 	"wizeBlock/wizeNode/core/network"
@@ -43,8 +45,39 @@ var GlobalFlags = []cli.Flag{
 		Usage:  "Node ID (port)",
 		EnvVar: "NODE_ID",
 	},
+	cli.StringFlag{
+		Name:   "network",
+		Value:  chaincfg.MainNetParams.Name,
+		Usage:  "Network to use: mainnet, testnet or regtest",
+		EnvVar: "NODE_NETWORK",
+	},
+	cli.StringFlag{
+		Name:   "config",
+		Value:  config.DefaultFile,
+		Usage:  "Configuration FILE, values of env. vars and flags override it",
+		EnvVar: "NODE_CONFIG",
+	},
+	cli.StringFlag{
+		Name:   "datadir",
+		Usage:  "Base dir of node data, other networks than mainnet use its sub dirs",
+		EnvVar: "NODE_DATADIR",
+	},
+	cli.StringFlag{
+		Name:   "loglevel",
+		Value:  "info",
+		Usage:  "Lowest level of logged messages: debug, info, warn or fatal",
+		EnvVar: "NODE_LOGLEVEL",
+	},
+	cli.StringFlag{
+		Name:   "logfile",
+		Usage:  "FILE log messages are appended to",
+		EnvVar: "NODE_LOGFILE",
+	},
 }
 
+// Configuration loaded from the file, commands use it for values of unset flags
+var nodeConfig = &config.Config{}
+
 var Commands = []cli.Command{
 	// wallet commands
 	{
@@ -104,6 +137,14 @@ var Commands = []cli.Command{
 				Name:  "mine",
 				Usage: "Mine in the same node or only with miner nodes",
 			},
+			cli.Int64Flag{
+				Name:  "locktime",
+				Usage: "Block height (below 500000000) or unix time until which the transaction can't be mined",
+			},
+			cli.UintFlag{
+				Name:  "sequence",
+				Usage: "Relative lock of inputs: blocks, or 512 second units with bit 22 set, their outputs should be deep",
+			},
 		},
 		Usage:  "Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set",
 		Action: CmdSend,
@@ -127,6 +168,77 @@ var Commands = []cli.Command{
 		Usage:  "Get a block with hash",
 		Action: CmdGetBlock,
 	},
+	{
+		Name:    "exportchain",
+		Aliases: []string{"export"},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "file",
+				Usage: "Chain FILE to write",
+			},
+		},
+		Usage:  "Export blocks of the best chain to FILE",
+		Action: CmdExportChain,
+	},
+	{
+		Name:    "importchain",
+		Aliases: []string{"import"},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "file",
+				Usage: "Chain FILE to read",
+			},
+		},
+		Usage:  "Validate and import blocks from FILE, the blockchain is created if there is none",
+		Action: CmdImportChain,
+	},
+	{
+		Name:    "verifychain",
+		Aliases: []string{"verify"},
+		Usage:   "Validate all blocks of the best chain again and check indexes and the UTXO set",
+		Action:  CmdVerifyChain,
+	},
+	{
+		Name:   "reindex",
+		Usage:  "Rebuild the UTXO set and indexes from saved blocks",
+		Action: CmdReindex,
+	},
+	{
+		Name:    "dumpsnapshot",
+		Aliases: []string{"dump"},
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "height",
+				Usage: "HEIGHT of the best chain",
+			},
+			cli.StringFlag{
+				Name:  "file",
+				Usage: "Snapshot FILE to write",
+			},
+		},
+		Usage:  "Write the UTXO set at HEIGHT to FILE and print its hash and the genesis hash",
+		Action: CmdDumpSnapshot,
+	},
+	{
+		Name:    "loadsnapshot",
+		Aliases: []string{"load"},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "file",
+				Usage: "Snapshot FILE to read",
+			},
+			cli.StringFlag{
+				Name:  "hash",
+				Usage: "Trusted HASH of the snapshot",
+			},
+			cli.StringFlag{
+				Name:  "genesis",
+				Usage: "Trusted HASH of the genesis block",
+			},
+		},
+		Usage:  "Create a blockchain from the UTXO snapshot FILE if its hash is HASH, historical blocks are validated later by the node",
+		Action: CmdLoadSnapshot,
+	},
 	// p2p network commands
 	{
 		Name:    "startnode",
@@ -146,10 +258,62 @@ var Commands = []cli.Command{
 				Value: 0,
 				Usage: "",
 			},
+			cli.BoolFlag{
+				Name:   "secure",
+				Usage:  "Encrypt and authenticate connections with other nodes",
+				EnvVar: "NODE_SECURE",
+			},
+			cli.StringSliceFlag{
+				Name:  "allow",
+				Usage: "Public key of a node allowed to connect (secure mode only). Can be repeated",
+			},
+			cli.StringFlag{
+				Name:   "bind",
+				Usage:  "Address (host:port) the node listens on, node address if not set",
+				EnvVar: "NODE_BIND",
+			},
+			cli.StringFlag{
+				Name:   "external",
+				Usage:  "Address (host:port) advertised to other nodes, node address if not set",
+				EnvVar: "NODE_EXTERNAL",
+			},
+			cli.IntFlag{
+				Name:   "prune",
+				Usage:  "Keep bodies of only the last N blocks, all blocks are kept if it is zero",
+				EnvVar: "NODE_PRUNE",
+			},
+			cli.IntFlag{
+				Name:   "utxocache",
+				Value:  blockchain.DefaultUTXOCacheSize >> 20,
+				Usage:  "Size limit of the in-memory UTXO cache in megabytes",
+				EnvVar: "NODE_UTXOCACHE",
+			},
+			cli.BoolFlag{
+				Name:   "light",
+				Usage:  "Keep only block headers and transactions of watched addresses",
+				EnvVar: "NODE_LIGHT",
+			},
+			cli.StringSliceFlag{
+				Name:  "watch",
+				Usage: "Address watched by a light node besides wallet addresses. Can be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:  "peer",
+				Usage: "Full node (host:port) a light node syncs with. Can be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:  "seed",
+				Usage: "Node (host:port) to connect to besides initial nodes, seeds of the config file if not set. Can be repeated",
+			},
 		},
-		Usage:  "Start a node with ID specified in NODE_ID env. var. -miner enables mining",
+		Usage:  "Start a node with ID specified in NODE_ID env. var. -miner enables mining, -light starts a light node",
 		Action: CmdStartNode,
 	},
+	{
+		Name:   "nodekey",
+		Usage:  "Print public key of the node identity used by secure connections",
+		Action: CmdNodeKey,
+	},
 }
 
 // CommandNotFound implements action when subcommand not found
@@ -160,12 +324,67 @@ func CommandNotFound(c *cli.Context, command string) {
 
 // CommandBefore implements action before run command
 func CommandBefore(c *cli.Context) error {
+	cfg, err := config.Load(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	nodeConfig = cfg
+	// values of the file are used for flags set neither in command line nor in env.
+	setGlobalDefault(c, "network", cfg.Network)
+	setGlobalDefault(c, "datadir", cfg.DataDir)
+	setGlobalDefault(c, "nodeADD", cfg.Node.Host)
+	if cfg.Node.Port > 0 {
+		setGlobalDefault(c, "nodeID", strconv.Itoa(cfg.Node.Port))
+	}
+	setGlobalDefault(c, "loglevel", cfg.Log.Level)
+	setGlobalDefault(c, "logfile", cfg.Log.File)
+
+	err = log.SetLevel(c.GlobalString("loglevel"))
+	if err != nil {
+		return err
+	}
 	if c.GlobalBool("debug") {
 		log.Debug.Enabled = true
 	}
+	if c.GlobalString("logfile") != "" {
+		file, err := os.OpenFile(c.GlobalString("logfile"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(file)
+	}
+	if cfg.API.DocDir != "" {
+		node.APIDocDir = cfg.API.DocDir
+	}
+
+	err = chaincfg.SelectNetwork(c.GlobalString("network"))
+	if err != nil {
+		return err
+	}
+	if c.GlobalString("datadir") != "" {
+		chaincfg.SetDataDir(c.GlobalString("datadir"))
+	}
+	// nodes of other networks use other ports by default
+	if !c.GlobalIsSet("nodeID") {
+		c.GlobalSet("nodeID", strconv.Itoa(chaincfg.Active.DefaultPort))
+	}
 	return nil
 }
 
+// Sets a global flag to the value unless it is set by command line or env. var
+func setGlobalDefault(c *cli.Context, name, value string) {
+	if value != "" && !c.GlobalIsSet(name) {
+		c.GlobalSet(name, value)
+	}
+}
+
+// Sets a flag of the command to the value unless it is set by command line or env. var
+func setDefault(c *cli.Context, name, value string) {
+	if value != "" && !c.IsSet(name) {
+		c.Set(name, value)
+	}
+}
+
 // wallet commands
 func CmdCreateWallet(c *cli.Context) (err error) {
 	nodeID := c.GlobalString("nodeID")
@@ -218,9 +437,7 @@ func CmdCreateBlockchain(c *cli.Context) (err error) {
 		return fmt.Errorf("ERROR: Address is not valid")
 	}
 	bc := blockchain.CreateBlockchain(address, nodeID)
-	defer bc.Db.Close()
-	UTXOSet := blockchain.UTXOSet{bc}
-	UTXOSet.Reindex()
+	defer bc.Close()
 
 	fmt.Println("Done!")
 	return nil
@@ -244,7 +461,7 @@ func CmdSend(c *cli.Context) (err error) {
 
 	bc := blockchain.NewBlockchain(nodeID)
 	UTXOSet := blockchain.UTXOSet{bc}
-	defer bc.Db.Close()
+	defer bc.Close()
 
 	wallets, err := wallet.NewWallets(nodeID)
 	if err != nil {
@@ -258,13 +475,12 @@ func CmdSend(c *cli.Context) (err error) {
 		return
 	}
 
-	tx := blockchain.NewUTXOTransaction(wallet, to, amount, &UTXOSet)
+	tx := blockchain.NewUTXOTransaction(wallet, to, amount, c.Int64("locktime"), uint32(c.Uint("sequence")), &UTXOSet)
 	if mineNow {
 		cbTx := blockchain.NewCoinbaseTX(from, "")
 		txs := []*blockchain.Transaction{cbTx, tx}
 
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		bc.MineBlock(txs)
 	} else {
 		// TODO: проверять остаток на балансе с учетом незамайненых транзакций,
 		// во избежание двойного использования выходов
@@ -279,7 +495,7 @@ func CmdSend(c *cli.Context) (err error) {
 func CmdPrintChain(c *cli.Context) (err error) {
 	nodeID := c.GlobalString("nodeID")
 	bc := blockchain.NewBlockchain(nodeID)
-	defer bc.Db.Close()
+	defer bc.Close()
 
 	bci := bc.Iterator()
 
@@ -307,7 +523,7 @@ func CmdPrintChain(c *cli.Context) (err error) {
 func CmdGetBlock(c *cli.Context) (err error) {
 	nodeID := c.GlobalString("nodeID")
 	bc := blockchain.NewBlockchain(nodeID)
-	defer bc.Db.Close()
+	defer bc.Close()
 
 	blockHash := c.String("hash")
 	bci := bc.Iterator()
@@ -336,6 +552,164 @@ func CmdGetBlock(c *cli.Context) (err error) {
 	return nil
 }
 
+func CmdExportChain(c *cli.Context) (err error) {
+	nodeID := c.GlobalString("nodeID")
+	path := c.String("file")
+	if path == "" {
+		return fmt.Errorf("ERROR: Chain file is not set")
+	}
+
+	bc := blockchain.NewBlockchain(nodeID)
+	defer bc.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count, err := bc.Export(file)
+	if err != nil {
+		fmt.Printf("ERROR: Export failed after %d blocks: %s\n", count, err)
+		return err
+	}
+	fmt.Printf("Exported %d blocks to %s\n", count, path)
+	return nil
+}
+
+func CmdImportChain(c *cli.Context) (err error) {
+	nodeID := c.GlobalString("nodeID")
+	path := c.String("file")
+	if path == "" {
+		return fmt.Errorf("ERROR: Chain file is not set")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	store, err := blockchain.OpenChainStore(nodeID)
+	if err != nil {
+		return err
+	}
+	bc, count, err := blockchain.ImportBlockchain(store, file)
+	if bc != nil {
+		defer bc.Close()
+	} else {
+		defer store.Close()
+	}
+	if err != nil {
+		fmt.Printf("ERROR: Import failed after %d blocks: %s\n", count, err)
+		return err
+	}
+	fmt.Printf("Imported %d blocks from %s\n", count, path)
+	return nil
+}
+
+func CmdVerifyChain(c *cli.Context) (err error) {
+	nodeID := c.GlobalString("nodeID")
+	bc := blockchain.NewBlockchain(nodeID)
+	defer bc.Close()
+
+	height, err := bc.VerifyChain(progressPrinter("Verified"))
+	if err != nil {
+		fmt.Printf("ERROR: Chain is corrupt at height %d: %s\n", height, err)
+		return err
+	}
+	fmt.Printf("Chain of height %d is valid\n", height)
+	return nil
+}
+
+func CmdReindex(c *cli.Context) (err error) {
+	nodeID := c.GlobalString("nodeID")
+	bc := blockchain.NewBlockchain(nodeID)
+	defer bc.Close()
+
+	err = bc.ReindexWithProgress(progressPrinter("Connected"))
+	if err != nil {
+		fmt.Printf("ERROR: Reindex failed: %s\n", err)
+		return err
+	}
+	fmt.Printf("Done! Tip is %x at height %d\n", bc.GetTip(), bc.GetBestHeight())
+	return nil
+}
+
+// Returns progress callback printing count of done blocks when their percent changes
+func progressPrinter(action string) func(done, total int) {
+	last := -1
+	return func(done, total int) {
+		percent := done * 100 / total
+		if percent != last {
+			last = percent
+			fmt.Printf("%s %d of %d blocks (%d%%)\n", action, done, total, percent)
+		}
+	}
+}
+
+func CmdDumpSnapshot(c *cli.Context) (err error) {
+	nodeID := c.GlobalString("nodeID")
+	height := c.Int("height")
+	path := c.String("file")
+	if path == "" {
+		return fmt.Errorf("ERROR: Snapshot file is not set")
+	}
+
+	bc := blockchain.NewBlockchain(nodeID)
+	defer bc.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := bc.WriteSnapshot(file, height)
+	if err != nil {
+		fmt.Printf("ERROR: Snapshot failed: %s\n", err)
+		return err
+	}
+	fmt.Printf("Snapshot of %d transactions at height %d is written to %s\n", header.Count, header.Height, path)
+	fmt.Printf("Hash: %x\n", header.Hash)
+	fmt.Printf("Genesis: %x\n", header.Genesis)
+	return nil
+}
+
+func CmdLoadSnapshot(c *cli.Context) (err error) {
+	nodeID := c.GlobalString("nodeID")
+	path := c.String("file")
+	hash, err := hex.DecodeString(c.String("hash"))
+	if err != nil || len(hash) == 0 {
+		return fmt.Errorf("ERROR: Snapshot hash is not valid")
+	}
+	genesis, err := hex.DecodeString(c.String("genesis"))
+	if err != nil || len(genesis) == 0 {
+		return fmt.Errorf("ERROR: Genesis hash is not valid")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	store, err := blockchain.OpenChainStore(nodeID)
+	if err != nil {
+		return err
+	}
+	bc, err := blockchain.LoadSnapshot(store, file, hash, genesis)
+	if err != nil {
+		store.Close()
+		fmt.Printf("ERROR: Snapshot is not loaded: %s\n", err)
+		return err
+	}
+	defer bc.Close()
+
+	fmt.Printf("Snapshot is loaded, the chain starts at height %d\n", bc.GetBestHeight())
+	return nil
+}
+
 // p2p network commands
 func CmdStartNode(c *cli.Context) (err error) {
 	pause := c.Int("pause")
@@ -343,13 +717,35 @@ func CmdStartNode(c *cli.Context) (err error) {
 		time.Sleep(time.Duration(pause) * time.Second)
 	}
 
+	setDefault(c, "bind", nodeConfig.Node.Bind)
+	setDefault(c, "external", nodeConfig.Node.External)
+	setDefault(c, "api", nodeConfig.API.Listen)
+	setDefault(c, "miner", nodeConfig.Node.Miner)
+	seeds, err := parseNodeAddrs(c.StringSlice("seed"), nodeConfig.Node.Seeds)
+	if err != nil {
+		return err
+	}
+
 	nodeID := c.GlobalInt("nodeID")
 	nodeIDStr := strconv.Itoa(nodeID)
 	nodeAddr := network.NodeAddr{
 		Host: c.GlobalString("nodeADD"),
 		Port: nodeID,
 	}
-	log.Info.Printf("Starting Node %s", nodeAddr)
+	bindAddr := nodeAddr
+	if c.String("bind") != "" {
+		err = bindAddr.LoadFromString(c.String("bind"))
+		if err != nil {
+			return fmt.Errorf("Wrong bind address %s: %s", c.String("bind"), err)
+		}
+	}
+	if c.String("external") != "" {
+		err = nodeAddr.LoadFromString(c.String("external"))
+		if err != nil {
+			return fmt.Errorf("Wrong external address %s: %s", c.String("external"), err)
+		}
+	}
+	log.Info.Printf("Starting Node %s on %s", nodeAddr, chaincfg.Active.Name)
 
 	// PROD: add request to masternode and get nodeID
 	//nodeAddress := os.Getenv("NODE_ADD") + ":" + nodeIDStr
@@ -359,6 +755,13 @@ func CmdStartNode(c *cli.Context) (err error) {
 
 	// FIXME: it is just apiPort
 	apiAddr := c.String("api")
+	if !c.IsSet("api") {
+		apiAddr = fmt.Sprintf(":%d", chaincfg.Active.DefaultAPIPort)
+	}
+
+	if c.Bool("light") {
+		return startLightNode(c, nodeIDStr, apiAddr, seeds)
+	}
 
 	// FIXME: minerWalletAddress to Node, not to NodeServer
 	minerWalletAddress := c.String("miner")
@@ -376,6 +779,85 @@ func CmdStartNode(c *cli.Context) (err error) {
 	}
 
 	newNode := node.NewNode(nodeIDStr, nodeAddr, apiAddr, minerWalletAddress)
+	newNode.SetBindAddress(bindAddr)
+	newNode.AddSeeds(seeds)
+	if c.Bool("secure") {
+		err = newNode.SetupSecurity(c.StringSlice("allow"))
+		if err != nil {
+			log.Fatal.Printf("Failed to setup secure transport: %s", err)
+			return err
+		}
+	} else if len(c.StringSlice("allow")) > 0 {
+		log.Warn.Println("Allowed nodes list works only with -secure")
+	}
+	if size := c.Int("utxocache"); size > 0 {
+		newNode.SetUTXOCacheSize(size << 20)
+	}
+	if depth := c.Int("prune"); depth > 0 {
+		err = newNode.SetPruneDepth(depth)
+		if err != nil {
+			log.Fatal.Printf("Failed to enable pruning: %s", err)
+			return err
+		}
+		log.Info.Printf("Pruning is on, bodies of the last %d blocks are kept", depth)
+	}
 	newNode.Run()
 	return nil
 }
+
+// Parses node addresses (host:port) of the list, defaults are used if the list is empty
+func parseNodeAddrs(list, defaults []string) ([]network.NodeAddr, error) {
+	if len(list) == 0 {
+		list = defaults
+	}
+	addrs := []network.NodeAddr{}
+	for _, item := range list {
+		addr := network.NodeAddr{}
+		err := addr.LoadFromString(item)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong node address %s: %s", item, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Starts a light node syncing with full nodes, it doesn't accept connections.
+// Seeds are the full nodes if no peers are given
+func startLightNode(c *cli.Context, nodeID, apiAddr string, seeds []network.NodeAddr) error {
+	peers, err := parseNodeAddrs(c.StringSlice("peer"), nil)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		peers = seeds
+	}
+
+	lightNode, err := node.NewLightNode(nodeID, apiAddr, c.StringSlice("watch"))
+	if err != nil {
+		log.Fatal.Printf("Failed to start light node: %s", err)
+		return err
+	}
+	if c.Bool("secure") {
+		err = lightNode.SetupSecurity(c.StringSlice("allow"))
+		if err != nil {
+			log.Fatal.Printf("Failed to setup secure transport: %s", err)
+			return err
+		}
+	}
+	lightNode.InitNetwork(peers)
+	lightNode.Run()
+	return nil
+}
+
+func CmdNodeKey(c *cli.Context) (err error) {
+	nodeID := c.GlobalString("nodeID")
+	identity, err := node.LoadNodeIdentity(nodeID)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return err
+	}
+
+	fmt.Printf("Node public key: %x\n", identity.PublicKey)
+	return nil
+}
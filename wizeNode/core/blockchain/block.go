@@ -3,12 +3,16 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"time"
 
+	"wizeBlock/wizeNode/core/chaincfg"
 	"wizeBlock/wizeNode/core/crypto"
 )
 
+// Max size of serialized block. Bigger blocks are rejected
+const MaxBlockSize = 1024 * 1024
+
 // Block represents a block in the blockchain
 type Block struct {
 	Timestamp     int64
@@ -21,7 +25,20 @@ type Block struct {
 
 // NewBlock creates and returns Block
 func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height}
+	block := &Block{Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height}
+
+	return mineBlock(block)
+}
+
+// NewGenesisBlock creates and returns genesis Block of the active network
+func NewGenesisBlock(coinbase *Transaction) *Block {
+	block := &Block{chaincfg.Active.GenesisTimestamp, []*Transaction{coinbase}, []byte{}, []byte{}, 0, 0}
+
+	return mineBlock(block)
+}
+
+// Runs proof-of-work and sets hash and nonce of the block
+func mineBlock(block *Block) *Block {
 	pow := NewProofOfWork(block)
 	nonce, hash := pow.Run()
 
@@ -31,11 +48,6 @@ func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Bl
 	return block
 }
 
-// NewGenesisBlock creates and returns genesis Block
-func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
-}
-
 // HashTransactions returns a hash of the transactions in the block
 func (b *Block) HashTransactions() []byte {
 	var transactions [][]byte
@@ -62,14 +74,23 @@ func (b *Block) Serialize() []byte {
 }
 
 // DeserializeBlock deserializes a block
-func DeserializeBlock(d []byte) *Block {
-	var block Block
+func DeserializeBlock(d []byte) (*Block, error) {
+	if len(d) > MaxBlockSize {
+		return nil, fmt.Errorf("Block size %d is over limit %d", len(d), MaxBlockSize)
+	}
 
+	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(d))
 	err := decoder.Decode(&block)
 	if err != nil {
-		fmt.Println(err)
+		return nil, fmt.Errorf("Decode block: %s", err)
+	}
+
+	for _, tx := range block.Transactions {
+		if tx == nil {
+			return nil, errors.New("Block has empty transaction")
+		}
 	}
 
-	return &block
+	return &block, nil
 }
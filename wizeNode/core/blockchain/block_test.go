@@ -0,0 +1,69 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBlock() *Block {
+	tx1 := testTransaction("tx1")
+	tx2 := testTransaction("tx2")
+	return &Block{1514764800, []*Transaction{tx1, tx2}, []byte("prev"), []byte("hash"), 1, 2}
+}
+
+func TestDeserializeBlock(t *testing.T) {
+	block := testBlock()
+	decoded, err := DeserializeBlock(block.Serialize())
+	assert.Nil(t, err, "Block is deserialized")
+	assert.Equal(t, block.Hash, decoded.Hash, "Block is not changed")
+	assert.Equal(t, 2, len(decoded.Transactions), "Transactions are decoded")
+
+	_, err = DeserializeBlock([]byte("garbage"))
+	assert.NotNil(t, err, "Wrong data is not decoded to empty block")
+	_, err = DeserializeBlock(nil)
+	assert.NotNil(t, err, "Empty data is not a block")
+	_, err = DeserializeBlock(make([]byte, MaxBlockSize+1))
+	assert.NotNil(t, err, "Block over size limit is rejected")
+
+	_, err = DeserializeTransaction([]byte("garbage"))
+	assert.NotNil(t, err, "Wrong data is not decoded to empty transaction")
+}
+
+func FuzzDeserializeBlock(f *testing.F) {
+	f.Add(testBlock().Serialize())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block, err := DeserializeBlock(data)
+		if err != nil {
+			return
+		}
+		for _, tx := range block.Transactions {
+			assert.NotNil(t, tx, "Decoded block has no empty transactions")
+		}
+	})
+}
+
+func FuzzDeserializeTransaction(f *testing.F) {
+	f.Add(testTransaction("tx").Serialize())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DeserializeTransaction(data)
+	})
+}
+
+func FuzzDeserializeCompactBlock(f *testing.F) {
+	data, _ := NewCompactBlock(testBlock()).Serialize()
+	f.Add(data)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		compact, err := DeserializeCompactBlock(data)
+		if err != nil {
+			return
+		}
+		compact.Reconstruct(map[string]Transaction{})
+	})
+}
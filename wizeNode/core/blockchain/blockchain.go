@@ -7,80 +7,120 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 
-	"github.com/boltdb/bolt"
-
+	"wizeBlock/wizeNode/core/chaincfg"
 	"wizeBlock/wizeNode/core/crypto"
+	"wizeBlock/wizeNode/core/storage"
 )
 
-const dbFile = "files/db%s/wizebit.db"
-const blocksBucket = "blocks"
-const genesisCoinbaseData = "The Times 22/Jan/2017 Now I have nice gopher"
-const emissionValue = 1000000
+const dbFile = "db%s/wizebit.db"
 
 // Blockchain implements interactions with a DB
 type Blockchain struct {
-	tip []byte
-	Db  *bolt.DB
+	tip      []byte
+	tipMutex sync.RWMutex
+	store    storage.ChainStore
+	// count of last blocks which bodies are kept, zero if the chain is not pruned
+	pruneDepth int
+	// unspent outputs read and changed by connected blocks
+	utxos *utxoCache
+	// changes of the chain state go one by one, the UTXO cache is updated after commit
+	chainMutex sync.Mutex
+}
+
+func newBlockchain(tip []byte, store storage.ChainStore) *Blockchain {
+	return &Blockchain{tip: tip, store: store, utxos: newUTXOCache(DefaultUTXOCacheSize)}
 }
 
 // Iterator returns a BlockchainIterat
 func (bc *Blockchain) Iterator() *BlockchainIterator {
-	bci := &BlockchainIterator{bc.tip, bc.Db}
+	bci := &BlockchainIterator{bc.GetTip(), bc.store}
 
 	return bci
 }
 
 // CreateBlockchain creates a new blockchain DB
 func CreateBlockchain(address, nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+	dbFile := chaincfg.DataPath(dbFile, nodeID)
 	ok, err := DbExists(dbFile)
 	if ok {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
 
-	var tip []byte
+	store, err := OpenChainStore(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc, err := CreateBlockchainInStore(address, store)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	cbtx := NewEmissionCoinbaseTX(address, genesisCoinbaseData, emissionValue)
+	return bc
+}
+
+// CreateBlockchainInStore creates a new blockchain with genesis block in an empty store
+func CreateBlockchainInStore(address string, store storage.ChainStore) (*Blockchain, error) {
+	params := chaincfg.Active
+	cbtx := NewEmissionCoinbaseTX(address, params.GenesisCoinbaseData, params.GenesisEmission)
 	genesis := NewGenesisBlock(cbtx)
 
-	db, err := bolt.Open(dbFile, 0600, nil)
+	return CreateBlockchainFromGenesis(genesis, store)
+}
+
+// CreateBlockchainFromGenesis creates a new blockchain with the genesis block in an empty store
+func CreateBlockchainFromGenesis(genesis *Block, store storage.ChainStore) (*Blockchain, error) {
+	if genesis.Height != 0 || len(genesis.PrevBlockHash) != 0 {
+		return nil, fmt.Errorf("Block %x is not genesis", genesis.Hash)
+	}
+	err := genesis.Header().Validate()
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte(blocksBucket))
-		if err != nil {
-			log.Panic(err)
+	err = store.Update(func(b storage.ChainBatch) error {
+		if b.Tip() != nil {
+			return errors.New("Blockchain already exists.")
 		}
 
-		err = b.Put(genesis.Hash, genesis.Serialize())
+		err := b.PutBlock(genesis.Hash, genesis.Serialize())
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-
-		err = b.Put([]byte("l"), genesis.Hash)
+		err = connectBlock(b, b, genesis)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		tip = genesis.Hash
-
-		return nil
+		err = setUTXOTip(b, genesis)
+		if err != nil {
+			return err
+		}
+		return b.SetTip(genesis.Hash)
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	bc := Blockchain{tip, db}
+	return newBlockchain(genesis.Hash, store), nil
+}
 
-	return &bc
+// OpenChainStore opens the chain DB of the node, it is created if it doesn't exist
+func OpenChainStore(nodeID string) (storage.ChainStore, error) {
+	dbFile := chaincfg.DataPath(dbFile, nodeID)
+	err := os.MkdirAll(filepath.Dir(dbFile), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return storage.OpenBoltChainStore(dbFile)
 }
 
 // NewBlockchain creates a new Blockchain with genesis Block
 func NewBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+	dbFile := chaincfg.DataPath(dbFile, nodeID)
 	//fmt.Printf("dbFile: %s\n", dbFile)
 	ok, err := DbExists(dbFile)
 	if !ok {
@@ -88,83 +128,95 @@ func NewBlockchain(nodeID string) *Blockchain {
 		os.Exit(1)
 	}
 
-	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	store, err := OpenChainStore(nodeID)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-
-		return nil
-	})
+	bc, err := NewBlockchainFromStore(store)
 	if err != nil {
 		log.Panic(err)
 	}
-
-	bc := Blockchain{tip, db}
 	//fmt.Println("B db:", db, "bc:", bc)
 
-	return &bc
+	return bc
 }
 
-// AddBlock saves the block into the blockchain
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockInDb := b.Get(block.Hash)
-
-		if blockInDb != nil {
-			return nil
-		}
-
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
-
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panic(err)
-			}
-			bc.tip = block.Hash
-		}
-
+// NewBlockchainFromStore opens a blockchain kept in the store
+func NewBlockchainFromStore(store storage.ChainStore) (*Blockchain, error) {
+	var tip []byte
+	store.View(func(r storage.ChainReader) error {
+		// store values are valid only inside transaction
+		tip = append([]byte{}, r.Tip()...)
 		return nil
 	})
+	if len(tip) == 0 {
+		return nil, errors.New("No existing blockchain found. Create one first.")
+	}
+
+	bc := newBlockchain(tip, store)
+	err := bc.checkChainState()
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+	return bc, nil
 }
 
-// FindTransaction finds a transaction by its ID
-func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	bci := bc.Iterator()
+// Close flushes the UTXO cache and closes the store of the blockchain
+func (bc *Blockchain) Close() error {
+	err := bc.FlushUTXO()
+	if err != nil {
+		fmt.Printf("ERROR: UTXO cache is not flushed: %s\n", err)
+	}
+	return bc.store.Close()
+}
 
-	for {
-		block := bci.Next()
+// FindTransaction finds a transaction of the best chain by its ID
+func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	var tx Transaction
+	err := bc.store.View(func(r storage.ChainReader) error {
+		var err error
+		tx, err = findTransaction(r, ID)
+		return err
+	})
+	return tx, err
+}
 
-		for _, tx := range block.Transactions {
-			//fmt.Println("ID: ", ID, " tx.ID: ", tx.ID) //TODO: remove
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
+// Finds a transaction of the best chain in a view or a batch
+func findTransaction(r storage.ChainReader, ID []byte) (Transaction, error) {
+	if hash := r.Index(txIndex, ID); hash != nil {
+		block, err := readBlock(r, hash)
+		if err == nil {
+			for _, tx := range block.Transactions {
+				if bytes.Equal(tx.ID, ID) {
+					return *tx, nil
+				}
 			}
 		}
+	}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+	// transactions with unspent outputs are kept when their block is pruned
+	tx, err := readPrunedTransaction(r, ID)
+	if err != nil {
+		return Transaction{}, err
 	}
+	return *tx, nil
+}
+
+// FindTransactionBlock finds the block of the best chain containing a transaction
+func (bc *Blockchain) FindTransactionBlock(ID []byte) (*Block, error) {
+	var block *Block
+	err := bc.store.View(func(r storage.ChainReader) error {
+		hash := r.Index(txIndex, ID)
+		if hash == nil {
+			return errors.New("Transaction is not found")
+		}
 
-	return Transaction{}, errors.New("Transaction is not found")
+		var err error
+		block, err = readBlock(r, hash)
+		return err
+	})
+	return block, err
 }
 
 // FindUTXO finds all unspent transaction outputs and returns transactions with spent outputs removed
@@ -214,11 +266,13 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 // GetBestHeight returns the height of the latest block
 func (bc *Blockchain) GetBestHeight() int {
 	var lastBlock Block
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash := b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
+	err := bc.store.View(func(r storage.ChainReader) error {
+		blockData := r.Block(r.Tip())
+		block, err := DeserializeBlock(blockData)
+		if err != nil {
+			return err
+		}
+		lastBlock = *block
 		return nil
 	})
 	if err != nil {
@@ -227,16 +281,34 @@ func (bc *Blockchain) GetBestHeight() int {
 	return lastBlock.Height
 }
 
+// GetTip returns hash of the last block
+func (bc *Blockchain) GetTip() []byte {
+	bc.tipMutex.RLock()
+	defer bc.tipMutex.RUnlock()
+
+	return bc.tip
+}
+
+func (bc *Blockchain) setTip(hash []byte) {
+	bc.tipMutex.Lock()
+	defer bc.tipMutex.Unlock()
+
+	bc.tip = hash
+}
+
 // GetBlock finds a block by its hash and returns it
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockData := b.Get(blockHash)
+	err := bc.store.View(func(r storage.ChainReader) error {
+		blockData := r.Block(blockHash)
 		if blockData == nil {
 			return errors.New("Block is not found.")
 		}
-		block = *DeserializeBlock(blockData)
+		found, err := DeserializeBlock(blockData)
+		if err != nil {
+			return err
+		}
+		block = *found
 		return nil
 	})
 	if err != nil {
@@ -251,6 +323,10 @@ func (bc *Blockchain) GetBlockHashes() [][]byte {
 	bci := bc.Iterator()
 	for {
 		block := bci.Next()
+		// bodies of pruned blocks are not kept
+		if len(block.Hash) == 0 {
+			break
+		}
 		blocks = append(blocks, block.Hash)
 		if len(block.PrevBlockHash) == 0 {
 			break
@@ -259,26 +335,62 @@ func (bc *Blockchain) GetBlockHashes() [][]byte {
 	return blocks
 }
 
-// MineBlock mines a new block with the provided transactions
+/*
+* GetHeaders returns up to max headers of the chain following the latest
+* block of the locator, oldest first. Headers from genesis are returned
+* if no block of the locator is in the chain
+ */
+func (bc *Blockchain) GetHeaders(locator [][]byte, max int) []BlockHeader {
+	known := make(map[string]bool)
+	for _, hash := range locator {
+		known[hex.EncodeToString(hash)] = true
+	}
+
+	var headers []BlockHeader
+	// headers of pruned blocks are kept without bodies
+	bc.store.View(func(r storage.ChainReader) error {
+		hash := r.Tip()
+		for len(hash) > 0 && !known[hex.EncodeToString(hash)] {
+			header, err := readHeader(r, hash)
+			if err != nil {
+				break
+			}
+			headers = append(headers, *header)
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+
+	// headers are collected from the tip
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+	if len(headers) > max {
+		headers = headers[:max]
+	}
+	return headers
+}
+
+/*
+* MineBlock mines a new block with the provided transactions. Transactions
+* which can't be mined together are skipped: invalid ones, ones spending
+* outputs spent already or by an earlier transaction, and ones over the
+* block size limit. Returns nil if the block can't be mined or added
+ */
 func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	var lastHash []byte
 	var lastHeight int
 
-	for _, tx := range transactions {
-		// TODO: ignore transaction if it's not valid
-		check, err := bc.VerifyTransaction(tx)
-		if err != nil || !check {
-			fmt.Printf("ERROR: Invalid transaction: %v\n", err)
-			return nil
-		}
-	}
+	transactions = bc.selectTransactions(transactions)
 
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+	err := bc.store.View(func(r storage.ChainReader) error {
+		lastHash = append([]byte{}, r.Tip()...)
 
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
+		blockData := r.Block(lastHash)
+		block, err := DeserializeBlock(blockData)
+		if err != nil {
+			return err
+		}
 		lastHeight = block.Height
 		return nil
 	})
@@ -288,37 +400,78 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 		//log.Panic(err)
 	}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
+	// timestamp of a new block should be after median time of previous blocks
+	timestamp := Now().Unix()
+	if median, ok := bc.medianTimePast(lastHash); ok && timestamp <= median {
+		timestamp = median + 1
+	}
+	newBlock := mineBlock(&Block{timestamp, transactions, lastHash, []byte{}, 0, lastHeight + 1})
 
 	if newBlock == nil {
 		fmt.Printf("ERROR: NewBlock returns nil")
 		return nil
 	}
+	if size := len(newBlock.Serialize()); size > MaxBlockSize {
+		fmt.Printf("ERROR: Block size %d is over limit %d\n", size, MaxBlockSize)
+		return nil
+	}
 
-	err = bc.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
+	// the block, its UTXO changes and indexes are saved in one batch
+	err = bc.AddBlock(newBlock)
+	if err != nil {
+		fmt.Printf("ERROR: AddBlock %v\n", err)
+		return nil
+	}
+	return newBlock
+}
 
-		err = b.Put([]byte("l"), newBlock.Hash)
-		if err != nil {
-			fmt.Printf("ERROR: b.Put %v\n", err)
-			return nil
-			//log.Panic(err)
+// Picks transactions which can be mined together in the next block
+func (bc *Blockchain) selectTransactions(transactions []*Transaction) []*Transaction {
+	selected := []*Transaction{}
+	spent := make(map[string]bool)
+	size := 0
+
+	for _, tx := range transactions {
+		txSize := len(tx.Serialize())
+		if size+txSize > MaxBlockSize {
+			fmt.Printf("ERROR: Transaction %x is over block size limit\n", tx.ID)
+			continue
 		}
+		if !tx.IsCoinbase() {
+			check, err := bc.VerifyTransaction(tx)
+			if err == nil && !check {
+				err = errors.New("Signature is not valid")
+			}
+			if err == nil {
+				err = bc.CheckTransactionInputs(tx)
+			}
+			if err != nil {
+				fmt.Printf("ERROR: Invalid transaction %x: %v\n", tx.ID, err)
+				continue
+			}
 
-		bc.tip = newBlock.Hash
+			inputs := make(map[string]bool)
+			conflict := false
+			for _, vin := range tx.Vin {
+				key := string(outpointKey(vin.Txid, vin.Vout))
+				if spent[key] || inputs[key] {
+					conflict = true
+				}
+				inputs[key] = true
+			}
+			if conflict {
+				fmt.Printf("ERROR: Transaction %x spends an output spent in the block\n", tx.ID)
+				continue
+			}
+			for key := range inputs {
+				spent[key] = true
+			}
+		}
 
-		return nil
-	})
-	if err != nil {
-		fmt.Printf("ERROR: db.Update %v\n", err)
-		return nil
-		//log.Panic(err)
+		selected = append(selected, tx)
+		size += txSize
 	}
-	return newBlock
+	return selected
 }
 
 // SignTransaction signs inputs of a Transaction
@@ -366,11 +519,15 @@ func (bc *Blockchain) SignTransaction(tx *Transaction, privKey crypto.PrivateKey
 	tx.Sign(privKey, prevTXs)
 }
 
-// VerifyTransaction verifies transaction input signatures
+// VerifyTransaction verifies transaction input signatures and that its locks allow to mine it in the next block
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) (bool, error) {
 	if tx.IsCoinbase() {
 		return true, nil
 	}
+	err := bc.CheckTransactionLocks(tx)
+	if err != nil {
+		return false, err
+	}
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
@@ -384,6 +541,26 @@ func (bc *Blockchain) VerifyTransaction(tx *Transaction) (bool, error) {
 	return tx.Verify(prevTXs)
 }
 
+// CheckTransactionInputs checks that outputs spent by the transaction are unspent
+func (bc *Blockchain) CheckTransactionInputs(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+	return bc.store.View(func(r storage.ChainReader) error {
+		for _, vin := range tx.Vin {
+			outpoint := outpointKey(vin.Txid, vin.Vout)
+			data, found := bc.utxos.get(outpoint)
+			if !found {
+				data = r.UTXO(outpoint)
+			}
+			if data == nil {
+				return fmt.Errorf("Output %x:%d is spent or unknown", vin.Txid, vin.Vout)
+			}
+		}
+		return nil
+	})
+}
+
 func (bc *Blockchain) GetBalance(address string) int {
 	UTXOSet := UTXOSet{bc}
 	balance := 0
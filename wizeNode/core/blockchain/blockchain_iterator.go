@@ -3,25 +3,30 @@ package blockchain
 import (
 	"log"
 
-	"github.com/boltdb/bolt"
+	"wizeBlock/wizeNode/core/storage"
 )
 
 // BlockchainIterator is used to iterate over blockchain blocks
 type BlockchainIterator struct {
 	currentHash []byte
-	db          *bolt.DB
+	store       storage.ChainStore
 }
 
-// Next returns next block starting from the tip
+// Next returns next block starting from the tip. Empty block is returned
+// when the previous block is not received yet, so iteration stops there
 func (i *BlockchainIterator) Next() *Block {
 	var block *Block
 
-	err := i.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		encodedBlock := b.Get(i.currentHash)
-		block = DeserializeBlock(encodedBlock)
+	err := i.store.View(func(r storage.ChainReader) error {
+		encodedBlock := r.Block(i.currentHash)
+		if encodedBlock == nil {
+			block = &Block{}
+			return nil
+		}
 
-		return nil
+		var err error
+		block, err = DeserializeBlock(encodedBlock)
+		return err
 	})
 
 	if err != nil {
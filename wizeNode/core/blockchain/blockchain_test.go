@@ -0,0 +1,33 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestMineBlockSkipsConflicts(t *testing.T) {
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+	other := newTestWallet().Address
+
+	first := spendGenesis(bc, owner, genesis, *NewTXOutput(testEmission, other))
+	second := spendGenesis(bc, owner, genesis, *NewTXOutput(testEmission, address))
+	assert.Nil(t, bc.CheckTransactionInputs(second), "Output is unspent")
+
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), first, second})
+	if !assert.NotNil(t, block, "Block is mined") {
+		return
+	}
+	assert.Equal(t, 2, len(block.Transactions), "Conflicting transaction is skipped")
+	assert.Equal(t, first.ID, block.Transactions[1].ID, "The first transaction is mined")
+	assert.Equal(t, testEmission, bc.GetBalance(other), "Output is spent once")
+
+	assert.NotNil(t, bc.CheckTransactionInputs(second), "Output is spent")
+	block = bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), second})
+	if assert.NotNil(t, block, "Block is mined") {
+		assert.Equal(t, 1, len(block.Transactions), "Spent output is not spent again")
+	}
+}
@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"wizeBlock/wizeNode/core/crypto"
+)
+
+/*
+* BlockFilter is a compact filter of a block for light clients. It holds
+* pubkey hashes of all outputs and outpoints spent by the block, so a client
+* learns if the block touches its addresses without downloading the block
+ */
+type BlockFilter struct {
+	BlockHash []byte
+	Filter    []byte
+}
+
+// Builds filter of the block
+func NewBlockFilter(b *Block) *BlockFilter {
+	return &BlockFilter{
+		BlockHash: b.Hash,
+		Filter:    crypto.BuildGCSFilter(crypto.BlockFilterKey(b.Hash), BlockFilterElements(b)),
+	}
+}
+
+// Returns elements of the block put into its filter
+func BlockFilterElements(b *Block) [][]byte {
+	elements := [][]byte{}
+
+	for _, tx := range b.Transactions {
+		for _, out := range tx.Vout {
+			if len(out.PubKeyHash) > 0 {
+				elements = append(elements, out.PubKeyHash)
+			}
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			elements = append(elements, crypto.OutpointFilterElement(in.Txid, in.Vout))
+		}
+	}
+
+	return elements
+}
+
+// Returns true if any of the elements is probably in the block
+func (f *BlockFilter) Match(elements [][]byte) (bool, error) {
+	return crypto.MatchGCSFilter(f.Filter, crypto.BlockFilterKey(f.BlockHash), elements)
+}
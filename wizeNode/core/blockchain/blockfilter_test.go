@@ -0,0 +1,35 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/crypto"
+)
+
+func TestBlockFilter(t *testing.T) {
+	chaincfg.SelectNetwork(chaincfg.RegTestParams.Name)
+	defer chaincfg.SelectNetwork(chaincfg.MainNetParams.Name)
+
+	_, public := crypto.NewKeyPair()
+	coinbase := NewCoinbaseTX(string(crypto.GetAddress(public)), "")
+	tx1 := testTransaction("tx1")
+	block := NewBlock([]*Transaction{coinbase, tx1}, []byte("prev"), 1)
+	filter := NewBlockFilter(block)
+
+	match, err := filter.Match([][]byte{crypto.HashPubKey(public)})
+	assert.Nil(t, err, "Filter is decoded")
+	assert.True(t, match, "Output pubkey hash is in the filter")
+
+	match, _ = filter.Match([][]byte{crypto.OutpointFilterElement([]byte("prevtx1"), 0)})
+	assert.True(t, match, "Spent outpoint is in the filter")
+
+	match, _ = filter.Match([][]byte{crypto.OutpointFilterElement([]byte("prevtx1"), 1)})
+	assert.False(t, match, "Other output of the transaction is not in the filter")
+
+	_, other := crypto.NewKeyPair()
+	match, _ = filter.Match([][]byte{crypto.HashPubKey(other)})
+	assert.False(t, match, "Other address is not in the filter")
+}
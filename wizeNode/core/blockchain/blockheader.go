@@ -0,0 +1,40 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+)
+
+// BlockHeader is a block without transactions
+type BlockHeader struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	Hash          []byte
+	Nonce         int
+	Height        int
+	MerkleRoot    []byte
+}
+
+// Header returns header of the block
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{b.Timestamp, b.PrevBlockHash, b.Hash, b.Nonce, b.Height, b.HashTransactions()}
+}
+
+// Validate checks that the header hash is proof-of-work of its data
+func (h BlockHeader) Validate() error {
+	hash := sha256.Sum256(powData(h.PrevBlockHash, h.MerkleRoot, h.Timestamp, h.Nonce))
+	if !bytes.Equal(hash[:], h.Hash) {
+		return fmt.Errorf("Block header %x doesn't match its hash", h.Hash)
+	}
+
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-chaincfg.Active.TargetBits))
+	if new(big.Int).SetBytes(hash[:]).Cmp(target) != -1 {
+		return fmt.Errorf("Block header %x doesn't meet target", h.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/storage"
+)
+
+/*
+* Chain file keeps blocks of the best chain from genesis in height order.
+* Every block is a record of network magic bytes, length of the block and
+* the serialized block, like frames of network messages. So a chain of one
+* network can't be imported by nodes of other network
+ */
+
+// Export writes blocks of the best chain to the chain file. Returns count of blocks
+func (bc *Blockchain) Export(w io.Writer) (int, error) {
+	count := 0
+	buffered := bufio.NewWriter(w)
+
+	err := bc.store.View(func(r storage.ChainReader) error {
+		if height := prunedHeight(r); height > 0 {
+			return fmt.Errorf("Blocks below height %d are pruned", height)
+		}
+		tip, err := readBlock(r, r.Tip())
+		if err != nil {
+			return err
+		}
+
+		for height := 0; height <= tip.Height; height++ {
+			data := r.Block(r.Index(heightIndex, heightKey(height)))
+			if data == nil {
+				return fmt.Errorf("Block at height %d is not found", height)
+			}
+			err = writeRecord(buffered, data)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, buffered.Flush()
+}
+
+/*
+* Import reads blocks from the chain file, validates and connects them.
+* The file should start with the same genesis, blocks known already are
+* skipped. Returns count of imported blocks
+ */
+func (bc *Blockchain) Import(r io.Reader) (int, error) {
+	return bc.importBlocks(bufio.NewReader(r))
+}
+
+/*
+* ImportBlockchain imports the chain file to the store. If the store is
+* empty, the chain is created from genesis of the file, so a new node can
+* be started without network
+ */
+func ImportBlockchain(store storage.ChainStore, r io.Reader) (*Blockchain, int, error) {
+	buffered := bufio.NewReader(r)
+
+	empty := false
+	store.View(func(r storage.ChainReader) error {
+		empty = r.Tip() == nil
+		return nil
+	})
+
+	var bc *Blockchain
+	created := 0
+	if empty {
+		genesis, err := readChainRecord(buffered)
+		if err != nil {
+			return nil, 0, err
+		}
+		bc, err = CreateBlockchainFromGenesis(genesis, store)
+		if err != nil {
+			return nil, 0, err
+		}
+		created = 1
+	} else {
+		var err error
+		bc, err = NewBlockchainFromStore(store)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	count, err := bc.importBlocks(buffered)
+	return bc, created + count, err
+}
+
+func (bc *Blockchain) importBlocks(r io.Reader) (int, error) {
+	count := 0
+	for {
+		block, err := readChainRecord(r)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		known, err := bc.inBestChain(block)
+		if err != nil {
+			return count, err
+		}
+		if known {
+			continue
+		}
+
+		err = bc.ValidateBlock(block)
+		if err != nil {
+			return count, err
+		}
+		err = bc.AddBlock(block)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// Checks the block is in the best chain already. Other genesis is an error
+func (bc *Blockchain) inBestChain(block *Block) (bool, error) {
+	known := false
+	bc.store.View(func(r storage.ChainReader) error {
+		known = bytes.Equal(r.Index(heightIndex, heightKey(block.Height)), block.Hash)
+		return nil
+	})
+	if !known && block.Height == 0 {
+		return false, fmt.Errorf("Genesis block %x differs from known one", block.Hash)
+	}
+	return known, nil
+}
+
+func writeRecord(w io.Writer, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, chaincfg.Active.Magic)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Reads the next block of the chain file, io.EOF is returned at the end of the file
+func readChainRecord(r io.Reader) (*Block, error) {
+	data, err := readRecord(r, MaxBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeBlock(data)
+}
+
+// Reads the next record of up to limit bytes, io.EOF is returned at the end of the file
+func readRecord(r io.Reader, limit int) ([]byte, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("File is truncated: %s", err)
+	}
+
+	if magic := binary.BigEndian.Uint32(header); magic != chaincfg.Active.Magic {
+		return nil, fmt.Errorf("Wrong network magic %08x", magic)
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > uint32(limit) {
+		return nil, fmt.Errorf("Record size %d is over limit %d", length, limit)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("File is truncated: %s", err)
+	}
+	return data, nil
+}
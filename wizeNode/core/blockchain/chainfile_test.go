@@ -0,0 +1,65 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestExportImportChain(t *testing.T) {
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+	other := newTestWallet().Address
+
+	tx := spendGenesis(bc, owner, genesis, *NewTXOutput(10, other), *NewTXOutput(990, address))
+	assert.NotNil(t, bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), tx}), "Block is mined")
+	assert.NotNil(t, bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")}), "Block is mined")
+
+	file := &bytes.Buffer{}
+	count, err := bc.Export(file)
+	assert.Nil(t, err, "Chain is exported")
+	assert.Equal(t, 3, count, "All blocks are exported")
+	data := file.Bytes()
+
+	imported, count, err := ImportBlockchain(storage.NewMemoryChainStore(), bytes.NewReader(data))
+	if !assert.Nil(t, err, "Chain is imported") {
+		return
+	}
+	assert.Equal(t, 3, count, "All blocks are imported")
+	assert.Equal(t, bc.GetTip(), imported.GetTip(), "Tip is the same")
+	assert.Equal(t, UTXOSet{bc}.Digest(), UTXOSet{imported}.Digest(), "UTXO set is the same")
+	assert.Equal(t, 10, imported.GetBalance(other), "Balance is the same")
+
+	count, err = imported.Import(bytes.NewReader(data))
+	assert.Nil(t, err, "Chain is imported again")
+	assert.Equal(t, 0, count, "Known blocks are skipped")
+
+	_, _, err = ImportBlockchain(storage.NewMemoryChainStore(), bytes.NewReader(data[:len(data)-1]))
+	assert.NotNil(t, err, "Truncated file is rejected")
+
+	// block with changed content but old proof-of-work
+	block, _ := bc.GetBlock(bc.GetTip())
+	block.Nonce++
+	tampered := chainFile(t, genesis, &block)
+	_, count, err = ImportBlockchain(storage.NewMemoryChainStore(), tampered)
+	assert.NotNil(t, err, "Block with wrong proof-of-work is rejected")
+	assert.Equal(t, 1, count, "Only genesis is imported")
+
+	// block with valid proof-of-work but with a changed transaction
+	forged := *tx
+	forged.Vout = []TXOutput{*NewTXOutput(1000, other)}
+	forgedBlock := NewBlock([]*Transaction{NewCoinbaseTX(address, ""), &forged}, genesis.Hash, 1)
+	_, _, err = ImportBlockchain(storage.NewMemoryChainStore(), chainFile(t, genesis, forgedBlock))
+	assert.NotNil(t, err, "Block with wrong signature is rejected")
+}
+
+func chainFile(t *testing.T, blocks ...*Block) *bytes.Buffer {
+	file := &bytes.Buffer{}
+	for _, block := range blocks {
+		assert.Nil(t, writeRecord(file, block.Serialize()), "Block is written")
+	}
+	return file
+}
@@ -0,0 +1,664 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+// Indexes kept in the chain store with the UTXO set
+const (
+	// height of a block in the best chain to its hash
+	heightIndex = "height"
+	// ID of a transaction in the best chain to hash of its block
+	txIndex = "tx"
+	// hash of a block in the best chain to its undo data
+	undoIndex = "undo"
+	// hash of a block which ancestors are not received yet to the previous hash
+	orphanIndex = "orphan"
+	// hash of an orphan block to the time it was received
+	orphanTimeIndex = "orphantime"
+	// state of the UTXO set
+	stateIndex = "state"
+)
+
+// Limits of orphan blocks, the oldest ones are removed when they are exceeded
+const (
+	maxOrphanBlocks = 100
+	maxOrphanBytes  = 8 * MaxBlockSize
+)
+
+// hash of the block the UTXO set is built for, it is always the tip
+var utxoTipKey = []byte("utxotip")
+
+// format of the saved UTXO set, a set of another format is rebuilt. Version 2
+// keys outputs by outpoint, unmarked sets keep all outputs of a transaction
+var (
+	utxoVersionKey = []byte("utxoversion")
+	utxoVersion    = []byte{2}
+)
+
+// Error of a block which can't be connected to the best chain
+type invalidBlockError struct {
+	hash []byte
+	err  error
+}
+
+func (e *invalidBlockError) Error() string {
+	return e.err.Error()
+}
+
+/*
+* Undo data of a block: UTXO records changed by the block as they were
+* before it. A block is disconnected by writing them back
+ */
+type blockUndo struct {
+	Records []undoRecord
+}
+
+type undoRecord struct {
+	Outpoint []byte
+	Entry    []byte
+	Exists   bool
+}
+
+/*
+* Saves the block and connects it to the chain in one batch. Only blocks
+* with valid proof-of-work are saved. A block which parent is not known is
+* kept as an orphan and is connected when its ancestors come. If the block
+* or its connected descendants make a longer chain it becomes the best one:
+* blocks of the old chain are disconnected with undo data and blocks of the
+* new chain are validated and connected
+ */
+func (bc *Blockchain) AddBlock(block *Block) error {
+	err := checkBlock(block)
+	if err != nil {
+		return err
+	}
+
+	bc.chainMutex.Lock()
+	defer bc.chainMutex.Unlock()
+
+	for {
+		err = bc.addBlock(block)
+		invalid, ok := err.(*invalidBlockError)
+		if !ok || bytes.Equal(invalid.hash, block.Hash) {
+			return err
+		}
+		// an invalid descendant received earlier is removed, so it doesn't stop the block
+		fmt.Printf("ERROR: Block %x is removed: %s\n", invalid.hash, invalid.err)
+		err = bc.store.Update(func(b storage.ChainBatch) error {
+			return removeOrphans(b, invalid.hash)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Saves and connects the block, the chain mutex should be locked
+func (bc *Blockchain) addBlock(block *Block) error {
+	var newTip []byte
+	var view *cachedUTXOView
+	connected, flushed, reorganized := 0, false, false
+	err := bc.store.Update(func(b storage.ChainBatch) error {
+		if b.Block(block.Hash) != nil {
+			return nil
+		}
+		// genesis comes only to a chain started from a UTXO snapshot
+		snapshot := b.Index(stateIndex, snapshotBlockKey) != nil
+		if len(block.PrevBlockHash) == 0 && !snapshot {
+			return fmt.Errorf("Genesis block %x differs from known one", block.Hash)
+		}
+
+		err := b.PutBlock(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		if len(block.PrevBlockHash) == 0 {
+			_, err = connectOrphans(b, block)
+			return err
+		}
+		if b.Block(block.PrevBlockHash) == nil || b.Index(orphanIndex, block.PrevBlockHash) != nil {
+			return addOrphan(b, block)
+		}
+
+		best, err := connectOrphans(b, block)
+		if err != nil {
+			return err
+		}
+		tip, err := readBlock(b, b.Tip())
+		if err != nil {
+			return err
+		}
+		if best.Height <= tip.Height {
+			return nil
+		}
+
+		fork, branch, err := findFork(b, best)
+		if err != nil {
+			return err
+		}
+		view = bc.utxos.newView(b)
+		var utxos utxoView = view
+		if !bytes.Equal(fork.Hash, tip.Hash) {
+			// reorganization is rare, the cache is flushed and it works with saved set
+			reorganized = true
+			err = view.flush()
+			if err != nil {
+				return err
+			}
+			utxos = b
+		}
+
+		err = setMainChain(b, utxos, tip, fork, branch)
+		if err != nil {
+			return err
+		}
+		newTip = best.Hash
+		connected = len(branch)
+
+		// blocks after the flush marker are not pruned, so a pruned chain is flushed more often
+		_, flushedHeight, _ := utxoTip(b)
+		pruneBehind := bc.pruneDepth > 0 && flushedHeight <= best.Height-bc.pruneDepth
+		if !reorganized && (bc.utxos.shouldFlush(view.size) || pruneBehind) {
+			flushed = true
+			err = view.flush()
+			if err != nil {
+				return err
+			}
+		}
+		if reorganized || flushed {
+			err = setUTXOTip(b, best)
+			if err != nil {
+				return err
+			}
+		}
+
+		if bc.pruneDepth > 0 {
+			return pruneBlocks(b, utxos, bc.pruneDepth)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if reorganized {
+		bc.utxos.clear()
+	} else if view != nil {
+		bc.utxos.apply(view.changes, connected, flushed)
+	}
+	// tip is changed after commit, so readers always find it in DB
+	if newTip != nil {
+		bc.setTip(newTip)
+	}
+	return nil
+}
+
+/*
+* Reindex rebuilds the UTXO set and indexes from saved blocks in one batch.
+* The best block which ancestors are all known becomes the tip
+ */
+func (bc *Blockchain) Reindex() error {
+	return bc.ReindexWithProgress(nil)
+}
+
+// ReindexWithProgress rebuilds the chain state like Reindex, progress is called after every connected block
+func (bc *Blockchain) ReindexWithProgress(progress func(done, total int)) error {
+	bc.chainMutex.Lock()
+	defer bc.chainMutex.Unlock()
+
+	var newTip []byte
+	err := bc.store.Update(func(b storage.ChainBatch) error {
+		if b.Index(stateIndex, snapshotBlockKey) != nil {
+			return errors.New("Chain started from a UTXO snapshot can't be reindexed before it is validated")
+		}
+		if prunedHeight(b) > 0 {
+			return errors.New("Pruned chain can't be reindexed")
+		}
+
+		type blockLink struct {
+			prev   []byte
+			height int
+		}
+		links := make(map[string]blockLink)
+		err := b.ForEachBlock(func(hash, data []byte) error {
+			block, err := DeserializeBlock(data)
+			if err != nil {
+				return err
+			}
+			links[string(hash)] = blockLink{block.PrevBlockHash, block.Height}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// a block is complete if all its ancestors down to genesis are known
+		complete := make(map[string]bool)
+		var isComplete func(hash string) bool
+		isComplete = func(hash string) bool {
+			if done, ok := complete[hash]; ok {
+				return done
+			}
+			link, ok := links[hash]
+			done := ok && (len(link.prev) == 0 || isComplete(string(link.prev)))
+			complete[hash] = done
+			return done
+		}
+
+		best := ""
+		tip := string(b.Tip())
+		for hash, link := range links {
+			if !isComplete(hash) {
+				continue
+			}
+			if best == "" || link.height > links[best].height || (link.height == links[best].height && hash == tip) {
+				best = hash
+			}
+		}
+		if best == "" {
+			return errors.New("There are no blocks to build the chain")
+		}
+
+		for _, name := range []string{heightIndex, txIndex, undoIndex, orphanIndex, orphanTimeIndex, stateIndex} {
+			err = b.ClearIndex(name)
+			if err != nil {
+				return err
+			}
+		}
+		err = b.ClearUTXO()
+		if err != nil {
+			return err
+		}
+
+		chain := [][]byte{}
+		for hash := []byte(best); len(hash) > 0; hash = links[string(hash)].prev {
+			chain = append(chain, hash)
+		}
+		var block *Block
+		for i := len(chain) - 1; i >= 0; i-- {
+			block, err = readBlock(b, chain[i])
+			if err != nil {
+				return err
+			}
+			err = connectBlock(b, b, block)
+			if err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(len(chain)-i, len(chain))
+			}
+		}
+
+		for hash, link := range links {
+			if !isComplete(hash) {
+				err = b.PutIndex(orphanIndex, []byte(hash), link.prev)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = setUTXOTip(b, block)
+		if err != nil {
+			return err
+		}
+		newTip = []byte(best)
+		return b.SetTip(newTip)
+	})
+	if err != nil {
+		return err
+	}
+	bc.utxos.clear()
+	bc.setTip(newTip)
+	return nil
+}
+
+/*
+* Checks that the UTXO set and indexes are built for the tip. Changes of
+* the UTXO cache after the last flush are lost on crash, so the saved set
+* is rolled forward from the block it is marked with. Chains saved before
+* blocks were connected in one batch may have a stale UTXO set or a tip
+* with missing ancestors, they are rebuilt
+ */
+func (bc *Blockchain) checkChainState() error {
+	consistent, behind := false, false
+	bc.store.View(func(r storage.ChainReader) error {
+		tip := r.Tip()
+		block, err := readBlock(r, tip)
+		if err != nil || !bytes.Equal(r.Index(heightIndex, heightKey(block.Height)), tip) {
+			return nil
+		}
+		if !bytes.Equal(r.Index(stateIndex, utxoVersionKey), utxoVersion) {
+			return nil
+		}
+		consistent = bytes.Equal(r.Index(stateIndex, utxoTipKey), tip)
+
+		hash, height, ok := utxoTip(r)
+		behind = ok && height < block.Height && bytes.Equal(r.Index(heightIndex, heightKey(height)), hash)
+		return nil
+	})
+	if consistent {
+		return nil
+	}
+	if behind {
+		return bc.rollForwardUTXO()
+	}
+
+	fmt.Printf("WARNING: Chain state doesn't match the tip %x, rebuilding it\n", bc.GetTip())
+	return bc.Reindex()
+}
+
+// Connects blocks of the best chain after the flush marker to the saved UTXO set
+func (bc *Blockchain) rollForwardUTXO() error {
+	return bc.store.Update(func(b storage.ChainBatch) error {
+		_, height, _ := utxoTip(b)
+		tip, err := readBlock(b, b.Tip())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("WARNING: UTXO set is saved for height %d, rolling it forward to %d\n", height, tip.Height)
+
+		for h := height + 1; h <= tip.Height; h++ {
+			block, err := readBlock(b, b.Index(heightIndex, heightKey(h)))
+			if err != nil {
+				return err
+			}
+			err = connectBlock(b, b, block)
+			if err != nil {
+				return err
+			}
+		}
+		return setUTXOTip(b, tip)
+	})
+}
+
+// Connects orphans which ancestors are known now. Returns the highest connected block
+func connectOrphans(b storage.ChainBatch, block *Block) (*Block, error) {
+	children := make(map[string][][]byte)
+	err := b.ForEachIndex(orphanIndex, func(hash, prev []byte) error {
+		children[string(prev)] = append(children[string(prev)], append([]byte{}, hash...))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	best := block
+	queue := [][]byte{block.Hash}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		for _, childHash := range children[string(hash)] {
+			err := deleteOrphanIndex(b, childHash)
+			if err != nil {
+				return nil, err
+			}
+			child, err := readBlock(b, childHash)
+			if err != nil {
+				return nil, err
+			}
+			if child.Height > best.Height {
+				best = child
+			}
+			queue = append(queue, childHash)
+		}
+	}
+	return best, nil
+}
+
+/*
+* Keeps the saved block as an orphan. When there are too many orphans or
+* they are too big, the oldest ones are removed with their bodies
+ */
+func addOrphan(b storage.ChainBatch, block *Block) error {
+	err := b.PutIndex(orphanIndex, block.Hash, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	received := make([]byte, 8)
+	binary.BigEndian.PutUint64(received, uint64(time.Now().UnixNano()))
+	err = b.PutIndex(orphanTimeIndex, block.Hash, received)
+	if err != nil {
+		return err
+	}
+
+	type orphan struct {
+		hash     []byte
+		size     int
+		received uint64
+	}
+	orphans := []orphan{}
+	size := 0
+	err = b.ForEachIndex(orphanIndex, func(hash, prev []byte) error {
+		item := orphan{hash: append([]byte{}, hash...), size: len(b.Block(hash))}
+		// orphans saved before times were kept are the oldest
+		if data := b.Index(orphanTimeIndex, hash); len(data) == 8 {
+			item.received = binary.BigEndian.Uint64(data)
+		}
+		orphans = append(orphans, item)
+		size += item.size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].received < orphans[j].received
+	})
+	for len(orphans) > maxOrphanBlocks || size > maxOrphanBytes {
+		oldest := orphans[0]
+		orphans = orphans[1:]
+		size -= oldest.size
+
+		err = deleteOrphanIndex(b, oldest.hash)
+		if err != nil {
+			return err
+		}
+		err = b.DeleteBlock(oldest.hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the block and orphans descending from it
+func removeOrphans(b storage.ChainBatch, hash []byte) error {
+	children := make(map[string][][]byte)
+	err := b.ForEachIndex(orphanIndex, func(hash, prev []byte) error {
+		children[string(prev)] = append(children[string(prev)], append([]byte{}, hash...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	queue := [][]byte{hash}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = append(queue[1:], children[string(hash)]...)
+
+		err = deleteOrphanIndex(b, hash)
+		if err != nil {
+			return err
+		}
+		err = b.DeleteBlock(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteOrphanIndex(b storage.ChainBatch, hash []byte) error {
+	err := b.DeleteIndex(orphanIndex, hash)
+	if err != nil {
+		return err
+	}
+	return b.DeleteIndex(orphanTimeIndex, hash)
+}
+
+// Finds the fork of the block with the best chain. Returns blocks of the branch after the fork from the newest
+func findFork(b storage.ChainBatch, block *Block) (*Block, []*Block, error) {
+	branch := []*Block{}
+	fork := block
+	for !bytes.Equal(b.Index(heightIndex, heightKey(fork.Height)), fork.Hash) {
+		if len(fork.PrevBlockHash) == 0 {
+			return nil, nil, fmt.Errorf("Block %x is not in the chain of known genesis", block.Hash)
+		}
+		branch = append(branch, fork)
+
+		prev, err := readBlock(b, fork.PrevBlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		fork = prev
+	}
+	return fork, branch, nil
+}
+
+// Makes the branch the best chain, blocks are disconnected from the tip down to the fork and the branch is connected
+func setMainChain(b storage.ChainBatch, utxos utxoView, tip, fork *Block, branch []*Block) error {
+	current := tip
+	for !bytes.Equal(current.Hash, fork.Hash) {
+		err := disconnectBlock(b, utxos, current)
+		if err != nil {
+			return err
+		}
+		current, err = readBlock(b, current.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		err := checkConnect(b, branch[i])
+		if err != nil {
+			return &invalidBlockError{branch[i].Hash, err}
+		}
+		err = connectBlock(b, utxos, branch[i])
+		if err != nil {
+			return err
+		}
+	}
+	return b.SetTip(branch[0].Hash)
+}
+
+// Applies transactions of the block to the UTXO set, saves its undo data and indexes
+func connectBlock(b storage.ChainBatch, utxos utxoView, block *Block) error {
+	undo := blockUndo{}
+	touched := make(map[string]bool)
+	remember := func(outpoint []byte) {
+		if touched[string(outpoint)] {
+			return
+		}
+		touched[string(outpoint)] = true
+		entry := utxos.UTXO(outpoint)
+		undo.Records = append(undo.Records, undoRecord{outpoint, append([]byte{}, entry...), entry != nil})
+	}
+
+	// locks are checked with the median time of previous blocks
+	median, _ := medianTime(b, block.PrevBlockHash)
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			if !tx.IsFinal(block.Height, median) {
+				return fmt.Errorf("Transaction %x is locked until %d", tx.ID, tx.LockTime)
+			}
+			for _, vin := range tx.Vin {
+				outpoint := outpointKey(vin.Txid, vin.Vout)
+				data := utxos.UTXO(outpoint)
+				if data == nil {
+					return fmt.Errorf("Transaction %x spends unknown output %x:%d", tx.ID, vin.Txid, vin.Vout)
+				}
+				err := checkInputLocks(b, vin, DeserializeUTXOEntry(data), block.Height, median)
+				if err != nil {
+					return err
+				}
+				remember(outpoint)
+				err = utxos.DeleteUTXO(outpoint)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for outIdx, out := range tx.Vout {
+			outpoint := outpointKey(tx.ID, outIdx)
+			remember(outpoint)
+			err := utxos.PutUTXO(outpoint, UTXOEntry{out, block.Height, tx.IsCoinbase()}.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+		err := b.PutIndex(txIndex, tx.ID, block.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := gobEncode(undo)
+	if err != nil {
+		return err
+	}
+	err = b.PutIndex(undoIndex, block.Hash, data)
+	if err != nil {
+		return err
+	}
+	return b.PutIndex(heightIndex, heightKey(block.Height), block.Hash)
+}
+
+// Reverts changes of the block in the UTXO set and removes it from indexes
+func disconnectBlock(b storage.ChainBatch, utxos utxoView, block *Block) error {
+	data := b.Index(undoIndex, block.Hash)
+	if data == nil {
+		return fmt.Errorf("Undo data of block %x is not found", block.Hash)
+	}
+	var undo blockUndo
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+	if err != nil {
+		return err
+	}
+
+	for i := len(undo.Records) - 1; i >= 0; i-- {
+		record := undo.Records[i]
+		if record.Exists {
+			err = utxos.PutUTXO(record.Outpoint, record.Entry)
+		} else {
+			err = utxos.DeleteUTXO(record.Outpoint)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		err = b.DeleteIndex(txIndex, tx.ID)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.DeleteIndex(undoIndex, block.Hash)
+	if err != nil {
+		return err
+	}
+	return b.DeleteIndex(heightIndex, heightKey(block.Height))
+}
+
+func readBlock(r storage.ChainReader, hash []byte) (*Block, error) {
+	data := r.Block(hash)
+	if data == nil {
+		return nil, fmt.Errorf("Block %x is not found", hash)
+	}
+	return DeserializeBlock(data)
+}
@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestAddBlockConnectsChainState(t *testing.T) {
+	store := storage.NewMemoryChainStore()
+	bc, owner, genesis := newTestChain(t, store)
+	address := owner.Address
+	assert.Equal(t, 1000, bc.GetBalance(address), "Genesis output is unspent")
+
+	spend := spendGenesis(bc, owner, genesis, *NewTXOutput(10, address))
+	blockA := newTestBlock(genesis, NewCoinbaseTX(address, ""), spend)
+	assert.Nil(t, bc.AddBlock(blockA), "Block is added")
+	assert.Equal(t, blockA.Hash, bc.GetTip(), "Block is the tip")
+	assert.Equal(t, 10, bc.GetBalance(address), "Genesis output is spent")
+	_, err := bc.FindTransaction(spend.ID)
+	assert.Nil(t, err, "Transaction is indexed")
+
+	// longer branch comes from the tip down
+	blockB1 := newTestBlock(genesis, NewCoinbaseTX(address, ""))
+	blockB2 := newTestBlock(blockB1, NewCoinbaseTX(address, ""))
+	assert.Nil(t, bc.AddBlock(blockB2), "Orphan block is added")
+	assert.Equal(t, blockA.Hash, bc.GetTip(), "Orphan block doesn't change the tip")
+
+	assert.Nil(t, bc.AddBlock(blockB1), "Missing block is added")
+	assert.Equal(t, blockB2.Hash, bc.GetTip(), "Longer branch becomes the best chain")
+	assert.Equal(t, 1000, bc.GetBalance(address), "Spent output is restored with undo data")
+	_, err = bc.FindTransaction(spend.ID)
+	assert.NotNil(t, err, "Transaction of disconnected block is not found")
+	_, err = bc.FindTransaction(blockB2.Transactions[0].ID)
+	assert.Nil(t, err, "Transaction of connected block is found")
+
+	digest := UTXOSet{bc}.Digest()
+	assert.Nil(t, bc.Reindex(), "Chain is reindexed")
+	assert.Equal(t, digest, UTXOSet{bc}.Digest(), "Incremental UTXO set equals rebuilt one")
+
+	bad := &Transaction{
+		ID:   []byte("bad"),
+		Vin:  []TXInput{{Txid: []byte("unknown"), Vout: 0}},
+		Vout: []TXOutput{*NewTXOutput(10, address)},
+	}
+	blockC := newTestBlock(blockB2, NewCoinbaseTX(address, ""), bad)
+	assert.NotNil(t, bc.AddBlock(blockC), "Block spending unknown output is rejected")
+	_, err = bc.GetBlock(blockC.Hash)
+	assert.NotNil(t, err, "Rejected block is not saved")
+	assert.Equal(t, blockB2.Hash, bc.GetTip(), "Tip is not changed")
+
+	// UTXO set left behind the tip is rebuilt on start
+	store.Update(func(b storage.ChainBatch) error {
+		return b.PutIndex(stateIndex, utxoTipKey, genesis.Hash)
+	})
+	bc, err = NewBlockchainFromStore(store)
+	assert.Nil(t, err, "Blockchain is opened")
+	assert.Equal(t, blockB2.Hash, bc.GetTip(), "Tip is kept")
+	assert.Equal(t, digest, UTXOSet{bc}.Digest(), "UTXO set is repaired")
+}
+
+func TestAddBlockChecksOrphans(t *testing.T) {
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+
+	tampered := newTestBlock(genesis, NewCoinbaseTX(address, ""))
+	tampered.Nonce++
+	assert.NotNil(t, bc.AddBlock(tampered), "Block with wrong proof-of-work is rejected")
+	_, err := bc.GetBlock(tampered.Hash)
+	assert.NotNil(t, err, "Rejected block is not saved")
+
+	// orphan is validated when it is connected
+	parent := newTestBlock(genesis, NewCoinbaseTX(address, ""))
+	overspend := spendGenesis(bc, owner, genesis, *NewTXOutput(2*testEmission, address))
+	child := newTestBlock(parent, NewCoinbaseTX(address, ""), overspend)
+	assert.Nil(t, bc.AddBlock(child), "Orphan is saved")
+	assert.Nil(t, bc.AddBlock(parent), "Invalid orphan doesn't stop its parent")
+	assert.Equal(t, parent.Hash, bc.GetTip(), "Parent is the tip")
+	_, err = bc.GetBlock(child.Hash)
+	assert.NotNil(t, err, "Invalid orphan is removed")
+
+	orphans := []*Block{}
+	for i := 0; i < maxOrphanBlocks+2; i++ {
+		missing := &Block{Timestamp: genesis.Timestamp, Hash: []byte(fmt.Sprintf("missing%d", i)), Height: 5}
+		orphan := newTestBlock(missing, NewCoinbaseTX(address, ""))
+		assert.Nil(t, bc.AddBlock(orphan), "Orphan is saved")
+		orphans = append(orphans, orphan)
+	}
+	_, err = bc.GetBlock(orphans[0].Hash)
+	assert.NotNil(t, err, "The oldest orphan is removed")
+	_, err = bc.GetBlock(orphans[len(orphans)-1].Hash)
+	assert.Nil(t, err, "The newest orphan is kept")
+
+	count := 0
+	bc.store.View(func(r storage.ChainReader) error {
+		return r.ForEachIndex(orphanIndex, func(hash, prev []byte) error {
+			count++
+			return nil
+		})
+	})
+	assert.Equal(t, maxOrphanBlocks, count, "Count of orphans is limited")
+}
@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+const (
+	// block can't be more than this time ahead of node time
+	MaxFutureBlockTime = 2 * time.Hour
+	// count of previous blocks used to compute median time
+	medianTimeBlocks = 11
+)
+
+// mocked unix time, zero when real time is used
+var mockTime int64
+
+// Now returns current time of the node. It can be mocked to test timestamp rules
+func Now() time.Time {
+	if t := atomic.LoadInt64(&mockTime); t != 0 {
+		return time.Unix(t, 0)
+	}
+	return time.Now()
+}
+
+// SetMockTime fixes node time to the unix timestamp. Zero returns real time
+func SetMockTime(timestamp int64) {
+	atomic.StoreInt64(&mockTime, timestamp)
+}
+
+/*
+* Checks block timestamp: it should be greater than median time of
+* previous blocks and can't be far in the future
+ */
+func (bc *Blockchain) CheckBlockTimestamp(block *Block) error {
+	maxTime := Now().Add(MaxFutureBlockTime).Unix()
+	if block.Timestamp > maxTime {
+		return fmt.Errorf("Block %x timestamp %d is too far in the future", block.Hash, block.Timestamp)
+	}
+
+	// parent can be unknown yet, when blocks are received from newest
+	median, ok := bc.medianTimePast(block.PrevBlockHash)
+	if ok && block.Timestamp <= median {
+		return fmt.Errorf("Block %x timestamp %d is not after median time %d", block.Hash, block.Timestamp, median)
+	}
+
+	return nil
+}
+
+// Returns median timestamp of the block and its previous blocks.
+// Returns false if some of these blocks are not known yet
+func (bc *Blockchain) medianTimePast(hash []byte) (int64, bool) {
+	var median int64
+	var ok bool
+	bc.store.View(func(r storage.ChainReader) error {
+		median, ok = medianTime(r, hash)
+		return nil
+	})
+	return median, ok
+}
+
+// Computes median time in a transaction, so it works inside a batch. Pruned blocks are read by headers
+func medianTime(r storage.ChainReader, hash []byte) (int64, bool) {
+	timestamps := []int64{}
+
+	for len(hash) > 0 && len(timestamps) < medianTimeBlocks {
+		block, err := readBlock(r, hash)
+		if err != nil {
+			header, err := readHeader(r, hash)
+			if err != nil {
+				return 0, false
+			}
+			block = &Block{Timestamp: header.Timestamp, PrevBlockHash: header.PrevBlockHash}
+		}
+		timestamps = append(timestamps, block.Timestamp)
+		hash = block.PrevBlockHash
+	}
+
+	if len(timestamps) == 0 {
+		return 0, false
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2], true
+}
@@ -0,0 +1,64 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+// Creates a chain of blocks with given timestamps without proof-of-work
+func testChain(t *testing.T, timestamps []int64) *Blockchain {
+	store := storage.NewMemoryChainStore()
+
+	bc := newBlockchain(nil, store)
+	prevHash := []byte{}
+	err := store.Update(func(b storage.ChainBatch) error {
+		for i, timestamp := range timestamps {
+			block := &Block{timestamp, nil, prevHash, []byte(fmt.Sprintf("block%d", i)), 0, i}
+			b.PutBlock(block.Hash, block.Serialize())
+			b.SetTip(block.Hash)
+			prevHash = block.Hash
+		}
+		bc.tip = prevHash
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error: %+v\n", err)
+	}
+
+	return bc
+}
+
+func TestMockTime(t *testing.T) {
+	defer SetMockTime(0)
+
+	SetMockTime(1600000000)
+	assert.Equal(t, int64(1600000000), Now().Unix(), "Time is mocked")
+
+	SetMockTime(0)
+	assert.NotEqual(t, int64(1600000000), Now().Unix(), "Real time is used")
+}
+
+func TestCheckBlockTimestamp(t *testing.T) {
+	defer SetMockTime(0)
+	SetMockTime(1600000000)
+
+	bc := testChain(t, []int64{1599990000, 1599990010, 1599990020})
+	defer bc.Close()
+
+	block := &Block{Timestamp: 1599990010, PrevBlockHash: bc.tip, Hash: []byte("new")}
+	assert.NotNil(t, bc.CheckBlockTimestamp(block), "Block before median time is rejected")
+
+	block.Timestamp = 1599990011
+	assert.Nil(t, bc.CheckBlockTimestamp(block), "Block after median time is accepted")
+
+	block.Timestamp = Now().Add(MaxFutureBlockTime).Unix() + 1
+	assert.NotNil(t, bc.CheckBlockTimestamp(block), "Block from the future is rejected")
+
+	block.Timestamp = Now().Unix()
+	block.PrevBlockHash = []byte("unknown")
+	assert.Nil(t, bc.CheckBlockTimestamp(block), "Block with unknown parent is accepted")
+}
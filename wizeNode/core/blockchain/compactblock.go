@@ -0,0 +1,186 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+)
+
+// Length of short transaction IDs in compact blocks
+const ShortIDLength = 6
+
+// PrefilledTx is a transaction sent in a compact block as is
+type PrefilledTx struct {
+	Index       int
+	Transaction []byte
+}
+
+/*
+* CompactBlock carries block header and short IDs of transactions.
+* Receiver takes transactions from its mempool and requests only missing ones.
+* Coinbase is always prefilled because nobody has it in mempool
+ */
+type CompactBlock struct {
+	Header       BlockHeader
+	Salt         uint64
+	ShortIDs     [][]byte
+	PrefilledTxs []PrefilledTx
+}
+
+/*
+* PartialBlock is a block being reconstructed from a compact block.
+* Missing holds indexes of transactions not found in mempool
+ */
+type PartialBlock struct {
+	Header       BlockHeader
+	Transactions []*Transaction
+	Missing      []int
+}
+
+// NewCompactBlock builds a compact block with random salt of short IDs
+func NewCompactBlock(b *Block) *CompactBlock {
+	cb := &CompactBlock{
+		Header: b.Header(),
+		Salt:   mrand.Uint64(),
+	}
+
+	for i, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			cb.PrefilledTxs = append(cb.PrefilledTxs, PrefilledTx{i, tx.Serialize()})
+			continue
+		}
+		cb.ShortIDs = append(cb.ShortIDs, ShortTxID(tx.ID, cb.Salt))
+	}
+
+	return cb
+}
+
+// ShortTxID returns short ID of a transaction. Salt makes collisions
+// different for every block, so nobody can make them on purpose
+func ShortTxID(txID []byte, salt uint64) []byte {
+	data := make([]byte, 8, 8+len(txID))
+	binary.BigEndian.PutUint64(data, salt)
+	data = append(data, txID...)
+
+	hash := sha256.Sum256(data)
+	return hash[:ShortIDLength]
+}
+
+/*
+* Reconstructs the block with transactions from mempool. Transactions
+* which are missing or have ambiguous short ID are listed in Missing
+ */
+func (cb *CompactBlock) Reconstruct(mempool map[string]Transaction) (*PartialBlock, error) {
+	count := len(cb.ShortIDs) + len(cb.PrefilledTxs)
+	partial := &PartialBlock{
+		Header:       cb.Header,
+		Transactions: make([]*Transaction, count),
+	}
+
+	for _, prefilled := range cb.PrefilledTxs {
+		if prefilled.Index < 0 || prefilled.Index >= count || partial.Transactions[prefilled.Index] != nil {
+			return nil, errors.New("Wrong index of prefilled transaction")
+		}
+		tx, err := DeserializeTransaction(prefilled.Transaction)
+		if err != nil {
+			return nil, err
+		}
+		partial.Transactions[prefilled.Index] = &tx
+	}
+
+	// short ID of every mempool transaction, nil when two have the same
+	candidates := make(map[string]*Transaction)
+	for id := range mempool {
+		tx := mempool[id]
+		key := hex.EncodeToString(ShortTxID(tx.ID, cb.Salt))
+		if _, ok := candidates[key]; ok {
+			candidates[key] = nil
+			continue
+		}
+		candidates[key] = &tx
+	}
+
+	next := 0
+	for i := range partial.Transactions {
+		if partial.Transactions[i] != nil {
+			continue
+		}
+		if next >= len(cb.ShortIDs) {
+			return nil, errors.New("Wrong count of short IDs")
+		}
+		tx := candidates[hex.EncodeToString(cb.ShortIDs[next])]
+		next++
+
+		if tx == nil {
+			partial.Missing = append(partial.Missing, i)
+			continue
+		}
+		partial.Transactions[i] = tx
+	}
+
+	return partial, nil
+}
+
+// Fills missing transactions received from other node
+func (pb *PartialBlock) Fill(txs []*Transaction) error {
+	if len(txs) != len(pb.Missing) {
+		return errors.New("Wrong count of missing transactions")
+	}
+
+	for i, index := range pb.Missing {
+		pb.Transactions[index] = txs[i]
+	}
+	pb.Missing = nil
+
+	return nil
+}
+
+// Returns true if all transactions of the block are known
+func (pb *PartialBlock) IsComplete() bool {
+	return len(pb.Missing) == 0
+}
+
+/*
+* Builds the block and checks that transactions match the header.
+* An error means short ID collision, so full block should be requested
+ */
+func (pb *PartialBlock) Block() (*Block, error) {
+	if !pb.IsComplete() {
+		return nil, errors.New("Block has missing transactions")
+	}
+
+	h := pb.Header
+	block := &Block{h.Timestamp, pb.Transactions, h.PrevBlockHash, h.Hash, h.Nonce, h.Height}
+
+	pow := NewProofOfWork(block)
+	hash := sha256.Sum256(pow.prepareData(block.Nonce))
+	if !bytes.Equal(hash[:], block.Hash) || !pow.Validate() {
+		return nil, errors.New("Transactions don't match block header")
+	}
+	if size := len(block.Serialize()); size > MaxBlockSize {
+		return nil, fmt.Errorf("Block size %d is over limit %d", size, MaxBlockSize)
+	}
+
+	return block, nil
+}
+
+// Serialize serializes the compact block
+func (cb *CompactBlock) Serialize() ([]byte, error) {
+	var result bytes.Buffer
+	err := gob.NewEncoder(&result).Encode(cb)
+
+	return result.Bytes(), err
+}
+
+// DeserializeCompactBlock deserializes a compact block
+func DeserializeCompactBlock(data []byte) (*CompactBlock, error) {
+	var cb CompactBlock
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cb)
+
+	return &cb, err
+}
@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/crypto"
+)
+
+func testTransaction(id string) *Transaction {
+	return &Transaction{1, []byte(id), []TXInput{{[]byte("prev" + id), 0, nil, nil, 0}}, nil, 0}
+}
+
+func TestCompactBlock(t *testing.T) {
+	chaincfg.SelectNetwork(chaincfg.RegTestParams.Name)
+	defer chaincfg.SelectNetwork(chaincfg.MainNetParams.Name)
+
+	_, public := crypto.NewKeyPair()
+	coinbase := NewCoinbaseTX(string(crypto.GetAddress(public)), "")
+	tx1 := testTransaction("tx1")
+	tx2 := testTransaction("tx2")
+	block := NewBlock([]*Transaction{tx1, tx2, coinbase}, []byte("prev"), 1)
+
+	data, err := NewCompactBlock(block).Serialize()
+	assert.Nil(t, err, "Compact block is serialized")
+	compact, err := DeserializeCompactBlock(data)
+	assert.Nil(t, err, "Compact block is deserialized")
+	assert.Equal(t, 2, len(compact.ShortIDs), "Short IDs of transactions")
+	assert.Equal(t, 1, len(compact.PrefilledTxs), "Coinbase is prefilled")
+
+	mempool := map[string]Transaction{hex.EncodeToString(tx1.ID): *tx1}
+	partial, err := compact.Reconstruct(mempool)
+	assert.Nil(t, err, "Block is reconstructed")
+	assert.Equal(t, []int{1}, partial.Missing, "Transaction not in mempool is missing")
+
+	err = partial.Fill([]*Transaction{tx2})
+	assert.Nil(t, err, "Missing transaction is filled")
+	reconstructed, err := partial.Block()
+	assert.Nil(t, err, "Block matches header")
+	assert.Equal(t, block.Hash, reconstructed.Hash, "Block hash is the same")
+
+	partial, _ = compact.Reconstruct(mempool)
+	partial.Fill([]*Transaction{testTransaction("other")})
+	_, err = partial.Block()
+	assert.NotNil(t, err, "Wrong transaction doesn't match header")
+}
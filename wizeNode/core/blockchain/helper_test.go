@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/crypto"
+	"wizeBlock/wizeNode/core/storage"
+)
+
+// Genesis emission of test chains
+const testEmission = 1000
+
+// Keys and address of a test wallet
+type testWallet struct {
+	Private *crypto.PrivateKey
+	Public  []byte
+	Address string
+}
+
+func newTestWallet() testWallet {
+	private, public := crypto.NewKeyPair()
+	return testWallet{private, public, string(crypto.GetAddress(public))}
+}
+
+/*
+* Makes a copy of regtest parameters with small genesis emission active
+* until the test ends. The test can change the returned parameters
+ */
+func useTestNetwork(t *testing.T) *chaincfg.Params {
+	params := chaincfg.RegTestParams
+	params.GenesisEmission = testEmission
+	oldActive := chaincfg.Active
+	chaincfg.Active = &params
+	t.Cleanup(func() { chaincfg.Active = oldActive })
+	return &params
+}
+
+/*
+* Creates a chain in the store on the test network. The genesis emission
+* is paid to the returned wallet
+ */
+func newTestChain(t *testing.T, store storage.ChainStore) (*Blockchain, testWallet, *Block) {
+	if chaincfg.Active.GenesisEmission != testEmission {
+		useTestNetwork(t)
+	}
+
+	owner := newTestWallet()
+	bc, err := CreateBlockchainInStore(owner.Address, store)
+	if err != nil {
+		t.Fatalf("Blockchain is not created: %s", err)
+	}
+	genesis, err := bc.GetBlock(bc.GetTip())
+	if err != nil {
+		t.Fatalf("Genesis is not found: %s", err)
+	}
+	return bc, owner, &genesis
+}
+
+// Creates a transaction spending an output of the wallet and signs it
+func spendOutput(bc *Blockchain, from testWallet, txID []byte, vout int, outputs ...TXOutput) *Transaction {
+	tx := &Transaction{time.Now().UnixNano(), nil,
+		[]TXInput{{txID, vout, nil, from.Public, 0}},
+		outputs, 0}
+	tx.ID = tx.Hash()
+	bc.SignTransaction(tx, *from.Private)
+	return tx
+}
+
+// Creates a transaction spending the genesis emission of the chain owner
+func spendGenesis(bc *Blockchain, owner testWallet, genesis *Block, outputs ...TXOutput) *Transaction {
+	return spendOutput(bc, owner, genesis.Transactions[0].ID, 0, outputs...)
+}
+
+// Mines a block after the parent with the next timestamp, so blocks can be made faster than one per second
+func newTestBlock(parent *Block, transactions ...*Transaction) *Block {
+	return mineBlock(&Block{parent.Timestamp + 1, transactions, parent.Hash, []byte{}, 0, parent.Height + 1})
+}
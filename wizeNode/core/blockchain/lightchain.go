@@ -0,0 +1,407 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/crypto"
+	"wizeBlock/wizeNode/core/storage"
+)
+
+const lightDbFile = "db%s/light.db"
+
+const (
+	headersBucket    = "headers"
+	mainChainBucket  = "mainchain"
+	walletTxsBucket  = "wallettxs"
+	lightStateBucket = "lightstate"
+)
+
+var (
+	scannedKey = []byte("scanned")
+	watchedKey = []byte("watched")
+)
+
+/*
+* LightChain keeps headers of blocks and transactions of watched addresses.
+* A light node syncs headers from full nodes and downloads only blocks
+* which compact filters match the watched addresses
+ */
+type LightChain struct {
+	store storage.Store
+}
+
+// WalletTransaction is a transaction of watched addresses and its block
+type WalletTransaction struct {
+	BlockHash   []byte
+	Transaction Transaction
+}
+
+// WalletOutput is an unspent output of a wallet transaction
+type WalletOutput struct {
+	TxID   []byte
+	Index  int
+	Output TXOutput
+}
+
+// NewLightChain opens the light chain of a node, it is created on first run
+func NewLightChain(nodeID string) (*LightChain, error) {
+	dbFile := chaincfg.DataPath(lightDbFile, nodeID)
+	err := os.MkdirAll(filepath.Dir(dbFile), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := storage.OpenBolt(dbFile, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LightChain{store: store}, nil
+}
+
+// Height returns height of the best header, -1 if there are no headers yet
+func (lc *LightChain) Height() int {
+	height := -1
+	lc.store.View(func(tx storage.Tx) error {
+		height = bestHeight(tx)
+		return nil
+	})
+	return height
+}
+
+// HeaderAt returns header of the best chain at the height
+func (lc *LightChain) HeaderAt(height int) (BlockHeader, error) {
+	var header BlockHeader
+	err := lc.store.View(func(tx storage.Tx) error {
+		hash := tx.Get(mainChainBucket, heightKey(height))
+		if hash == nil {
+			return fmt.Errorf("There is no header at height %d", height)
+		}
+		found, err := getHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		header = *found
+		return nil
+	})
+	return header, err
+}
+
+/*
+* Locator returns hashes of the best chain from the tip back to genesis.
+* First ten hashes follow each other, then the step is doubled every time,
+* so a full node finds the fork with the light chain from a short list
+ */
+func (lc *LightChain) Locator() [][]byte {
+	locator := [][]byte{}
+	lc.store.View(func(tx storage.Tx) error {
+		step := 1
+		for height := bestHeight(tx); height >= 0; height -= step {
+			locator = append(locator, append([]byte{}, tx.Get(mainChainBucket, heightKey(height))...))
+			if height == 0 {
+				break
+			}
+			if len(locator) >= 10 {
+				step *= 2
+			}
+			if height-step < 0 {
+				step = height
+			}
+		}
+		return nil
+	})
+	return locator
+}
+
+/*
+* AddHeaders checks proof-of-work and links of the headers and saves them.
+* The longest chain becomes the best one. If the best chain is switched
+* below the scanned height, blocks are scanned again from the fork.
+* Returns count of new headers
+ */
+func (lc *LightChain) AddHeaders(headers []BlockHeader) (int, error) {
+	added := 0
+	err := lc.store.Update(func(tx storage.Tx) error {
+		added = 0
+
+		for _, header := range headers {
+			if tx.Get(headersBucket, header.Hash) != nil {
+				continue
+			}
+			err := header.Validate()
+			if err != nil {
+				return err
+			}
+
+			if header.Height == 0 {
+				if len(header.PrevBlockHash) != 0 {
+					return fmt.Errorf("Header %x at height 0 has previous block", header.Hash)
+				}
+				if tx.Get(mainChainBucket, heightKey(0)) != nil {
+					return fmt.Errorf("Genesis block %x differs from known one", header.Hash)
+				}
+			} else {
+				prev, err := getHeader(tx, header.PrevBlockHash)
+				if err != nil {
+					return err
+				}
+				if prev.Height+1 != header.Height {
+					return fmt.Errorf("Header %x has wrong height %d", header.Hash, header.Height)
+				}
+			}
+
+			data, err := gobEncode(header)
+			if err != nil {
+				return err
+			}
+			err = tx.Put(headersBucket, header.Hash, data)
+			if err != nil {
+				return err
+			}
+			added++
+
+			if header.Height > bestHeight(tx) {
+				err = setBestChain(tx, header)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return added, err
+}
+
+// ScannedHeight returns height of the last block checked for wallet transactions, -1 if none
+func (lc *LightChain) ScannedHeight() int {
+	height := -1
+	lc.store.View(func(tx storage.Tx) error {
+		height = scannedHeight(tx)
+		return nil
+	})
+	return height
+}
+
+// AddScanned saves wallet transactions found in blocks up to the height
+func (lc *LightChain) AddScanned(height int, txs []WalletTransaction) error {
+	return lc.store.Update(func(tx storage.Tx) error {
+		for _, wtx := range txs {
+			data, err := gobEncode(wtx)
+			if err != nil {
+				return err
+			}
+			err = tx.Put(walletTxsBucket, wtx.Transaction.ID, data)
+			if err != nil {
+				return err
+			}
+		}
+		return setScannedHeight(tx, height)
+	})
+}
+
+// Watched returns addresses of the wallet
+func (lc *LightChain) Watched() []string {
+	addresses := []string{}
+	lc.store.View(func(tx storage.Tx) error {
+		data := tx.Get(lightStateBucket, watchedKey)
+		if data != nil {
+			return gob.NewDecoder(bytes.NewReader(data)).Decode(&addresses)
+		}
+		return nil
+	})
+	return addresses
+}
+
+// IsWatched checks the address is in the wallet
+func (lc *LightChain) IsWatched(address string) bool {
+	for _, watched := range lc.Watched() {
+		if watched == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch adds addresses to the wallet. Blocks are scanned again from genesis if there are new addresses
+func (lc *LightChain) Watch(addresses []string) error {
+	watched := lc.Watched()
+	known := make(map[string]bool)
+	for _, address := range watched {
+		known[address] = true
+	}
+
+	for _, address := range addresses {
+		if !crypto.ValidateAddress(address) {
+			return fmt.Errorf("Address %s is not valid", address)
+		}
+		if !known[address] {
+			known[address] = true
+			watched = append(watched, address)
+		}
+	}
+	if len(watched) == len(lc.Watched()) {
+		return nil
+	}
+
+	return lc.store.Update(func(tx storage.Tx) error {
+		data, err := gobEncode(watched)
+		if err != nil {
+			return err
+		}
+		err = tx.Put(lightStateBucket, watchedKey, data)
+		if err != nil {
+			return err
+		}
+		return setScannedHeight(tx, -1)
+	})
+}
+
+// Transactions returns wallet transactions in blocks of the best chain
+func (lc *LightChain) Transactions() ([]WalletTransaction, error) {
+	txs := []WalletTransaction{}
+	err := lc.store.View(func(tx storage.Tx) error {
+
+		return tx.ForEach(walletTxsBucket, func(k, v []byte) error {
+			var wtx WalletTransaction
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&wtx)
+			if err != nil {
+				return err
+			}
+			header, err := getHeader(tx, wtx.BlockHash)
+			if err != nil {
+				return err
+			}
+			// transactions of blocks left after reorganization are skipped
+			if bytes.Equal(tx.Get(mainChainBucket, heightKey(header.Height)), wtx.BlockHash) {
+				txs = append(txs, wtx)
+			}
+			return nil
+		})
+	})
+	return txs, err
+}
+
+// FindTransaction finds a wallet transaction by its ID
+func (lc *LightChain) FindTransaction(ID []byte) (Transaction, error) {
+	var wtx WalletTransaction
+	err := lc.store.View(func(tx storage.Tx) error {
+		data := tx.Get(walletTxsBucket, ID)
+		if data == nil {
+			return fmt.Errorf("Transaction %x is not found", ID)
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(&wtx)
+	})
+	return wtx.Transaction, err
+}
+
+// UnspentOutputs returns outputs locked with the pubkey hash not spent by wallet transactions
+func (lc *LightChain) UnspentOutputs(pubKeyHash []byte) ([]WalletOutput, error) {
+	txs, err := lc.Transactions()
+	if err != nil {
+		return nil, err
+	}
+
+	spent := make(map[string]bool)
+	for _, wtx := range txs {
+		if wtx.Transaction.IsCoinbase() {
+			continue
+		}
+		for _, in := range wtx.Transaction.Vin {
+			spent[string(crypto.OutpointFilterElement(in.Txid, in.Vout))] = true
+		}
+	}
+
+	outputs := []WalletOutput{}
+	for _, wtx := range txs {
+		for i, out := range wtx.Transaction.Vout {
+			if out.IsLockedWithKey(pubKeyHash) && !spent[string(crypto.OutpointFilterElement(wtx.Transaction.ID, i))] {
+				outputs = append(outputs, WalletOutput{wtx.Transaction.ID, i, out})
+			}
+		}
+	}
+	return outputs, nil
+}
+
+// Close closes the light chain DB
+func (lc *LightChain) Close() error {
+	return lc.store.Close()
+}
+
+// Makes the header tip of the best chain and moves the scanned height back to the fork
+func setBestChain(tx storage.Tx, header BlockHeader) error {
+	fork := header.Height
+
+	for !bytes.Equal(tx.Get(mainChainBucket, heightKey(header.Height)), header.Hash) {
+		err := tx.Put(mainChainBucket, heightKey(header.Height), header.Hash)
+		if err != nil {
+			return err
+		}
+		fork = header.Height
+		if header.Height == 0 {
+			break
+		}
+
+		prev, err := getHeader(tx, header.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+		header = *prev
+	}
+
+	if scannedHeight(tx) >= fork {
+		return setScannedHeight(tx, fork-1)
+	}
+	return nil
+}
+
+func getHeader(tx storage.Tx, hash []byte) (*BlockHeader, error) {
+	data := tx.Get(headersBucket, hash)
+	if data == nil {
+		return nil, fmt.Errorf("Header %x is not found", hash)
+	}
+
+	var header BlockHeader
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&header)
+	return &header, err
+}
+
+func bestHeight(tx storage.Tx) int {
+	k, _ := tx.Last(mainChainBucket)
+	if k == nil {
+		return -1
+	}
+	return int(binary.BigEndian.Uint64(k))
+}
+
+func scannedHeight(tx storage.Tx) int {
+	data := tx.Get(lightStateBucket, scannedKey)
+	if data == nil {
+		return -1
+	}
+	return int(int64(binary.BigEndian.Uint64(data)))
+}
+
+func setScannedHeight(tx storage.Tx, height int) error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(int64(height)))
+	return tx.Put(lightStateBucket, scannedKey, data)
+}
+
+// Heights are big endian, so keys of main chain are sorted by height
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+func gobEncode(data interface{}) ([]byte, error) {
+	var result bytes.Buffer
+	err := gob.NewEncoder(&result).Encode(data)
+	return result.Bytes(), err
+}
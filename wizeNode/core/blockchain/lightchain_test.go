@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Mines headers of a chain of count blocks after the block
+func testHeaders(prev *Block, count int, address string) []BlockHeader {
+	headers := []BlockHeader{}
+	for i := 0; i < count; i++ {
+		prev = NewBlock([]*Transaction{NewCoinbaseTX(address, "")}, prev.Hash, prev.Height+1)
+		headers = append(headers, prev.Header())
+	}
+	return headers
+}
+
+func TestLightChain(t *testing.T) {
+	params := useTestNetwork(t)
+	params.DataDir = t.TempDir() + "/"
+
+	address := newTestWallet().Address
+	genesis := NewGenesisBlock(NewEmissionCoinbaseTX(address, "genesis", 100))
+
+	lc, err := NewLightChain("test")
+	if !assert.Nil(t, err, "Light chain is created") {
+		return
+	}
+	defer lc.Close()
+	assert.Equal(t, -1, lc.Height(), "New chain has no headers")
+	assert.Equal(t, 0, len(lc.Locator()), "Empty locator")
+
+	branchA := testHeaders(genesis, 2, address)
+	added, err := lc.AddHeaders(append([]BlockHeader{genesis.Header()}, branchA...))
+	assert.Nil(t, err, "Headers are added")
+	assert.Equal(t, 3, added, "Count of new headers")
+	assert.Equal(t, 2, lc.Height(), "Height of the best chain")
+	assert.Equal(t, [][]byte{branchA[1].Hash, branchA[0].Hash, genesis.Hash}, lc.Locator(), "Locator from the tip")
+
+	wtx := WalletTransaction{branchA[1].Hash, *genesis.Transactions[0]}
+	wtx.Transaction.ID = []byte("wallet tx")
+	assert.Nil(t, lc.AddScanned(2, []WalletTransaction{wtx}), "Scanned blocks are saved")
+	txs, _ := lc.Transactions()
+	assert.Equal(t, 1, len(txs), "Transaction of the best chain")
+
+	// longer branch from genesis replaces the best chain
+	branchB := testHeaders(genesis, 3, address)
+	added, err = lc.AddHeaders(branchB)
+	assert.Nil(t, err, "Headers of other branch are added")
+	assert.Equal(t, 3, added, "Count of new headers")
+	header, _ := lc.HeaderAt(1)
+	assert.Equal(t, branchB[0].Hash, header.Hash, "Best chain is switched")
+	assert.Equal(t, 0, lc.ScannedHeight(), "Blocks after the fork are scanned again")
+	txs, _ = lc.Transactions()
+	assert.Equal(t, 0, len(txs), "Transaction of the left branch is skipped")
+
+	added, _ = lc.AddHeaders(branchB)
+	assert.Equal(t, 0, added, "Known headers are skipped")
+
+	orphan := testHeaders(&Block{Hash: []byte("unknown"), Height: 5}, 1, address)
+	_, err = lc.AddHeaders(orphan)
+	assert.NotNil(t, err, "Header with unknown previous block is rejected")
+
+	wrong := testHeaders(genesis, 1, address)
+	wrong[0].Nonce++
+	_, err = lc.AddHeaders(wrong)
+	assert.NotNil(t, err, "Header with wrong proof-of-work is rejected")
+
+	otherGenesis := NewGenesisBlock(NewEmissionCoinbaseTX(address, "other", 100))
+	_, err = lc.AddHeaders([]BlockHeader{otherGenesis.Header()})
+	assert.NotNil(t, err, "Other genesis is rejected")
+}
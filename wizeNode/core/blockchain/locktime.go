@@ -0,0 +1,123 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/storage"
+)
+
+// LockTimeThreshold separates lock times: lower values are block heights, others are unix times
+const LockTimeThreshold = 500000000
+
+/*
+* Input sequence holds a relative lock: the spent output should be this
+* count of blocks deep, or this count of 512 second units old by median
+* time, before the input can be mined. Zero sequence is no lock
+ */
+const (
+	// SequenceLockDisabled turns the relative lock of the input off
+	SequenceLockDisabled uint32 = 1 << 31
+	// SequenceLockTime makes the relative lock a time instead of blocks
+	SequenceLockTime uint32 = 1 << 22
+	// SequenceLockMask selects the value of the relative lock
+	SequenceLockMask uint32 = 0x0000ffff
+
+	// relative lock time is counted in 2^9 = 512 second units
+	sequenceTimeGranularity = 9
+)
+
+/*
+* IsFinal tells that the transaction can be mined in a block of the height
+* with the median time of previous blocks. LockTime below LockTimeThreshold
+* is the last height, otherwise the last unix time, when it can't be mined
+ */
+func (tx Transaction) IsFinal(height int, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if tx.LockTime < LockTimeThreshold {
+		return tx.LockTime < int64(height)
+	}
+	return tx.LockTime < medianTime
+}
+
+/*
+* CheckTransactionLocks checks that the transaction can be mined in the next
+* block: its lock time is passed, relative locks of inputs are passed and
+* spent coinbase outputs are mature. Inputs which outputs are not in the
+* UTXO set are checked when the transaction is mined
+ */
+func (bc *Blockchain) CheckTransactionLocks(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+	return bc.store.View(func(r storage.ChainReader) error {
+		tip, err := readBlock(r, r.Tip())
+		if err != nil {
+			return err
+		}
+		median, _ := medianTime(r, tip.Hash)
+		height := tip.Height + 1
+
+		if !tx.IsFinal(height, median) {
+			return fmt.Errorf("Transaction %x is locked until %d", tx.ID, tx.LockTime)
+		}
+		for _, vin := range tx.Vin {
+			outpoint := outpointKey(vin.Txid, vin.Vout)
+			data, found := bc.utxos.get(outpoint)
+			if !found {
+				data = r.UTXO(outpoint)
+			}
+			if data == nil {
+				continue
+			}
+			err = checkInputLocks(r, vin, DeserializeUTXOEntry(data), height, median)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+* IsMature tells that the output can be spent in a block of the height. Coinbase
+* outputs wait CoinbaseMaturity blocks, except the genesis emission, which
+* is the whole supply and is spendable at once
+ */
+func (entry UTXOEntry) IsMature(height int) bool {
+	if !entry.Coinbase || entry.Height == 0 {
+		return true
+	}
+	return height-entry.Height >= chaincfg.Active.CoinbaseMaturity
+}
+
+// Checks that the spent output is mature and the relative lock of the input is passed at the height
+func checkInputLocks(r storage.ChainReader, vin TXInput, entry UTXOEntry, height int, medianTimePast int64) error {
+	if !entry.IsMature(height) {
+		return fmt.Errorf("Coinbase output %x:%d of height %d is not mature", vin.Txid, vin.Vout, entry.Height)
+	}
+
+	if vin.Sequence&SequenceLockDisabled != 0 {
+		return nil
+	}
+	value := vin.Sequence & SequenceLockMask
+	if vin.Sequence&SequenceLockTime == 0 {
+		if height < entry.Height+int(value) {
+			return fmt.Errorf("Output %x:%d is locked for %d blocks", vin.Txid, vin.Vout, value)
+		}
+		return nil
+	}
+
+	// time of an output is the median time before its block
+	prevHeight := entry.Height - 1
+	if prevHeight < 0 {
+		prevHeight = 0
+	}
+	outputTime, _ := medianTime(r, r.Index(heightIndex, heightKey(prevHeight)))
+	if medianTimePast < outputTime+int64(value)<<sequenceTimeGranularity {
+		return fmt.Errorf("Output %x:%d is locked for %d seconds", vin.Txid, vin.Vout, int64(value)<<sequenceTimeGranularity)
+	}
+	return nil
+}
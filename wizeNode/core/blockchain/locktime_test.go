@@ -0,0 +1,94 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/crypto"
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestTransactionIsFinal(t *testing.T) {
+	tx := Transaction{}
+	assert.True(t, tx.IsFinal(1, 0), "Transaction without lock time is final")
+
+	tx.LockTime = 5
+	assert.False(t, tx.IsFinal(5, 0), "Transaction is locked up to the height")
+	assert.True(t, tx.IsFinal(6, 0), "Transaction is final after the height")
+
+	tx.LockTime = 1600000000
+	assert.False(t, tx.IsFinal(100, 1600000000), "Transaction is locked up to the time")
+	assert.True(t, tx.IsFinal(100, 1600000001), "Transaction is final after the time")
+}
+
+func TestTransactionLocks(t *testing.T) {
+	params := useTestNetwork(t)
+	params.CoinbaseMaturity = 2
+
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+	newBlock := func(tx *Transaction) *Block {
+		return NewBlock([]*Transaction{NewCoinbaseTX(address, ""), tx}, bc.GetTip(), bc.GetBestHeight()+1)
+	}
+
+	// the genesis emission is spendable at once, it pays fee to the miner
+	tx := spendGenesis(bc, owner, genesis, *NewTXOutput(600, address), *NewTXOutput(390, address))
+	assert.Nil(t, bc.CheckTransactionLocks(tx), "Genesis emission is mature")
+	miner := newTestWallet()
+	coinbase := NewCoinbaseTX(miner.Address, "")
+	coinbase.Vout[0].Value = 10
+	coinbase.ID = coinbase.Hash()
+	txBlock := bc.MineBlock([]*Transaction{coinbase, tx})
+	if !assert.NotNil(t, txBlock, "Genesis emission is spent") {
+		return
+	}
+
+	// coinbase output of the block is mature 2 blocks later
+	reward := spendOutput(bc, miner, coinbase.ID, 0, *NewTXOutput(10, address))
+	assert.NotNil(t, bc.CheckTransactionLocks(reward), "Immature coinbase can't be spent")
+	assert.NotNil(t, bc.AddBlock(newBlock(reward)), "Block spending immature coinbase is rejected")
+	spendable, _ := UTXOSet{bc}.FindSpendableOutputs(crypto.HashPubKey(miner.Public), 10)
+	assert.Equal(t, 0, spendable, "Immature coinbase is not selected by wallets")
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	assert.Nil(t, bc.CheckTransactionLocks(reward), "Mature coinbase can be spent")
+	spendable, _ = UTXOSet{bc}.FindSpendableOutputs(crypto.HashPubKey(miner.Public), 10)
+	assert.Equal(t, 10, spendable, "Mature coinbase is selected by wallets")
+
+	// absolute lock by height
+	locked := &Transaction{time.Now().UnixNano(), nil,
+		[]TXInput{{tx.ID, 0, nil, owner.Public, 0}},
+		[]TXOutput{*NewTXOutput(600, address)}, int64(bc.GetBestHeight() + 1)}
+	locked.ID = locked.Hash()
+	bc.SignTransaction(locked, *owner.Private)
+	assert.NotNil(t, bc.CheckTransactionLocks(locked), "Transaction is locked for the next block")
+	assert.NotNil(t, bc.AddBlock(newBlock(locked)), "Block with locked transaction is rejected")
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), locked})
+	if assert.NotNil(t, block, "Block is mined") {
+		assert.Equal(t, 1, len(block.Transactions), "Locked transaction is not mined")
+	}
+	block = bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), locked})
+	if assert.NotNil(t, block, "Block is mined") {
+		assert.Equal(t, 2, len(block.Transactions), "Transaction is mined after lock time")
+	}
+
+	// relative lock of an input by blocks, it ends after the next block
+	height := bc.GetBestHeight()
+	relative := &Transaction{time.Now().UnixNano(), nil,
+		[]TXInput{{tx.ID, 1, nil, owner.Public, uint32(height + 2 - txBlock.Height)}},
+		[]TXOutput{*NewTXOutput(390, address)}, 0}
+	relative.ID = relative.Hash()
+	bc.SignTransaction(relative, *owner.Private)
+	assert.NotNil(t, bc.CheckTransactionLocks(relative), "Output is locked for blocks")
+	assert.NotNil(t, bc.AddBlock(newBlock(relative)), "Block with locked input is rejected")
+	for bc.GetBestHeight() < height+1 {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	}
+	assert.Nil(t, bc.CheckTransactionLocks(relative), "Output is unlocked when it is deep enough")
+
+	relative.Vin[0].Sequence = SequenceLockDisabled | 10
+	assert.Nil(t, bc.CheckTransactionLocks(relative), "Disabled relative lock is ignored")
+	ok, _ := bc.VerifyTransaction(relative)
+	assert.False(t, ok, "Sequence is signed")
+}
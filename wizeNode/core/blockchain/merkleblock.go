@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"wizeBlock/wizeNode/core/crypto"
+)
+
+/*
+* MerkleBlock carries block header and some transactions of the block with
+* merkle proofs. A light client checks that transactions are in the block
+* having only the header, without other transactions of the block
+ */
+type MerkleBlock struct {
+	Header       BlockHeader
+	Transactions [][]byte
+	Proofs       []crypto.MerkleProof
+}
+
+// Returns merkle proof of the transaction in the block
+func (b *Block) MerkleProof(txID []byte) (*crypto.MerkleProof, error) {
+	var transactions [][]byte
+	index := -1
+
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+		transactions = append(transactions, tx.Serialize())
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("Transaction %x is not in block %x", txID, b.Hash)
+	}
+
+	return crypto.NewMerkleProof(transactions, index)
+}
+
+// Builds merkle block with the transactions. Transactions not in the block are skipped
+func NewMerkleBlock(b *Block, txIDs [][]byte) *MerkleBlock {
+	mb := &MerkleBlock{Header: b.Header()}
+
+	for _, txID := range txIDs {
+		proof, err := b.MerkleProof(txID)
+		if err != nil {
+			continue
+		}
+		mb.Transactions = append(mb.Transactions, b.Transactions[proof.Index].Serialize())
+		mb.Proofs = append(mb.Proofs, *proof)
+	}
+
+	return mb
+}
+
+/*
+* Checks proof-of-work of the header and proofs of transactions.
+* Returns transactions which are proved to be in the block
+ */
+func (mb *MerkleBlock) Verify() ([]*Transaction, error) {
+	if err := mb.Header.Validate(); err != nil {
+		return nil, err
+	}
+	if len(mb.Transactions) != len(mb.Proofs) {
+		return nil, errors.New("Count of proofs doesn't match count of transactions")
+	}
+
+	txs := []*Transaction{}
+	for i, data := range mb.Transactions {
+		if !mb.Proofs[i].Verify(data, mb.Header.MerkleRoot) {
+			return nil, fmt.Errorf("Wrong merkle proof of transaction %d", i)
+		}
+
+		tx, err := DeserializeTransaction(data)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, &tx)
+	}
+
+	return txs, nil
+}
+
+// Serialize serializes the merkle block
+func (mb *MerkleBlock) Serialize() ([]byte, error) {
+	var result bytes.Buffer
+	err := gob.NewEncoder(&result).Encode(mb)
+
+	return result.Bytes(), err
+}
+
+// DeserializeMerkleBlock deserializes a merkle block
+func DeserializeMerkleBlock(data []byte) (*MerkleBlock, error) {
+	var mb MerkleBlock
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&mb)
+
+	return &mb, err
+}
@@ -0,0 +1,42 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/crypto"
+)
+
+func TestMerkleBlock(t *testing.T) {
+	chaincfg.SelectNetwork(chaincfg.RegTestParams.Name)
+	defer chaincfg.SelectNetwork(chaincfg.MainNetParams.Name)
+
+	_, public := crypto.NewKeyPair()
+	coinbase := NewCoinbaseTX(string(crypto.GetAddress(public)), "")
+	tx1 := testTransaction("tx1")
+	tx2 := testTransaction("tx2")
+	block := NewBlock([]*Transaction{coinbase, tx1, tx2}, []byte("prev"), 1)
+
+	assert.Nil(t, block.Header().Validate(), "Header of mined block is valid")
+
+	data, err := NewMerkleBlock(block, [][]byte{tx2.ID, []byte("unknown")}).Serialize()
+	assert.Nil(t, err, "Merkle block is serialized")
+	merkle, err := DeserializeMerkleBlock(data)
+	assert.Nil(t, err, "Merkle block is deserialized")
+	assert.Equal(t, 1, len(merkle.Transactions), "Unknown transaction is skipped")
+
+	txs, err := merkle.Verify()
+	assert.Nil(t, err, "Merkle block is valid")
+	assert.Equal(t, tx2.ID, txs[0].ID, "Transaction is proved")
+
+	merkle.Transactions[0] = testTransaction("other").Serialize()
+	_, err = merkle.Verify()
+	assert.NotNil(t, err, "Other transaction is not proved")
+
+	merkle = NewMerkleBlock(block, [][]byte{tx1.ID})
+	merkle.Header.MerkleRoot = []byte("other root")
+	_, err = merkle.Verify()
+	assert.NotNil(t, err, "Header with other merkle root doesn't match its hash")
+}
@@ -6,13 +6,12 @@ import (
 	"fmt"
 	"math"
 	"math/big"
-)
 
-const (
-	targetBits = 16
-	maxNonce   = math.MaxInt64
+	"wizeBlock/wizeNode/core/chaincfg"
 )
 
+const maxNonce = math.MaxInt64
+
 // ProofOfWork represents a proof-of-work
 type ProofOfWork struct {
 	block  *Block
@@ -22,7 +21,7 @@ type ProofOfWork struct {
 // NewProofOfWork builds and returns a ProofOfWork
 func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target.Lsh(target, uint(256-chaincfg.Active.TargetBits))
 
 	pow := &ProofOfWork{b, target}
 
@@ -30,12 +29,17 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 }
 
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	return powData(pow.block.PrevBlockHash, pow.block.HashTransactions(), pow.block.Timestamp, nonce)
+}
+
+// Returns data of a block hashed by proof-of-work
+func powData(prevBlockHash, merkleRoot []byte, timestamp int64, nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
-			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetBits)),
+			prevBlockHash,
+			merkleRoot,
+			IntToHex(timestamp),
+			IntToHex(int64(chaincfg.Active.TargetBits)),
 			IntToHex(int64(nonce)),
 		},
 		[]byte{},
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+// Indexes kept for blocks which bodies are pruned
+const (
+	// hash of a pruned block to its header
+	headerIndex = "header"
+	// ID of a transaction of a pruned block, which had unspent outputs, to the transaction
+	prunedTxIndex = "prunedtx"
+)
+
+// height of the first block of the best chain which body is kept, in the state index
+var prunedHeightKey = []byte("pruned")
+
+// MinPruneDepth is the least count of last blocks a pruned node keeps. Median time
+// of new blocks needs the last blocks and a reorganization needs their undo data
+const MinPruneDepth = 2 * medianTimeBlocks
+
+/*
+* SetPruneDepth enables pruning: only bodies and undo data of the last
+* depth blocks are kept with headers of all blocks and the UTXO set. Older
+* blocks are pruned at once and then after every new tip
+ */
+func (bc *Blockchain) SetPruneDepth(depth int) error {
+	if depth < MinPruneDepth {
+		return fmt.Errorf("Prune depth %d is less than %d blocks", depth, MinPruneDepth)
+	}
+	bc.pruneDepth = depth
+
+	bc.chainMutex.Lock()
+	defer bc.chainMutex.Unlock()
+
+	// blocks after the flush marker are not pruned, so the UTXO cache is flushed first
+	err := bc.store.Update(func(b storage.ChainBatch) error {
+		view := bc.utxos.newView(b)
+		err := flushUTXO(b, view)
+		if err != nil {
+			return err
+		}
+		return pruneBlocks(b, view, depth)
+	})
+	if err != nil {
+		return err
+	}
+	bc.utxos.apply(nil, 0, true)
+	return nil
+}
+
+// Pruned tells that old blocks are not kept, so the node can't serve them to other nodes
+func (bc *Blockchain) Pruned() bool {
+	return bc.pruneDepth > 0 || bc.PrunedHeight() > 0
+}
+
+// PrunedHeight returns height of the first block of the best chain which body is kept
+func (bc *Blockchain) PrunedHeight() int {
+	height := 0
+	bc.store.View(func(r storage.ChainReader) error {
+		height = prunedHeight(r)
+		return nil
+	})
+	return height
+}
+
+func prunedHeight(r storage.ChainReader) int {
+	value := r.Index(stateIndex, prunedHeightKey)
+	if value == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(value))
+}
+
+/*
+* Removes bodies and undo data of best chain blocks older than depth last
+* ones. Headers are kept, and transactions with unspent outputs too, so
+* inputs spending them can be still signed and verified. Blocks after the
+* flush marker of the UTXO set are kept to roll it forward after a crash.
+* A chain started from a UTXO snapshot is pruned after its historical
+* blocks are validated
+ */
+func pruneBlocks(b storage.ChainBatch, utxos utxoView, depth int) error {
+	if b.Index(stateIndex, snapshotBlockKey) != nil {
+		return nil
+	}
+	tip, err := readBlock(b, b.Tip())
+	if err != nil {
+		return err
+	}
+
+	start := prunedHeight(b)
+	end := tip.Height - depth + 1
+	if _, height, ok := utxoTip(b); ok && height+1 < end {
+		end = height + 1
+	}
+	if end <= start {
+		return nil
+	}
+
+	for height := start; height < end; height++ {
+		hash := b.Index(heightIndex, heightKey(height))
+		block, err := readBlock(b, hash)
+		if err != nil {
+			return err
+		}
+
+		header, err := gobEncode(block.Header())
+		if err != nil {
+			return err
+		}
+		err = b.PutIndex(headerIndex, block.Hash, header)
+		if err != nil {
+			return err
+		}
+		for _, tx := range block.Transactions {
+			if !hasUnspentOutputs(utxos, tx) {
+				continue
+			}
+			err = b.PutIndex(prunedTxIndex, tx.ID, tx.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		err = b.DeleteIndex(undoIndex, block.Hash)
+		if err != nil {
+			return err
+		}
+		err = b.DeleteBlock(block.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.PutIndex(stateIndex, prunedHeightKey, heightKey(end))
+}
+
+func hasUnspentOutputs(utxos utxoView, tx *Transaction) bool {
+	for outIdx := range tx.Vout {
+		if utxos.UTXO(outpointKey(tx.ID, outIdx)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads header of a kept or pruned block
+func readHeader(r storage.ChainReader, hash []byte) (*BlockHeader, error) {
+	if data := r.Index(headerIndex, hash); data != nil {
+		var header BlockHeader
+		err := gob.NewDecoder(bytes.NewReader(data)).Decode(&header)
+		return &header, err
+	}
+
+	block, err := readBlock(r, hash)
+	if err != nil {
+		return nil, err
+	}
+	header := block.Header()
+	return &header, nil
+}
+
+// Reads a transaction of a pruned block
+func readPrunedTransaction(r storage.ChainReader, ID []byte) (*Transaction, error) {
+	data := r.Index(prunedTxIndex, ID)
+	if data == nil {
+		return nil, errors.New("Transaction is not found")
+	}
+	tx, err := DeserializeTransaction(data)
+	return &tx, err
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestPruneBlocks(t *testing.T) {
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+	otherWallet := newTestWallet()
+	other := otherWallet.Address
+
+	tx := spendGenesis(bc, owner, genesis, *NewTXOutput(1000, other))
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), tx})
+	for i := 0; i < MinPruneDepth+1; i++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	}
+	tipHeight := bc.GetBestHeight()
+
+	assert.NotNil(t, bc.SetPruneDepth(MinPruneDepth-1), "Too small depth is rejected")
+	assert.False(t, bc.Pruned(), "Chain is not pruned")
+
+	assert.Nil(t, bc.SetPruneDepth(MinPruneDepth), "Pruning is enabled")
+	assert.True(t, bc.Pruned(), "Chain is pruned")
+	assert.Equal(t, tipHeight-MinPruneDepth+1, bc.PrunedHeight(), "Only the last blocks are kept")
+	_, err := bc.GetBlock(genesis.Hash)
+	assert.NotNil(t, err, "Genesis body is removed")
+
+	headers := bc.GetHeaders(nil, 1000)
+	if assert.Equal(t, tipHeight+1, len(headers), "Headers of all blocks are kept") {
+		assert.Equal(t, genesis.Hash, headers[0].Hash, "Headers start from genesis")
+	}
+	assert.Equal(t, MinPruneDepth, len(bc.GetBlockHashes()), "Only kept blocks are announced")
+
+	assert.NotNil(t, bc.Reindex(), "Pruned chain can't be reindexed")
+	_, err = bc.Export(&bytes.Buffer{})
+	assert.NotNil(t, err, "Pruned chain can't be exported")
+
+	// output of a transaction from a pruned block is still spendable
+	_, err = bc.FindTransaction(tx.ID)
+	assert.Nil(t, err, "Transaction with unspent outputs is kept")
+	spend := spendOutput(bc, otherWallet, tx.ID, 0, *NewTXOutput(1000, address))
+	assert.NotNil(t, bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), spend}), "Block is mined")
+	assert.Equal(t, 0, bc.GetBalance(other), "Output is spent")
+	assert.Equal(t, tipHeight-MinPruneDepth+2, bc.PrunedHeight(), "New tip prunes the next block")
+}
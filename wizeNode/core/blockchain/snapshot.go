@@ -0,0 +1,367 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+/*
+* UTXO snapshot is the chainstate bucket at some height: a header with the
+* block of that height and hash of the content, then UTXO records ordered
+* by outpoint. Records are framed like blocks of the chain file. The
+* content hash is the UTXO set digest, so it equals UTXOSet.Digest of a
+* node which tip is the snapshot block
+ */
+
+// keys of the state index kept while historical blocks of a loaded snapshot are not validated
+var (
+	snapshotBlockKey   = []byte("snapshot")
+	snapshotHashKey    = []byte("snapshothash")
+	snapshotGenesisKey = []byte("snapshotgenesis")
+)
+
+// ErrMissingHistory is returned by ValidateSnapshot while blocks below the snapshot are not received yet
+var ErrMissingHistory = errors.New("Blocks below the UTXO snapshot are not received yet")
+
+// SnapshotHeader describes the UTXO set of a snapshot
+type SnapshotHeader struct {
+	Height int
+	// serialized block of the height
+	Block []byte
+	Count int
+	Hash  []byte
+	// hash of the genesis block, it is published with the content hash
+	Genesis []byte
+}
+
+type snapshotRecord struct {
+	Outpoint []byte
+	Entry    []byte
+}
+
+/*
+* WriteSnapshot writes the UTXO set at the height of the best chain. It is
+* rolled back from the tip with undo data of later blocks. Returns the
+* header with the content hash to be published for nodes loading it
+ */
+func (bc *Blockchain) WriteSnapshot(w io.Writer, height int) (*SnapshotHeader, error) {
+	// the saved set is rolled back, so changes of the UTXO cache are flushed first
+	err := bc.FlushUTXO()
+	if err != nil {
+		return nil, err
+	}
+
+	var header *SnapshotHeader
+	utxos := make(map[string][]byte)
+
+	err = bc.store.View(func(r storage.ChainReader) error {
+		if r.Index(stateIndex, snapshotBlockKey) != nil {
+			return errors.New("UTXO snapshot of the node is not validated yet")
+		}
+		block, err := readBlock(r, r.Tip())
+		if err != nil {
+			return err
+		}
+		if height < 0 || height > block.Height {
+			return fmt.Errorf("Height %d is not in the chain of height %d", height, block.Height)
+		}
+		genesis := append([]byte{}, r.Index(heightIndex, heightKey(0))...)
+
+		err = r.ForEachUTXO(func(outpoint, entry []byte) error {
+			utxos[string(outpoint)] = append([]byte{}, entry...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for block.Height > height {
+			data := r.Index(undoIndex, block.Hash)
+			if data == nil {
+				return fmt.Errorf("Undo data of block %x is not found", block.Hash)
+			}
+			var undo blockUndo
+			err = gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+			if err != nil {
+				return err
+			}
+			for i := len(undo.Records) - 1; i >= 0; i-- {
+				record := undo.Records[i]
+				if record.Exists {
+					utxos[string(record.Outpoint)] = record.Entry
+				} else {
+					delete(utxos, string(record.Outpoint))
+				}
+			}
+
+			block, err = readBlock(r, block.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		header = &SnapshotHeader{Height: height, Block: block.Serialize(), Count: len(utxos), Genesis: genesis}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	outpoints := make([]string, 0, len(utxos))
+	for outpoint := range utxos {
+		outpoints = append(outpoints, outpoint)
+	}
+	sort.Strings(outpoints)
+
+	hash := sha256.New()
+	for _, outpoint := range outpoints {
+		hash.Write([]byte(outpoint))
+		hash.Write(utxos[outpoint])
+	}
+	header.Hash = hash.Sum(nil)
+
+	buffered := bufio.NewWriter(w)
+	data, err := gobEncode(header)
+	if err != nil {
+		return nil, err
+	}
+	err = writeRecord(buffered, data)
+	if err != nil {
+		return nil, err
+	}
+	for _, outpoint := range outpoints {
+		data, err := gobEncode(snapshotRecord{[]byte(outpoint), utxos[outpoint]})
+		if err != nil {
+			return nil, err
+		}
+		err = writeRecord(buffered, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return header, buffered.Flush()
+}
+
+/*
+* LoadSnapshot creates a blockchain in an empty store from the UTXO
+* snapshot. The snapshot is trusted only if its content hash is the
+* configured one. The node can serve from the snapshot block at once,
+* historical blocks are checked later with ValidateSnapshot: they should
+* start from the trusted genesis block
+ */
+func LoadSnapshot(store storage.ChainStore, r io.Reader, trustedHash, genesisHash []byte) (*Blockchain, error) {
+	if len(genesisHash) == 0 {
+		return nil, errors.New("Trusted genesis hash is not set")
+	}
+	buffered := bufio.NewReader(r)
+
+	data, err := readRecord(buffered, 2*MaxBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	var header SnapshotHeader
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header.Hash, trustedHash) {
+		return nil, fmt.Errorf("Snapshot hash %x is not the trusted one %x", header.Hash, trustedHash)
+	}
+	// the header is not covered by the hash, so this only stops snapshots of other networks early
+	if header.Genesis != nil && !bytes.Equal(header.Genesis, genesisHash) {
+		return nil, fmt.Errorf("Snapshot is made for genesis block %x, not %x", header.Genesis, genesisHash)
+	}
+	block, err := DeserializeBlock(header.Block)
+	if err != nil {
+		return nil, err
+	}
+	if block.Height != header.Height || block.Height == 0 {
+		return nil, fmt.Errorf("Snapshot block %x has wrong height %d", block.Hash, block.Height)
+	}
+	err = block.Header().Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Update(func(b storage.ChainBatch) error {
+		if b.Tip() != nil {
+			return errors.New("Blockchain already exists.")
+		}
+
+		hash := sha256.New()
+		for i := 0; i < header.Count; i++ {
+			data, err := readRecord(buffered, MaxBlockSize)
+			if err == io.EOF {
+				return errors.New("Snapshot is truncated")
+			}
+			if err != nil {
+				return err
+			}
+			var record snapshotRecord
+			err = gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+			if err != nil {
+				return err
+			}
+			hash.Write(record.Outpoint)
+			hash.Write(record.Entry)
+
+			err = b.PutUTXO(record.Outpoint, record.Entry)
+			if err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(hash.Sum(nil), header.Hash) {
+			return fmt.Errorf("Snapshot content doesn't match its hash %x", header.Hash)
+		}
+
+		err := b.PutBlock(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		for _, tx := range block.Transactions {
+			err = b.PutIndex(txIndex, tx.ID, block.Hash)
+			if err != nil {
+				return err
+			}
+		}
+		err = b.PutIndex(heightIndex, heightKey(block.Height), block.Hash)
+		if err != nil {
+			return err
+		}
+		err = setUTXOTip(b, block)
+		if err != nil {
+			return err
+		}
+		err = b.PutIndex(stateIndex, snapshotBlockKey, block.Hash)
+		if err != nil {
+			return err
+		}
+		err = b.PutIndex(stateIndex, snapshotHashKey, header.Hash)
+		if err != nil {
+			return err
+		}
+		err = b.PutIndex(stateIndex, snapshotGenesisKey, genesisHash)
+		if err != nil {
+			return err
+		}
+		return b.SetTip(block.Hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(block.Hash, store), nil
+}
+
+// SnapshotPending tells that the chain starts from a UTXO snapshot which historical blocks are not validated yet
+func (bc *Blockchain) SnapshotPending() bool {
+	pending := false
+	bc.store.View(func(r storage.ChainReader) error {
+		pending = r.Index(stateIndex, snapshotBlockKey) != nil
+		return nil
+	})
+	return pending
+}
+
+/*
+* ValidateSnapshot replays blocks from genesis up to the snapshot block in
+* a separate memory store with full validation and compares the UTXO set
+* with the snapshot. If they match, indexes of historical blocks are saved
+* and the chain is a usual one. ErrMissingHistory is returned while some
+* blocks are not received yet. Only hashes of the history are kept in
+* memory, blocks are read one by one during the replay
+ */
+func (bc *Blockchain) ValidateSnapshot() error {
+	var snapshotHash, genesisHash []byte
+	// hashes from the snapshot block down to genesis
+	hashes := [][]byte{}
+	err := bc.store.View(func(r storage.ChainReader) error {
+		hash := r.Index(stateIndex, snapshotBlockKey)
+		if hash == nil {
+			return nil
+		}
+		snapshotHash = append([]byte{}, r.Index(stateIndex, snapshotHashKey)...)
+		genesisHash = append([]byte{}, r.Index(stateIndex, snapshotGenesisKey)...)
+
+		hash = append([]byte{}, hash...)
+		for len(hash) > 0 {
+			if r.Block(hash) == nil {
+				return ErrMissingHistory
+			}
+			block, err := readBlock(r, hash)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, hash)
+			hash = block.PrevBlockHash
+		}
+		return nil
+	})
+	if err != nil || snapshotHash == nil {
+		return err
+	}
+
+	// history of other network can't replace the snapshot even with the same UTXO set
+	genesis := hashes[len(hashes)-1]
+	if !bytes.Equal(genesis, genesisHash) {
+		return fmt.Errorf("Genesis block %x differs from the trusted one %x", genesis, genesisHash)
+	}
+
+	block, err := bc.GetBlock(genesis)
+	if err != nil {
+		return err
+	}
+	replay, err := CreateBlockchainFromGenesis(&block, storage.NewMemoryChainStore())
+	if err != nil {
+		return err
+	}
+	for i := len(hashes) - 2; i >= 0; i-- {
+		block, err := bc.GetBlock(hashes[i])
+		if err != nil {
+			return err
+		}
+		err = replay.ValidateBlock(&block)
+		if err != nil {
+			return err
+		}
+		err = replay.AddBlock(&block)
+		if err != nil {
+			return err
+		}
+	}
+	if digest := (UTXOSet{replay}).Digest(); !bytes.Equal(digest, snapshotHash) {
+		return fmt.Errorf("UTXO set %x of the chain doesn't match the snapshot %x", digest, snapshotHash)
+	}
+
+	return bc.store.Update(func(b storage.ChainBatch) error {
+		err := replay.store.View(func(r storage.ChainReader) error {
+			for _, name := range []string{heightIndex, txIndex, undoIndex} {
+				err := r.ForEachIndex(name, func(k, v []byte) error {
+					return b.PutIndex(name, append([]byte{}, k...), append([]byte{}, v...))
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range [][]byte{snapshotBlockKey, snapshotHashKey, snapshotGenesisKey} {
+			err = b.DeleteIndex(stateIndex, key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestUTXOSnapshot(t *testing.T) {
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+	other := newTestWallet().Address
+
+	tx := spendGenesis(bc, owner, genesis, *NewTXOutput(10, other), *NewTXOutput(990, address))
+	block1 := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), tx})
+	block2 := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	digest := UTXOSet{bc}.Digest()
+	block3 := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+
+	file := &bytes.Buffer{}
+	header, err := bc.WriteSnapshot(file, 2)
+	if !assert.Nil(t, err, "Snapshot is written") {
+		return
+	}
+	assert.Equal(t, digest, header.Hash, "Snapshot hash is the UTXO set digest at its height")
+	assert.Equal(t, genesis.Hash, header.Genesis, "Snapshot names its genesis")
+	data := file.Bytes()
+
+	_, err = LoadSnapshot(storage.NewMemoryChainStore(), bytes.NewReader(data), []byte("other"), genesis.Hash)
+	assert.NotNil(t, err, "Snapshot with not trusted hash is rejected")
+	_, err = LoadSnapshot(storage.NewMemoryChainStore(), bytes.NewReader(data), header.Hash, nil)
+	assert.NotNil(t, err, "Trusted genesis is required")
+	_, err = LoadSnapshot(storage.NewMemoryChainStore(), bytes.NewReader(data), header.Hash, []byte("other"))
+	assert.NotNil(t, err, "Snapshot of other genesis is rejected")
+
+	store := storage.NewMemoryChainStore()
+	loaded, err := LoadSnapshot(store, bytes.NewReader(data), header.Hash, genesis.Hash)
+	if !assert.Nil(t, err, "Snapshot is loaded") {
+		return
+	}
+	assert.Equal(t, block2.Hash, loaded.GetTip(), "Snapshot block is the tip")
+	assert.Equal(t, 10, loaded.GetBalance(other), "Balance is served from the snapshot")
+	assert.True(t, loaded.SnapshotPending(), "Snapshot is not validated")
+	assert.Equal(t, ErrMissingHistory, loaded.ValidateSnapshot(), "Historical blocks are missing")
+
+	assert.Nil(t, loaded.AddBlock(block3), "New block is added")
+	assert.Equal(t, block3.Hash, loaded.GetTip(), "New block is the tip")
+
+	// historical blocks come from the tip down
+	assert.Nil(t, loaded.AddBlock(block1), "Historical block is added")
+	assert.Nil(t, loaded.AddBlock(genesis), "Genesis is added")
+	assert.Equal(t, block3.Hash, loaded.GetTip(), "Historical blocks don't change the tip")
+
+	assert.Nil(t, loaded.ValidateSnapshot(), "Snapshot is validated")
+	assert.False(t, loaded.SnapshotPending(), "Snapshot is validated")
+	_, err = loaded.FindTransaction(tx.ID)
+	assert.Nil(t, err, "Historical transaction is indexed")
+	assert.Equal(t, UTXOSet{bc}.Digest(), UTXOSet{loaded}.Digest(), "UTXO set is the same")
+	assert.Nil(t, loaded.Reindex(), "Validated chain can be reindexed")
+
+	// snapshot which content doesn't match the chain
+	empty := sha256.Sum256(nil)
+	forged, _ := gobEncode(SnapshotHeader{Height: 2, Block: block2.Serialize(), Count: 0, Hash: empty[:]})
+	file = &bytes.Buffer{}
+	writeRecord(file, forged)
+	loaded, err = LoadSnapshot(storage.NewMemoryChainStore(), bytes.NewReader(file.Bytes()), empty[:], genesis.Hash)
+	if !assert.Nil(t, err, "Forged snapshot is loaded with its hash") {
+		return
+	}
+	loaded.AddBlock(block1)
+	loaded.AddBlock(genesis)
+	assert.NotNil(t, loaded.ValidateSnapshot(), "Forged snapshot is detected")
+	assert.True(t, loaded.SnapshotPending(), "Forged snapshot is not validated")
+
+	// history should start from the trusted genesis
+	loaded, err = LoadSnapshot(storage.NewMemoryChainStore(), bytes.NewReader(file.Bytes()), empty[:], []byte("other"))
+	if !assert.Nil(t, err, "Snapshot without genesis is loaded") {
+		return
+	}
+	loaded.AddBlock(block1)
+	loaded.AddBlock(genesis)
+	err = loaded.ValidateSnapshot()
+	if assert.NotNil(t, err, "History of other genesis is rejected") {
+		assert.Contains(t, err.Error(), "trusted one", "Genesis is checked")
+	}
+}
@@ -25,6 +25,8 @@ type Transaction struct {
 	ID        []byte
 	Vin       []TXInput
 	Vout      []TXOutput
+	// block height or unix time before which the transaction can't be mined, see IsFinal
+	LockTime int64
 }
 
 type TransactionToSign struct {
@@ -166,7 +168,7 @@ func (tx *Transaction) Sign(privKey crypto.PrivateKey, prevTXs map[string]Transa
 		if err != nil {
 			log.Panic(err)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		signature := crypto.SerializeSignature(r, s)
 
 		tx.Vin[inID].Signature = signature
 		txCopy.Vin[inID].PubKey = nil
@@ -181,7 +183,7 @@ func (tx Transaction) String() string {
 
 	for i, input := range tx.Vin {
 		pubKeyHash := crypto.HashPubKey(input.PubKey)
-		versionedPayload := append([]byte{crypto.Version}, pubKeyHash...)
+		versionedPayload := append([]byte{crypto.AddressVersion()}, pubKeyHash...)
 		fullPayload := append(versionedPayload, crypto.Checksum(versionedPayload)...)
 
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
@@ -190,6 +192,10 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
 		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
 		lines = append(lines, fmt.Sprintf("       Addr  :    %s", crypto.Base58Encode(fullPayload)))
+		// locks are signed with the text, they are omitted when not set to keep old signatures valid
+		if input.Sequence != 0 {
+			lines = append(lines, fmt.Sprintf("       Sequence:  %d", input.Sequence))
+		}
 	}
 
 	for i, output := range tx.Vout {
@@ -199,6 +205,10 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("       Addr  : %s", output.Address))
 	}
 
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
+	}
+
 	return strings.Join(lines, "\n")
 }
 
@@ -208,7 +218,7 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil, vin.Sequence})
 	}
 
 	for _, vout := range tx.Vout {
@@ -216,7 +226,7 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash, vout.Address})
 	}
 
-	txCopy := Transaction{tx.Timestamp, tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.Timestamp, tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
@@ -279,9 +289,9 @@ func NewCoinbaseTX(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
+	txin := TXInput{[]byte{}, -1, nil, []byte(data), 0}
 	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{time.Now().UnixNano(), nil, []TXInput{txin}, []TXOutput{*txout}}
+	tx := Transaction{time.Now().UnixNano(), nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
@@ -298,16 +308,20 @@ func NewEmissionCoinbaseTX(to, data string, emission int) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
+	txin := TXInput{[]byte{}, -1, nil, []byte(data), 0}
 	txout := NewTXOutput(emission, to)
-	tx := Transaction{time.Now().UnixNano(), nil, []TXInput{txin}, []TXOutput{*txout}}
+	tx := Transaction{time.Now().UnixNano(), nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-// PrepareUTXOTransaction prepare a new transaction
-func PrepareUTXOTransaction(from, to string, amount int, pubKey []byte, UTXOSet *UTXOSet) (*Transaction, *TransactionToSign, error) {
+/*
+* PrepareUTXOTransaction prepare a new transaction. It can't be mined before
+* lockTime, inputs get the sequence as their relative lock (see IsFinal and
+* CheckTransactionLocks), zero values are no locks
+ */
+func PrepareUTXOTransaction(from, to string, amount int, pubKey []byte, lockTime int64, sequence uint32, UTXOSet *UTXOSet) (*Transaction, *TransactionToSign, error) {
 	var inputs []TXInput
 	var outputs []TXOutput
 
@@ -338,7 +352,7 @@ func PrepareUTXOTransaction(from, to string, amount int, pubKey []byte, UTXOSet
 		for _, out := range outs {
 			// OLDTODO: delete
 			//fmt.Println("Output", out)
-			input := TXInput{txID, out, nil, pubKey}
+			input := TXInput{txID, out, nil, pubKey, sequence}
 			inputs = append(inputs, input)
 		}
 	}
@@ -349,7 +363,7 @@ func PrepareUTXOTransaction(from, to string, amount int, pubKey []byte, UTXOSet
 		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
 	}
 
-	tx := Transaction{time.Now().UnixNano(), nil, inputs, outputs}
+	tx := Transaction{time.Now().UnixNano(), nil, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()
 	fmt.Printf("tx.ID: %x\n", tx.ID)
 
@@ -364,8 +378,8 @@ func SignUTXOTransaction(preparedTx *Transaction, txSignatures *TransactionWithS
 	return preparedTx
 }
 
-// NewUTXOTransaction creates a new transaction
-func NewUTXOTransaction(walletFrom *wallet.Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewUTXOTransaction creates a new transaction, locks are the same as of PrepareUTXOTransaction
+func NewUTXOTransaction(walletFrom *wallet.Wallet, to string, amount int, lockTime int64, sequence uint32, UTXOSet *UTXOSet) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
@@ -390,7 +404,7 @@ func NewUTXOTransaction(walletFrom *wallet.Wallet, to string, amount int, UTXOSe
 		for _, out := range outs {
 			// OLDTODO: delete
 			//fmt.Println("Output", out)
-			input := TXInput{txID, out, nil, walletFrom.PublicKey}
+			input := TXInput{txID, out, nil, walletFrom.PublicKey, sequence}
 			inputs = append(inputs, input)
 		}
 	}
@@ -402,7 +416,7 @@ func NewUTXOTransaction(walletFrom *wallet.Wallet, to string, amount int, UTXOSe
 		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
 	}
 
-	tx := Transaction{time.Now().UnixNano(), nil, inputs, outputs}
+	tx := Transaction{time.Now().UnixNano(), nil, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()
 	UTXOSet.Blockchain.SignTransaction(&tx, walletFrom.PrivateKey)
 
@@ -410,12 +424,16 @@ func NewUTXOTransaction(walletFrom *wallet.Wallet, to string, amount int, UTXOSe
 }
 
 // DeserializeTransaction deserializes a transaction
-func DeserializeTransaction(data []byte) Transaction {
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
+	if len(data) > MaxBlockSize {
+		return transaction, fmt.Errorf("Transaction size %d is over limit %d", len(data), MaxBlockSize)
+	}
+
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
 	if err != nil {
-		fmt.Println(err)
+		return transaction, fmt.Errorf("Decode transaction: %s", err)
 	}
-	return transaction
+	return transaction, nil
 }
@@ -12,6 +12,8 @@ type TXInput struct {
 	Vout      int
 	Signature []byte
 	PubKey    []byte
+	// relative lock of the spent output, see SequenceLockDisabled
+	Sequence uint32
 }
 
 // UsesKey checks whether the address initiated the transaction
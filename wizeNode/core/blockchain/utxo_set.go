@@ -1,49 +1,95 @@
 package blockchain
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-
-	"github.com/boltdb/bolt"
 )
 
-const utxoBucket = "chainstate"
-
 // UTXOSet represents UTXO set
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
+/*
+* UTXOEntry is one unspent output of the set. It is keyed by its outpoint,
+* transaction ID and output index, so spending an output doesn't touch
+* other outputs of the transaction. Height and the coinbase flag of the
+* transaction are kept for maturity rules
+ */
+type UTXOEntry struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// Serialize serializes UTXOEntry
+func (entry UTXOEntry) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(entry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeUTXOEntry deserializes UTXOEntry
+func DeserializeUTXOEntry(data []byte) UTXOEntry {
+	var entry UTXOEntry
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&entry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return entry
+}
+
+// Key of an output in the UTXO set: transaction ID and big endian output index, outputs of a transaction are adjacent
+func outpointKey(txID []byte, vout int) []byte {
+	key := make([]byte, len(txID)+4)
+	copy(key, txID)
+	binary.BigEndian.PutUint32(key[len(txID):], uint32(vout))
+	return key
+}
+
+func splitOutpoint(key []byte) (txID []byte, vout int) {
+	return key[:len(key)-4], int(binary.BigEndian.Uint32(key[len(key)-4:]))
+}
+
 // FindSpendableOutputs finds and returns unspent outputs to reference in inputs
 // OLDTODO: rewrite for 2 transaction in one block include
 func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
-	db := u.Blockchain.Db
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
+	bc := u.Blockchain
+	// outputs should be spendable in the next block
+	height := bc.GetBestHeight() + 1
 
-			fmt.Printf("txID: %s, outs: %d\n", txID, len(outs.Outputs))
+	err := bc.utxos.forEach(bc.store, func(k, v []byte, entry UTXOEntry) error {
+		if !entry.IsMature(height) {
+			return nil
+		}
+		ID, outIdx := splitOutpoint(k)
+		txID := hex.EncodeToString(ID)
+		out := entry.Output
 
-			for outIdx, out := range outs.Outputs {
-				fmt.Printf("outIdx: %d, value: %d\n", outIdx, out.Value)
+		fmt.Printf("txID: %s, outIdx: %d, value: %d\n", txID, outIdx, out.Value)
 
-				// OLDTODO: rewrite to smart choice of outputs
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-					fmt.Printf("accumulated: %d, value: %d\n", accumulated, out.Value)
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				}
-			}
+		// OLDTODO: rewrite to smart choice of outputs
+		if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
+			fmt.Printf("accumulated: %d, value: %d\n", accumulated, out.Value)
+			accumulated += out.Value
+			unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -56,22 +102,12 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 // FindUTXO finds UTXO for a public key hash
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	var UTXOs []TXOutput
-	db := u.Blockchain.Db
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
+	bc := u.Blockchain
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
-
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
+	err := bc.utxos.forEach(bc.store, func(k, v []byte, entry UTXOEntry) error {
+		if entry.Output.IsLockedWithKey(pubKeyHash) {
+			UTXOs = append(UTXOs, entry.Output)
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -83,17 +119,17 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 
 // CountTransactions returns the number of transactions in the UTXO set
 func (u UTXOSet) CountTransactions() int {
-	db := u.Blockchain.Db
+	bc := u.Blockchain
 	counter := 0
+	var last []byte
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+	// outputs of a transaction are adjacent
+	err := bc.utxos.forEach(bc.store, func(k, v []byte, entry UTXOEntry) error {
+		txID, _ := splitOutpoint(k)
+		if !bytes.Equal(txID, last) {
 			counter++
+			last = append([]byte{}, txID...)
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -103,98 +139,26 @@ func (u UTXOSet) CountTransactions() int {
 	return counter
 }
 
-// Reindex rebuilds the UTXO set
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.Db
-	bucketName := []byte(utxoBucket)
-
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bolt.ErrBucketNotFound {
-			log.Panic(err)
-		}
-
-		_, err = tx.CreateBucket(bucketName)
-		if err != nil {
-			log.Panic(err)
-		}
+// Digest returns hash of the whole UTXO set. Nodes with the same set have the same digest
+func (u UTXOSet) Digest() []byte {
+	hash := sha256.New()
+	bc := u.Blockchain
 
+	err := bc.utxos.forEach(bc.store, func(k, v []byte, entry UTXOEntry) error {
+		hash.Write(k)
+		hash.Write(v)
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	UTXO := u.Blockchain.FindUTXO()
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
-			if err != nil {
-				log.Panic(err)
-			}
-
-			err = b.Put(key, outs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
-		}
-
-		return nil
-	})
+	return hash.Sum(nil)
 }
 
-// Update updates the UTXO set with transactions from the Block
-// The Block is considered to be the tip of a blockchain
-func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Db
-
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
-
-				}
-			}
-
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
-
-			err := b.Put(tx.ID, newOutputs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
-		}
-
-		return nil
-	})
+// Reindex rebuilds the UTXO set and indexes of the chain
+func (u UTXOSet) Reindex() {
+	err := u.Blockchain.Reindex()
 	if err != nil {
 		log.Panic(err)
 	}
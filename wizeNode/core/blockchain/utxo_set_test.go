@@ -0,0 +1,45 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestUTXOSetByOutpoint(t *testing.T) {
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+	otherWallet := newTestWallet()
+	other := otherWallet.Address
+
+	tx := spendGenesis(bc, owner, genesis, *NewTXOutput(10, other), *NewTXOutput(20, other), *NewTXOutput(970, address))
+	coinbase := NewCoinbaseTX(address, "")
+	block := bc.MineBlock([]*Transaction{coinbase, tx})
+	if !assert.NotNil(t, block, "Block is mined") {
+		return
+	}
+
+	entries := make(map[string]UTXOEntry)
+	bc.utxos.forEach(bc.store, func(outpoint, data []byte, entry UTXOEntry) error {
+		entries[string(outpoint)] = entry
+		return nil
+	})
+	assert.Equal(t, 4, len(entries), "Every output is a separate entry")
+	assert.Equal(t, UTXOEntry{tx.Vout[1], block.Height, false}, entries[string(outpointKey(tx.ID, 1))], "Entry keeps the output with its height")
+	assert.True(t, entries[string(outpointKey(coinbase.ID, 0))].Coinbase, "Coinbase output is marked")
+	assert.Equal(t, 2, UTXOSet{bc}.CountTransactions(), "Outputs are counted by transaction")
+
+	// the middle output is spent, the last one keeps its index
+	spend := spendOutput(bc, otherWallet, tx.ID, 1, *NewTXOutput(20, address))
+	assert.NotNil(t, bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), spend}), "Middle output is spent")
+
+	last := spendOutput(bc, owner, tx.ID, 2, *NewTXOutput(970, other))
+	assert.NotNil(t, bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), last}), "Last output is spent by its index")
+	assert.Equal(t, 980, bc.GetBalance(other), "Other outputs of the transaction are unspent")
+
+	// the same output can't be spent again
+	again := spendOutput(bc, otherWallet, tx.ID, 1, *NewTXOutput(20, other))
+	assert.NotNil(t, bc.AddBlock(NewBlock([]*Transaction{NewCoinbaseTX(address, ""), again}, bc.GetTip(), bc.GetBestHeight()+1)), "Spent output is rejected")
+}
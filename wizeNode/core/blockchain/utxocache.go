@@ -0,0 +1,396 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+// DefaultUTXOCacheSize is the size limit of the UTXO cache in bytes
+const DefaultUTXOCacheSize = 16 << 20
+
+// Changes of the UTXO cache are flushed at least once in this count of connected blocks
+const utxoFlushBlocks = 100
+
+// height of the block the saved UTXO set is built for, in the state index
+var utxoHeightKey = []byte("utxoheight")
+
+var errCacheFull = errors.New("UTXO cache is full")
+
+// utxoView reads and changes UTXO records while blocks are connected or disconnected
+type utxoView interface {
+	UTXO(outpoint []byte) []byte
+	PutUTXO(outpoint, data []byte) error
+	DeleteUTXO(outpoint []byte) error
+}
+
+type cachedUTXO struct {
+	// serialized UTXOEntry, nil if the output is spent and it is not flushed yet
+	data    []byte
+	decoded UTXOEntry
+	// changed after the last flush
+	dirty bool
+}
+
+/*
+* UTXO cache keeps changes of connected blocks in memory and writes them
+* to the store in a batch with a block, after utxoFlushBlocks blocks or
+* when they take half of the size limit. The saved UTXO set is marked with
+* the block it is built for, so after a crash the set is rolled forward
+* from this block. If the whole saved set fits the size limit, it is read
+* to memory and reads don't touch the store
+ */
+type utxoCache struct {
+	mutex   sync.RWMutex
+	entries map[string]*cachedUTXO
+	limit   int
+	// size of all entries and of changed ones in bytes
+	size      int
+	dirtySize int
+	// blocks connected after the last flush
+	blocks int
+	// all saved records are in entries
+	complete bool
+	// saved set doesn't fit the limit, it is not loaded again until the cache is cleared
+	tooBig bool
+}
+
+func newUTXOCache(limit int) *utxoCache {
+	return &utxoCache{entries: make(map[string]*cachedUTXO), limit: limit}
+}
+
+// Returns an output known to the cache, found is false if the store should be read
+func (c *utxoCache) get(outpoint []byte) (data []byte, found bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if entry, ok := c.entries[string(outpoint)]; ok {
+		return entry.data, true
+	}
+	return nil, c.complete
+}
+
+// Calls fn for all unspent outputs ordered by outpoint, the store is read if the set is not loaded
+func (c *utxoCache) forEach(store storage.ChainStore, fn func(outpoint, data []byte, entry UTXOEntry) error) error {
+	c.load(store)
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.complete {
+		keys := make([]string, 0, len(c.entries))
+		for key, entry := range c.entries {
+			if entry.data != nil {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := c.entries[key]
+			err := fn([]byte(key), entry.data, entry.decoded)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// saved records are overridden with changed ones, new outputs are merged in order
+	added := []string{}
+	for key, entry := range c.entries {
+		if entry.data != nil {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	next := 0
+	emitAdded := func(before []byte) error {
+		for ; next < len(added) && (before == nil || added[next] < string(before)); next++ {
+			entry := c.entries[added[next]]
+			err := fn([]byte(added[next]), entry.data, entry.decoded)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := store.View(func(r storage.ChainReader) error {
+		return r.ForEachUTXO(func(outpoint, data []byte) error {
+			err := emitAdded(outpoint)
+			if err != nil {
+				return err
+			}
+			// a changed output is emitted from the cache
+			if _, ok := c.entries[string(outpoint)]; ok {
+				return nil
+			}
+			return fn(outpoint, data, DeserializeUTXOEntry(data))
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return emitAdded(nil)
+}
+
+// Reads the saved set to memory if it fits the size limit
+func (c *utxoCache) load(store storage.ChainStore) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.complete || c.tooBig {
+		return
+	}
+
+	loaded := make(map[string]*cachedUTXO)
+	size := 0
+	store.View(func(r storage.ChainReader) error {
+		return r.ForEachUTXO(func(outpoint, data []byte) error {
+			if _, ok := c.entries[string(outpoint)]; ok {
+				return nil
+			}
+			size += len(outpoint) + len(data)
+			if c.size+size > c.limit {
+				c.tooBig = true
+				return errCacheFull
+			}
+			data = append([]byte{}, data...)
+			loaded[string(outpoint)] = &cachedUTXO{data: data, decoded: DeserializeUTXOEntry(data)}
+			return nil
+		})
+	})
+	if c.tooBig {
+		return
+	}
+
+	for outpoint, entry := range loaded {
+		c.entries[outpoint] = entry
+	}
+	c.size += size
+	c.complete = true
+}
+
+// Applies changes of connected blocks. If they are flushed, all entries become clean
+func (c *utxoCache) apply(changes map[string][]byte, blocks int, flushed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for outpoint, data := range changes {
+		if entry, ok := c.entries[outpoint]; ok {
+			c.size -= len(outpoint) + len(entry.data)
+			if entry.dirty {
+				c.dirtySize -= len(outpoint) + len(entry.data)
+			}
+		}
+		entry := &cachedUTXO{data: data, dirty: true}
+		if data != nil {
+			entry.decoded = DeserializeUTXOEntry(data)
+		}
+		c.entries[outpoint] = entry
+		c.size += len(outpoint) + len(data)
+		c.dirtySize += len(outpoint) + len(data)
+	}
+	c.blocks += blocks
+
+	if flushed {
+		for outpoint, entry := range c.entries {
+			if entry.data == nil {
+				c.size -= len(outpoint)
+				delete(c.entries, outpoint)
+			}
+			entry.dirty = false
+		}
+		c.dirtySize = 0
+		c.blocks = 0
+	}
+
+	// clean entries are dropped when the set grows over the limit
+	if c.size > c.limit {
+		for outpoint, entry := range c.entries {
+			if !entry.dirty {
+				c.size -= len(outpoint) + len(entry.data)
+				delete(c.entries, outpoint)
+			}
+		}
+		c.complete = false
+		c.tooBig = true
+	}
+}
+
+// Tells that there are changes which are not flushed
+func (c *utxoCache) changed() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.blocks > 0 || c.dirtySize > 0
+}
+
+// Tells that changes should be flushed with the next block
+func (c *utxoCache) shouldFlush(pending int) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.blocks+1 >= utxoFlushBlocks || c.dirtySize+pending > c.limit/2
+}
+
+// Writes changed entries to the batch, they are marked clean by apply after commit
+func (c *utxoCache) writeDirty(b storage.ChainBatch) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for outpoint, entry := range c.entries {
+		if !entry.dirty {
+			continue
+		}
+		var err error
+		if entry.data == nil {
+			err = b.DeleteUTXO([]byte(outpoint))
+		} else {
+			err = b.PutUTXO([]byte(outpoint), entry.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drops all entries, e.g. after the saved set is rebuilt
+func (c *utxoCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]*cachedUTXO)
+	c.size = 0
+	c.dirtySize = 0
+	c.blocks = 0
+	c.complete = false
+	c.tooBig = false
+}
+
+func (c *utxoCache) setLimit(limit int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.limit = limit
+	c.tooBig = false
+}
+
+/*
+* Changes of blocks connected in one batch. Reads see these changes, then
+* the cache, then the saved set. Changes go to the cache after commit
+ */
+type cachedUTXOView struct {
+	cache   *utxoCache
+	batch   storage.ChainBatch
+	changes map[string][]byte
+	size    int
+}
+
+func (c *utxoCache) newView(b storage.ChainBatch) *cachedUTXOView {
+	return &cachedUTXOView{cache: c, batch: b, changes: make(map[string][]byte)}
+}
+
+func (v *cachedUTXOView) UTXO(outpoint []byte) []byte {
+	if data, ok := v.changes[string(outpoint)]; ok {
+		return data
+	}
+	if data, found := v.cache.get(outpoint); found {
+		return data
+	}
+	return v.batch.UTXO(outpoint)
+}
+
+func (v *cachedUTXOView) PutUTXO(outpoint, data []byte) error {
+	v.changes[string(outpoint)] = append([]byte{}, data...)
+	v.size += len(outpoint) + len(data)
+	return nil
+}
+
+func (v *cachedUTXOView) DeleteUTXO(outpoint []byte) error {
+	v.changes[string(outpoint)] = nil
+	v.size += len(outpoint)
+	return nil
+}
+
+// Writes changes of the view to the batch after changes of the cache
+func (v *cachedUTXOView) flush() error {
+	err := v.cache.writeDirty(v.batch)
+	if err != nil {
+		return err
+	}
+	for outpoint, data := range v.changes {
+		if data == nil {
+			err = v.batch.DeleteUTXO([]byte(outpoint))
+		} else {
+			err = v.batch.PutUTXO([]byte(outpoint), data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushUTXO writes changes of the UTXO cache to the store, the saved set is marked with the tip
+func (bc *Blockchain) FlushUTXO() error {
+	if !bc.utxos.changed() {
+		return nil
+	}
+	bc.chainMutex.Lock()
+	defer bc.chainMutex.Unlock()
+
+	err := bc.store.Update(func(b storage.ChainBatch) error {
+		return flushUTXO(b, bc.utxos.newView(b))
+	})
+	if err != nil {
+		return err
+	}
+	bc.utxos.apply(nil, 0, true)
+	return nil
+}
+
+// SetUTXOCacheSize sets the size limit of the UTXO cache in bytes
+func (bc *Blockchain) SetUTXOCacheSize(size int) {
+	bc.utxos.setLimit(size)
+}
+
+// Writes changes of the cache and the view to the batch and marks the saved set with the tip
+func flushUTXO(b storage.ChainBatch, view *cachedUTXOView) error {
+	err := view.flush()
+	if err != nil {
+		return err
+	}
+	tip, err := readBlock(b, b.Tip())
+	if err != nil {
+		return err
+	}
+	return setUTXOTip(b, tip)
+}
+
+// Marks the saved UTXO set as built for the block
+func setUTXOTip(b storage.ChainBatch, block *Block) error {
+	err := b.PutIndex(stateIndex, utxoVersionKey, utxoVersion)
+	if err != nil {
+		return err
+	}
+	err = b.PutIndex(stateIndex, utxoTipKey, block.Hash)
+	if err != nil {
+		return err
+	}
+	return b.PutIndex(stateIndex, utxoHeightKey, heightKey(block.Height))
+}
+
+// Returns the block the saved UTXO set is built for, ok is false if it is not marked
+func utxoTip(r storage.ChainReader) (hash []byte, height int, ok bool) {
+	hash = r.Index(stateIndex, utxoTipKey)
+	value := r.Index(stateIndex, utxoHeightKey)
+	if hash == nil || value == nil {
+		return nil, 0, false
+	}
+	return hash, int(binary.BigEndian.Uint64(value)), true
+}
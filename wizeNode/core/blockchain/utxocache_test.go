@@ -0,0 +1,58 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestUTXOCache(t *testing.T) {
+	store := storage.NewMemoryChainStore()
+	bc, owner, genesis := newTestChain(t, store)
+	address := owner.Address
+	for i := 0; i < 3; i++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	}
+	tip, _ := bc.GetBlock(bc.GetTip())
+
+	savedHeight := func() int {
+		height := -1
+		store.View(func(r storage.ChainReader) error {
+			_, height, _ = utxoTip(r)
+			return nil
+		})
+		return height
+	}
+	assert.Equal(t, 0, savedHeight(), "Changes of new blocks are not flushed")
+	assert.Equal(t, 4, UTXOSet{bc}.CountTransactions(), "Changes are read from the cache")
+	digest := UTXOSet{bc}.Digest()
+
+	// node stops without flush, the saved set is rolled forward on open
+	reopened, err := NewBlockchainFromStore(store)
+	if !assert.Nil(t, err, "Blockchain is opened") {
+		return
+	}
+	assert.Equal(t, tip.Height, savedHeight(), "Saved set is rolled forward to the tip")
+	assert.Equal(t, digest, UTXOSet{reopened}.Digest(), "UTXO set is the same")
+
+	// saved set is read to memory once
+	assert.Equal(t, 4, UTXOSet{reopened}.CountTransactions(), "Saved set is read")
+	assert.True(t, reopened.utxos.complete, "Saved set fits the cache")
+	store.Update(func(b storage.ChainBatch) error {
+		return b.DeleteUTXO(outpointKey(genesis.Transactions[0].ID, 0))
+	})
+	assert.Equal(t, 4, UTXOSet{reopened}.CountTransactions(), "Outputs are served from memory")
+
+	// set over the limit is read from the store with cached changes over it
+	reopened.SetUTXOCacheSize(1)
+	reopened.utxos.clear()
+	reopened.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	assert.False(t, reopened.utxos.complete, "Saved set doesn't fit the cache")
+	assert.Equal(t, 4, UTXOSet{reopened}.CountTransactions(), "Saved records and cached changes are read")
+
+	assert.Nil(t, reopened.FlushUTXO(), "Cache is flushed")
+	assert.Equal(t, tip.Height+1, savedHeight(), "Saved set is marked with the tip")
+	assert.False(t, reopened.utxos.changed(), "All changes are flushed")
+}
@@ -0,0 +1,244 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+/*
+* ValidateBlock fully checks a block which should follow the tip: size,
+* proof-of-work of the header and transactions, link to the tip, timestamp,
+* single coinbase, signatures and amounts of transactions. Lock times and
+* coinbase maturity are checked when the block is connected
+ */
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	err := checkBlock(block)
+	if err != nil {
+		return err
+	}
+
+	tip, err := bc.GetBlock(bc.GetTip())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(block.PrevBlockHash, tip.Hash) {
+		return fmt.Errorf("Block %x doesn't follow the tip %x", block.Hash, tip.Hash)
+	}
+	if block.Height != tip.Height+1 {
+		return fmt.Errorf("Block %x has wrong height %d", block.Hash, block.Height)
+	}
+
+	err = bc.CheckBlockTimestamp(block)
+	if err != nil {
+		return err
+	}
+	return bc.store.View(func(r storage.ChainReader) error {
+		return validateTransactions(r, block)
+	})
+}
+
+// Checks what doesn't depend on the chain: size and proof-of-work of the header
+func checkBlock(block *Block) error {
+	if size := len(block.Serialize()); size > MaxBlockSize {
+		return fmt.Errorf("Block %x size %d is over limit %d", block.Hash, size, MaxBlockSize)
+	}
+	return block.Header().Validate()
+}
+
+/*
+* Checks a stored block when it joins the best chain in a batch: height and
+* timestamp against its parent and transactions against the chain state
+* of the batch. Blocks out of the best chain are kept unchecked
+ */
+func checkConnect(r storage.ChainReader, block *Block) error {
+	parent, err := readBlock(r, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("Block %x has wrong height %d", block.Hash, block.Height)
+	}
+	median, ok := medianTime(r, block.PrevBlockHash)
+	if ok && block.Timestamp <= median {
+		return fmt.Errorf("Block %x timestamp %d is not after median time %d", block.Hash, block.Timestamp, median)
+	}
+	return validateTransactions(r, block)
+}
+
+// Checks transactions of a block. Outputs of earlier transactions of the block can be spent by later ones
+func validateTransactions(r storage.ChainReader, block *Block) error {
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return fmt.Errorf("Block %x doesn't start with coinbase", block.Hash)
+	}
+
+	known := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	fees := 0
+
+	for i, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		if _, ok := known[txID]; ok {
+			return fmt.Errorf("Block %x has duplicate transaction %s", block.Hash, txID)
+		}
+		outputs := 0
+		for _, out := range tx.Vout {
+			if out.Value < 0 {
+				return fmt.Errorf("Transaction %s has negative output", txID)
+			}
+			outputs += out.Value
+		}
+
+		if i > 0 {
+			if tx.IsCoinbase() {
+				return fmt.Errorf("Block %x has more than one coinbase", block.Hash)
+			}
+
+			inputs := 0
+			prevTXs := make(map[string]Transaction)
+			for _, vin := range tx.Vin {
+				outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+				if spent[outpoint] {
+					return fmt.Errorf("Output %s is spent twice in block %x", outpoint, block.Hash)
+				}
+				spent[outpoint] = true
+
+				prevTX, ok := known[hex.EncodeToString(vin.Txid)]
+				if !ok {
+					var err error
+					prevTX, err = findTransaction(r, vin.Txid)
+					if err != nil {
+						return fmt.Errorf("Transaction %s spends unknown output %s", txID, outpoint)
+					}
+				}
+				if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+					return fmt.Errorf("Transaction %s spends unknown output %s", txID, outpoint)
+				}
+				inputs += prevTX.Vout[vin.Vout].Value
+				prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+			}
+
+			if outputs > inputs {
+				return fmt.Errorf("Transaction %s spends %d more than its inputs %d", txID, outputs, inputs)
+			}
+			fees += inputs - outputs
+
+			ok, err := tx.Verify(prevTXs)
+			if !ok {
+				return fmt.Errorf("Transaction %s is not valid: %s", txID, err)
+			}
+		}
+
+		known[txID] = *tx
+	}
+
+	coinbase := 0
+	for _, out := range block.Transactions[0].Vout {
+		coinbase += out.Value
+	}
+	if coinbase > subsidy+fees {
+		return fmt.Errorf("Coinbase of block %x pays %d over subsidy and fees %d", block.Hash, coinbase, subsidy+fees)
+	}
+	return nil
+}
+
+/*
+* VerifyChain checks stored data of the best chain: every block is read by
+* its height and validated again like a received one, while it is replayed
+* in a separate memory store. Then indexes and the UTXO set are compared
+* with the replayed ones. Returns height of the first corrupt block, or
+* the tip height if the chain state doesn't match blocks. Progress is
+* called after every block
+ */
+func (bc *Blockchain) VerifyChain(progress func(done, total int)) (int, error) {
+	tipHeight := 0
+	err := bc.store.View(func(r storage.ChainReader) error {
+		if r.Index(stateIndex, snapshotBlockKey) != nil {
+			return errors.New("Chain started from a UTXO snapshot can't be verified before it is validated")
+		}
+		if height := prunedHeight(r); height > 0 {
+			return fmt.Errorf("Blocks below height %d are pruned", height)
+		}
+		tip, err := readBlock(r, r.Tip())
+		if err != nil {
+			return err
+		}
+		tipHeight = tip.Height
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var replay *Blockchain
+	for height := 0; height <= tipHeight; height++ {
+		var block *Block
+		err = bc.store.View(func(r storage.ChainReader) error {
+			hash := r.Index(heightIndex, heightKey(height))
+			if hash == nil {
+				return errors.New("Block is not in the height index")
+			}
+			var err error
+			block, err = readBlock(r, hash)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(block.Hash, hash) || block.Height != height {
+				return fmt.Errorf("Block %x is saved as %x at height %d", block.Hash, hash, height)
+			}
+			for _, tx := range block.Transactions {
+				if !bytes.Equal(r.Index(txIndex, tx.ID), block.Hash) {
+					return fmt.Errorf("Transaction %x is not indexed", tx.ID)
+				}
+			}
+			if r.Index(undoIndex, block.Hash) == nil {
+				return errors.New("Undo data is not found")
+			}
+			return nil
+		})
+		if err != nil {
+			return height, err
+		}
+
+		if height == 0 {
+			replay, err = CreateBlockchainFromGenesis(block, storage.NewMemoryChainStore())
+		} else {
+			err = replay.ValidateBlock(block)
+			if err == nil {
+				err = replay.AddBlock(block)
+			}
+		}
+		if err != nil {
+			return height, err
+		}
+
+		if progress != nil {
+			progress(height+1, tipHeight+1)
+		}
+	}
+
+	// the saved set is compared, not the cached one
+	err = bc.FlushUTXO()
+	if err != nil {
+		return tipHeight, err
+	}
+	hash := sha256.New()
+	err = bc.store.View(func(r storage.ChainReader) error {
+		return r.ForEachUTXO(func(outpoint, entry []byte) error {
+			hash.Write(outpoint)
+			hash.Write(entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return tipHeight, err
+	}
+	if digest, expected := hash.Sum(nil), (UTXOSet{replay}).Digest(); !bytes.Equal(digest, expected) {
+		return tipHeight, fmt.Errorf("UTXO set %x doesn't match blocks %x", digest, expected)
+	}
+	return tipHeight, nil
+}
@@ -0,0 +1,53 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/storage"
+)
+
+func TestVerifyChain(t *testing.T) {
+	bc, owner, genesis := newTestChain(t, storage.NewMemoryChainStore())
+	address := owner.Address
+	other := newTestWallet().Address
+
+	tx := spendGenesis(bc, owner, genesis, *NewTXOutput(10, other), *NewTXOutput(990, address))
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	block2 := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), tx})
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+
+	calls := 0
+	height, err := bc.VerifyChain(func(done, total int) {
+		calls++
+		assert.Equal(t, calls, done, "Blocks are verified one by one")
+		assert.Equal(t, 4, total, "All blocks are verified")
+	})
+	assert.Nil(t, err, "Chain is valid")
+	assert.Equal(t, 3, height, "Chain is verified up to the tip")
+	assert.Equal(t, 4, calls, "Progress is reported for every block")
+
+	calls = 0
+	assert.Nil(t, bc.ReindexWithProgress(func(done, total int) { calls++ }), "Chain is reindexed")
+	assert.Equal(t, 4, calls, "Progress is reported for every block")
+
+	// block body changed on disk
+	tampered := *block2
+	tampered.Transactions = []*Transaction{tampered.Transactions[0], {tx.Timestamp, tx.ID, tx.Vin, []TXOutput{*NewTXOutput(1000, other)}, 0}}
+	bc.store.Update(func(b storage.ChainBatch) error {
+		return b.PutBlock(block2.Hash, tampered.Serialize())
+	})
+	height, err = bc.VerifyChain(nil)
+	assert.NotNil(t, err, "Corrupt block is found")
+	assert.Equal(t, 2, height, "Height of the corrupt block is reported")
+
+	// UTXO set doesn't match blocks
+	bc.store.Update(func(b storage.ChainBatch) error {
+		b.PutBlock(block2.Hash, block2.Serialize())
+		return b.DeleteUTXO(outpointKey(tx.ID, 0))
+	})
+	height, err = bc.VerifyChain(nil)
+	assert.NotNil(t, err, "Corrupt UTXO set is found")
+	assert.Equal(t, 3, height, "Tip height is reported")
+}
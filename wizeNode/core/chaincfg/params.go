@@ -0,0 +1,146 @@
+// Package chaincfg defines parameters of WizeBlock networks
+package chaincfg
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Params defines a WizeBlock network. Nodes of different networks
+// can't talk to each other because of different magic bytes
+type Params struct {
+	// Name of the network, used by --network flag
+	Name string
+
+	// Magic bytes starting every message frame
+	Magic uint32
+
+	// Version byte of wallet addresses
+	AddressVersion byte
+
+	// Default node and REST API ports
+	DefaultPort    int
+	DefaultAPIPort int
+
+	// Proof-of-work difficulty in bits
+	TargetBits int
+
+	// Genesis block parameters
+	GenesisCoinbaseData string
+	GenesisTimestamp    int64
+	GenesisEmission     int
+
+	// Blocks a coinbase output waits before it can be spent, the genesis emission is spendable at once
+	CoinbaseMaturity int
+
+	// Directory of node data files
+	DataDir string
+
+	// Blocks can be mined on demand with REST API and node time can be mocked
+	MineOnDemand bool
+}
+
+// MainNetParams defines the main network
+var MainNetParams = Params{
+	Name:           "mainnet",
+	Magic:          0x57495a45,
+	AddressVersion: 0x00,
+	DefaultPort:    3000,
+	DefaultAPIPort: 4000,
+	TargetBits:     16,
+
+	GenesisCoinbaseData: "The Times 22/Jan/2017 Now I have nice gopher",
+	GenesisTimestamp:    1514764800,
+	GenesisEmission:     1000000,
+
+	CoinbaseMaturity: 100,
+
+	DataDir: "files/",
+}
+
+// TestNetParams defines the test network
+var TestNetParams = Params{
+	Name:           "testnet",
+	Magic:          0x0b57495a,
+	AddressVersion: 0x6f,
+	DefaultPort:    13000,
+	DefaultAPIPort: 14000,
+	TargetBits:     12,
+
+	GenesisCoinbaseData: "WizeBlock test network genesis",
+	GenesisTimestamp:    1514764800,
+	GenesisEmission:     1000000,
+
+	CoinbaseMaturity: 100,
+
+	DataDir: "files/testnet/",
+}
+
+// RegTestParams defines the regression test network. Mining is instant,
+// so integration tests can generate blocks when they need
+var RegTestParams = Params{
+	Name:           "regtest",
+	Magic:          0x5245475a,
+	AddressVersion: 0x6f,
+	DefaultPort:    23000,
+	DefaultAPIPort: 24000,
+	TargetBits:     1,
+
+	GenesisCoinbaseData: "WizeBlock regression test genesis",
+	GenesisTimestamp:    1514764800,
+	GenesisEmission:     1000000,
+
+	// coinbase outputs are spendable in the next block, tests set maturity they need
+	CoinbaseMaturity: 0,
+
+	DataDir: "files/regtest/",
+
+	MineOnDemand: true,
+}
+
+// Active is the network selected for the node, main network by default
+var Active = &MainNetParams
+
+var networks = []*Params{&MainNetParams, &TestNetParams, &RegTestParams}
+
+// SelectNetwork makes the network with given name active
+func SelectNetwork(name string) error {
+	params, err := GetParams(name)
+	if err != nil {
+		return err
+	}
+
+	Active = params
+	return nil
+}
+
+// GetParams returns parameters of the network with given name
+func GetParams(name string) (*Params, error) {
+	for _, params := range networks {
+		if params.Name == strings.ToLower(name) {
+			return params, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown network %s", name)
+}
+
+/*
+* SetDataDir moves data of all networks to the base dir: main network data
+* is kept in the dir itself, other networks use sub dirs named after them
+ */
+func SetDataDir(dir string) {
+	for _, params := range networks {
+		if params == &MainNetParams {
+			params.DataDir = filepath.Clean(dir) + "/"
+		} else {
+			params.DataDir = filepath.Join(dir, params.Name) + "/"
+		}
+	}
+}
+
+// DataPath returns path of a data file of the active network
+func DataPath(format string, a ...interface{}) string {
+	return Active.DataDir + fmt.Sprintf(format, a...)
+}
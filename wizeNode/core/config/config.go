@@ -0,0 +1,98 @@
+// Package config loads configuration of a node from a TOML file
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultFile is the configuration file read from the working dir when no other is given
+const DefaultFile = "config.toml"
+
+/*
+* Config of a node. Values of the file are defaults: env. vars and command
+* line flags override them. Empty values keep defaults of the node
+ */
+type Config struct {
+	// Network to use: mainnet, testnet or regtest
+	Network string `toml:"network"`
+	// Base dir of node data, data of networks other than mainnet is kept in their sub dirs
+	DataDir string `toml:"datadir"`
+
+	Node NodeConfig `toml:"node"`
+	API  APIConfig  `toml:"api"`
+	Log  LogConfig  `toml:"log"`
+}
+
+// NodeConfig describes the node in the network
+type NodeConfig struct {
+	// Host and port (node ID) advertised to other nodes
+	Host string `toml:"host"`
+	Port int    `toml:"port"`
+	// Addresses (host:port) the node listens on and is reached by from other networks
+	Bind     string `toml:"bind"`
+	External string `toml:"external"`
+	// Wallet address receiving rewards of mined blocks, mining is off if it is empty
+	Miner string `toml:"miner"`
+	// Nodes (host:port) to connect to besides initial nodes, full nodes a light node syncs with
+	Seeds []string `toml:"seeds"`
+}
+
+// APIConfig describes REST API service
+type APIConfig struct {
+	// Address (host:port) of REST API
+	Listen string `toml:"listen"`
+	// Dir of generated API documentation
+	DocDir string `toml:"docdir"`
+}
+
+// LogConfig describes logging
+type LogConfig struct {
+	// Lowest level of logged messages: debug, info, warn or fatal
+	Level string `toml:"level"`
+	// File messages are appended to instead of stdout and stderr
+	File string `toml:"file"`
+}
+
+/*
+* Load reads configuration from the TOML file. A missing default file gives
+* an empty configuration, any other file should exist. Unknown keys are
+* errors, so typos don't leave settings silently ignored
+ */
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		path = DefaultFile
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && path == DefaultFile {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Config %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// Decodes the TOML document to the config, keys without a field are rejected
+func (cfg *Config) parse(data string) error {
+	meta, err := toml.Decode(data, cfg)
+	if err != nil {
+		return err
+	}
+
+	undecoded := meta.Undecoded()
+	if len(undecoded) > 0 {
+		return fmt.Errorf("Unknown key %s", undecoded[0])
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if !assert.Nil(t, err, "Temp dir is created") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "node.toml")
+	data := `# sample
+network = "testnet"
+datadir = '/var/lib/wize' # literal string
+
+[node]
+host = "node.example.com"
+port = 13_001
+seeds = [
+    "seed1:13000", # first
+    "seed2:13000",
+]
+
+[log]
+level = "warn"
+file = "C:\\logs\\node \"1\".log"
+`
+	ioutil.WriteFile(path, []byte(data), 0644)
+
+	cfg, err := Load(path)
+	if !assert.Nil(t, err, "Config is loaded") {
+		return
+	}
+	assert.Equal(t, "testnet", cfg.Network)
+	assert.Equal(t, "/var/lib/wize", cfg.DataDir)
+	assert.Equal(t, NodeConfig{Host: "node.example.com", Port: 13001, Seeds: []string{"seed1:13000", "seed2:13000"}}, cfg.Node)
+	assert.Equal(t, APIConfig{}, cfg.API, "Missing table keeps defaults")
+	assert.Equal(t, LogConfig{"warn", `C:\logs\node "1".log`}, cfg.Log)
+
+	_, err = Load(filepath.Join(dir, "missing.toml"))
+	assert.NotNil(t, err, "Given file should exist")
+
+	wrong := map[string]string{
+		"unknown key":  "[node]\nhots = \"localhost\"",
+		"wrong type":   "[node]\nport = \"3000\"",
+		"not a table":  "node = 1",
+		"twice":        "network = \"a\"\nnetwork = \"b\"",
+		"not closed":   "[node]\nseeds = [\"a:1\",",
+		"bad value":    "network = mainnet",
+		"array items":  "[node]\nseeds = [1, 2]",
+		"extra tokens": "network = \"a\" \"b\"",
+	}
+	for name, data := range wrong {
+		ioutil.WriteFile(path, []byte(data), 0644)
+		_, err = Load(path)
+		assert.NotNil(t, err, "Config with %s is rejected", name)
+	}
+}
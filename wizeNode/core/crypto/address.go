@@ -8,11 +8,17 @@ import (
 	"log"
 
 	"golang.org/x/crypto/ripemd160"
+
+	"wizeBlock/wizeNode/core/chaincfg"
 )
 
-const Version = byte(0x00)
 const addressChecksumLen = 4
 
+// AddressVersion returns version byte of addresses of the active network
+func AddressVersion() byte {
+	return chaincfg.Active.AddressVersion
+}
+
 // NewKeyPair
 func NewKeyPair() (*PrivateKey, []byte) {
 	// TODO: should we realize curve?
@@ -22,7 +28,7 @@ func NewKeyPair() (*PrivateKey, []byte) {
 		fmt.Printf("Cant generate keys: %s", err)
 		return nil, nil
 	}
-	pubKey := append(privKey.PublicKey.X.Bytes(), privKey.PublicKey.Y.Bytes()...)
+	pubKey := SerializePublicKey(&privKey.PublicKey)
 
 	return privKey, pubKey
 }
@@ -34,7 +40,7 @@ func GetAddress(pubKey []byte) []byte {
 }
 
 func GetAddressFromPubKeyHash(pubKeyHash []byte) []byte {
-	versionedPayload := append([]byte{Version}, pubKeyHash...)
+	versionedPayload := append([]byte{AddressVersion()}, pubKeyHash...)
 	checksum := Checksum(versionedPayload)
 
 	fullPayload := append(versionedPayload, checksum...)
@@ -54,9 +60,12 @@ func HashPubKey(pubKey []byte) []byte {
 	return publicRIPEMD160
 }
 
-// ValidateAddress check if address if valid
+// ValidateAddress check if address if valid and belongs to the active network
 func ValidateAddress(address string) bool {
 	fullPayload := Base58Decode([]byte(address))
+	if len(fullPayload) != 1+20+addressChecksumLen || fullPayload[0] != AddressVersion() {
+		return false
+	}
 	actualChecksum := fullPayload[len(fullPayload)-addressChecksumLen:]
 
 	version := fullPayload[0]
@@ -48,16 +48,14 @@ func Base58Decode(input []byte) []byte {
 	decoded := result.Bytes()
 
 	// Fix decoded slice to 20 + (addressChecksumLen) bytes
-	for {
-		if len(decoded) == (20 + addressChecksumLen) {
-			break
-		}
+	// (non-zero version byte is kept by big.Int, so the slice is longer)
+	for len(decoded) < (20 + addressChecksumLen) {
 		decoded = append([]byte{0x00}, decoded...)
 	}
 
 	// Fix address version processing in Base58 encoding/decoding
-	if input[0] == b58Alphabet[0] {
-		decoded = append([]byte{Version}, decoded...)
+	if len(input) > 0 && input[0] == b58Alphabet[0] {
+		decoded = append([]byte{0x00}, decoded...)
 	}
 
 	return decoded
@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/chaincfg"
 )
 
 func TestBase58(t *testing.T) {
@@ -13,7 +15,7 @@ func TestBase58(t *testing.T) {
 		pubKeyHash := HashPubKey(public)
 		//t.Logf("pubKeyHash: %x", pubKeyHash)
 
-		versionedPayload := append([]byte{Version}, pubKeyHash...)
+		versionedPayload := append([]byte{AddressVersion()}, pubKeyHash...)
 		checksum := Checksum(versionedPayload)
 
 		fullPayload := append(versionedPayload, checksum...)
@@ -41,3 +43,15 @@ func TestBase58IfPubKeyHashStartsWith00(t *testing.T) {
 		"Address: %s is invalid", address,
 	)
 }
+
+func TestAddressOfOtherNetwork(t *testing.T) {
+	defer chaincfg.SelectNetwork(chaincfg.MainNetParams.Name)
+
+	chaincfg.SelectNetwork(chaincfg.TestNetParams.Name)
+	_, public := NewKeyPair()
+	address := GetAddress(public)
+	assert.True(t, ValidateAddress(string(address)), "Address: %s is invalid", address)
+
+	chaincfg.SelectNetwork(chaincfg.MainNetParams.Name)
+	assert.False(t, ValidateAddress(string(address)), "Address of testnet is valid on mainnet")
+}
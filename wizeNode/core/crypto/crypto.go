@@ -4,6 +4,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"io"
 	"math/big"
 
@@ -144,11 +145,10 @@ func Sign(rand io.Reader, priv *PrivateKey, hash []byte) (r, s *big.Int, err err
 
 	publicKey := make([]byte, 1)
 	publicKey[0] = 0x04
-	publicKey = append(publicKey, priv.PublicKey.X.Bytes()...)
-	publicKey = append(publicKey, priv.PublicKey.Y.Bytes()...)
+	publicKey = append(publicKey, SerializePublicKey(&priv.PublicKey)...)
 	//log.Printf("Public Key: %s\n", hex.EncodeToString(publicKey))
 
-	privateKey := priv.D.Bytes()
+	privateKey := paddedBytes(priv.D, 32)
 	_, ecdsaSignature, err := secp256k1.EcdsaSign(ctx, hash, privateKey)
 	if err != nil {
 		return nil, nil, err
@@ -192,7 +192,7 @@ func Verify(pub *PublicKey, hash []byte, r, s *big.Int) bool {
 	}
 	//log.Printf("%+v\n", ctx)
 
-	signature := append(r.Bytes(), s.Bytes()...)
+	signature := SerializeSignature(r, s)
 	log.Info.Printf("Signature Compact: %s\n", hex.EncodeToString(signature[:]))
 	_, ecdsaSignature, err := secp256k1.EcdsaSignatureParseCompact(ctx, signature)
 	if err != nil {
@@ -202,8 +202,7 @@ func Verify(pub *PublicKey, hash []byte, r, s *big.Int) bool {
 
 	publicKey := make([]byte, 1)
 	publicKey[0] = 0x04
-	publicKey = append(publicKey, pub.X.Bytes()...)
-	publicKey = append(publicKey, pub.Y.Bytes()...)
+	publicKey = append(publicKey, SerializePublicKey(pub)...)
 	log.Info.Printf("Public Key: %s\n", hex.EncodeToString(publicKey))
 	_, publicKeyStruct, err := secp256k1.EcPubkeyParse(ctx, publicKey)
 	if err != nil {
@@ -222,3 +221,66 @@ func Verify(pub *PublicKey, hash []byte, r, s *big.Int) bool {
 
 	return ret == 1
 }
+
+// ECDH computes a shared secret from own private key and a public key
+// of other side serialized with SerializePublicKey
+func ECDH(priv *PrivateKey, publicKey []byte) ([]byte, error) {
+	if len(publicKey) != 64 {
+		return nil, errors.New("Wrong public key length")
+	}
+
+	// context
+	params := uint(secp256k1.ContextSign | secp256k1.ContextVerify)
+	ctx, err := secp256k1.ContextCreate(params)
+	if err != nil {
+		return nil, err
+	}
+	defer secp256k1.ContextDestroy(ctx)
+
+	_, publicKeyStruct, err := secp256k1.EcPubkeyParse(ctx, append([]byte{0x04}, publicKey...))
+	if err != nil {
+		return nil, err
+	}
+
+	_, secret, err := secp256k1.Ecdh(ctx, publicKeyStruct, paddedBytes(priv.D, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// SerializePublicKey returns X and Y coordinates of a public key, 32 bytes each
+func SerializePublicKey(pub *PublicKey) []byte {
+	return append(paddedBytes(pub.X, 32), paddedBytes(pub.Y, 32)...)
+}
+
+// SerializeSignature returns R and S of a signature, 32 bytes each
+func SerializeSignature(r, s *big.Int) []byte {
+	return append(paddedBytes(r, 32), paddedBytes(s, 32)...)
+}
+
+// ParsePublicKey restores a public key serialized with SerializePublicKey
+func ParsePublicKey(publicKey []byte) (*PublicKey, error) {
+	if len(publicKey) != 64 {
+		return nil, errors.New("Wrong public key length")
+	}
+
+	pub := new(PublicKey)
+	pub.X = new(big.Int).SetBytes(publicKey[:32])
+	pub.Y = new(big.Int).SetBytes(publicKey[32:])
+
+	return pub, nil
+}
+
+// paddedBytes returns big-endian bytes of a number left-padded with zeros
+func paddedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
@@ -1,8 +1,10 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"math/big"
 	"testing"
 )
 
@@ -64,3 +66,25 @@ func TestSignAndVerify(t *testing.T) {
 		t.Errorf("Verify Failed")
 	}
 }
+
+func TestSerializedKeysAndSignaturesArePadded(t *testing.T) {
+	signature := SerializeSignature(big.NewInt(1), big.NewInt(2))
+	if len(signature) != 64 || signature[31] != 1 || signature[63] != 2 {
+		t.Errorf("Signature is not padded: %x", signature)
+	}
+
+	// about one of 128 keys has a short coordinate, so enough keys are checked
+	for i := 0; i < 256; i++ {
+		private, public := NewKeyPair()
+		if len(public) != 64 {
+			t.Fatalf("Public key length is %d", len(public))
+		}
+		parsed, err := ParsePublicKey(public)
+		if err != nil || parsed.X.Cmp(private.PublicKey.X) != 0 || parsed.Y.Cmp(private.PublicKey.Y) != 0 {
+			t.Fatalf("Public key %x is not restored", public)
+		}
+		if !bytes.Equal(public, SerializePublicKey(&private.PublicKey)) {
+			t.Fatalf("Public key %x is not serialized", public)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// Parameters of Golomb-coded set filters, the same as BIP158 basic filters
+const (
+	GCSFilterP = 19
+	GCSFilterM = 784931
+)
+
+// Length of a filter key
+const GCSKeySize = 16
+
+/*
+* Builds Golomb-coded set filter of the elements. Elements are hashed with
+* SipHash to a range of N*M values, sorted, and differences are Golomb-Rice
+* coded. The filter starts with count of elements as varint
+ */
+func BuildGCSFilter(key [GCSKeySize]byte, elements [][]byte) []byte {
+	elements = uniqueElements(elements)
+	values := hashedSet(key, elements, uint64(len(elements)))
+
+	header := make([]byte, binary.MaxVarintLen64)
+	filter := header[:binary.PutUvarint(header, uint64(len(values)))]
+
+	w := &bitWriter{}
+	var last uint64
+	for _, value := range values {
+		delta := value - last
+		last = value
+
+		for q := delta >> GCSFilterP; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, GCSFilterP)
+	}
+
+	return append(filter, w.bytes...)
+}
+
+// Returns true if any of the queries is probably in the filter
+func MatchGCSFilter(filter []byte, key [GCSKeySize]byte, queries [][]byte) (bool, error) {
+	count, n := binary.Uvarint(filter)
+	if n <= 0 {
+		return false, errors.New("Wrong filter header")
+	}
+	// every element takes at least P+1 bits
+	if count > uint64(len(filter)-n)*8/(GCSFilterP+1) {
+		return false, errors.New("Wrong count of filter elements")
+	}
+	if count == 0 || len(queries) == 0 {
+		return false, nil
+	}
+
+	targets := hashedSet(key, queries, count)
+	r := &bitReader{data: filter[n:]}
+
+	var value uint64
+	t := 0
+	for i := uint64(0); i < count; i++ {
+		delta, err := r.readGolomb()
+		if err != nil {
+			return false, err
+		}
+		value += delta
+
+		for t < len(targets) && targets[t] < value {
+			t++
+		}
+		if t == len(targets) {
+			return false, nil
+		}
+		if targets[t] == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Returns key of block filter from the block hash
+func BlockFilterKey(blockHash []byte) [GCSKeySize]byte {
+	var key [GCSKeySize]byte
+	copy(key[:], blockHash)
+	return key
+}
+
+// Returns filter element of a spent transaction output
+func OutpointFilterElement(txID []byte, vout int) []byte {
+	element := make([]byte, len(txID)+4)
+	copy(element, txID)
+	binary.BigEndian.PutUint32(element[len(txID):], uint32(vout))
+	return element
+}
+
+// Hashes elements to range [0, count*M) and sorts them
+func hashedSet(key [GCSKeySize]byte, elements [][]byte, count uint64) []uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	limit := count * GCSFilterM
+
+	values := []uint64{}
+	for _, element := range elements {
+		hi, _ := bits.Mul64(sipHash24(k0, k1, element), limit)
+		values = append(values, hi)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	return values
+}
+
+func uniqueElements(elements [][]byte) [][]byte {
+	seen := make(map[string]bool)
+	unique := [][]byte{}
+	for _, element := range elements {
+		if !seen[string(element)] {
+			seen[string(element)] = true
+			unique = append(unique, element)
+		}
+	}
+	return unique
+}
+
+type bitWriter struct {
+	bytes []byte
+	count uint
+}
+
+func (w *bitWriter) writeBit(bit uint64) {
+	if w.count%8 == 0 {
+		w.bytes = append(w.bytes, 0)
+	}
+	if bit != 0 {
+		w.bytes[len(w.bytes)-1] |= 0x80 >> (w.count % 8)
+	}
+	w.count++
+}
+
+func (w *bitWriter) writeBits(value uint64, count uint) {
+	for i := count; i > 0; i-- {
+		w.writeBit((value >> (i - 1)) & 1)
+	}
+}
+
+type bitReader struct {
+	data  []byte
+	index uint
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	if r.index/8 >= uint(len(r.data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	bit := (r.data[r.index/8] >> (7 - r.index%8)) & 1
+	r.index++
+	return uint64(bit), nil
+}
+
+func (r *bitReader) readGolomb() (uint64, error) {
+	var quotient uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			break
+		}
+		quotient++
+	}
+
+	var remainder uint64
+	for i := 0; i < GCSFilterP; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		remainder = remainder<<1 | bit
+	}
+
+	return quotient<<GCSFilterP | remainder, nil
+}
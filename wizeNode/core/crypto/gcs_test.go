@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSipHash24(t *testing.T) {
+	// test vectors from the SipHash paper, key is 00 01 .. 0f
+	k0 := uint64(0x0706050403020100)
+	k1 := uint64(0x0f0e0d0c0b0a0908)
+	data := make([]byte, 15)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	assert.Equal(t, uint64(0x726fdb47dd0e0e31), sipHash24(k0, k1, nil), "Hash of empty data")
+	assert.Equal(t, uint64(0xa129ca6149be45e5), sipHash24(k0, k1, data), "Hash of 15 bytes")
+}
+
+func TestGCSFilter(t *testing.T) {
+	key := BlockFilterKey([]byte("block hash of 32 bytes length..."))
+
+	elements := [][]byte{}
+	for i := 0; i < 100; i++ {
+		elements = append(elements, []byte(fmt.Sprintf("element%d", i)))
+	}
+	// duplicates are stored once
+	filter := BuildGCSFilter(key, append(elements, elements[0]))
+	count, _ := binary.Uvarint(filter)
+	assert.Equal(t, uint64(100), count, "Count of unique elements")
+
+	for _, element := range elements {
+		match, err := MatchGCSFilter(filter, key, [][]byte{[]byte("other"), element})
+		assert.Nil(t, err, "Filter is decoded")
+		assert.True(t, match, "There are no false negatives")
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		match, _ := MatchGCSFilter(filter, key, [][]byte{[]byte(fmt.Sprintf("missing%d", i))})
+		if match {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 5, "False positives are rare")
+
+	match, err := MatchGCSFilter(filter, BlockFilterKey([]byte("other key")), elements[:1])
+	assert.Nil(t, err, "Filter is decoded with other key")
+	assert.False(t, match, "Element is hashed with the key")
+
+	match, err = MatchGCSFilter(BuildGCSFilter(key, nil), key, elements)
+	assert.Nil(t, err, "Empty filter is decoded")
+	assert.False(t, match, "Empty filter matches nothing")
+
+	_, err = MatchGCSFilter(filter[:len(filter)/2], key, [][]byte{[]byte("missing")})
+	assert.NotNil(t, err, "Truncated filter is rejected")
+	_, err = MatchGCSFilter(nil, key, elements)
+	assert.NotNil(t, err, "Filter without header is rejected")
+}
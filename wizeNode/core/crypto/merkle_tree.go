@@ -1,7 +1,9 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 )
 
 // MerkleTree represent a Merkle tree
@@ -67,3 +69,70 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 
 	return &mNode
 }
+
+// MerkleProof is a branch of the tree from a leaf to the root.
+// Hashes are siblings of the leaf path from the bottom level
+type MerkleProof struct {
+	Index  int
+	Hashes [][]byte
+}
+
+/*
+* Builds a proof that data[index] is a leaf of the tree. Levels are built
+* the same way as in NewMerkleTree, so the proof matches its root
+ */
+func NewMerkleProof(data [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(data) {
+		return nil, errors.New("Leaf index is out of range")
+	}
+
+	if len(data)%2 != 0 {
+		data = append(data, data[len(data)-1])
+	}
+
+	var nodes [][]byte
+	for _, datum := range data {
+		nodes = append(nodes, NewMerkleNode(nil, nil, datum).Data)
+	}
+
+	proof := &MerkleProof{Index: index}
+	position := index
+	for i := 0; i < len(data)/2; i++ {
+		proof.Hashes = append(proof.Hashes, nodes[position^1])
+
+		var newLevel [][]byte
+		for j := 0; j < len(nodes); j += 2 {
+			newLevel = append(newLevel, hashPair(nodes[j], nodes[j+1]))
+		}
+		if len(newLevel)%2 != 0 {
+			newLevel = append(newLevel, newLevel[len(newLevel)-1])
+		}
+
+		nodes = newLevel
+		position /= 2
+	}
+
+	return proof, nil
+}
+
+// Checks that the data is a leaf of the tree with the root
+func (p *MerkleProof) Verify(data []byte, root []byte) bool {
+	hash := NewMerkleNode(nil, nil, data).Data
+	position := p.Index
+
+	for _, sibling := range p.Hashes {
+		if position%2 == 0 {
+			hash = hashPair(hash, sibling)
+		} else {
+			hash = hashPair(sibling, hash)
+		}
+		position /= 2
+	}
+
+	return position == 0 && bytes.Equal(hash, root)
+}
+
+func hashPair(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return hash[:]
+}
@@ -147,3 +147,29 @@ func TestNewMerkleTree6(t *testing.T) {
 
 	assert.Equal(t, rootHash, fmt.Sprintf("%x", mTree.RootNode.Data), "Merkle tree root hash is correct")
 }
+
+func TestMerkleProof(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		data := [][]byte{}
+		for i := 0; i < count; i++ {
+			data = append(data, []byte(fmt.Sprintf("node%d", i)))
+		}
+		root := NewMerkleTree(data).RootNode.Data
+
+		for i := range data {
+			proof, err := NewMerkleProof(data, i)
+			assert.Nil(t, err, "Proof is built")
+			assert.True(t, proof.Verify(data[i], root), "Proof of leaf %d of %d is valid", i, count)
+			assert.False(t, proof.Verify([]byte("other"), root), "Proof of other data is not valid")
+		}
+	}
+
+	data := [][]byte{[]byte("node1"), []byte("node2"), []byte("node3")}
+	root := NewMerkleTree(data).RootNode.Data
+	proof, _ := NewMerkleProof(data, 1)
+	proof.Index = 0
+	assert.False(t, proof.Verify(data[1], root), "Proof with wrong index is not valid")
+
+	_, err := NewMerkleProof(data, 3)
+	assert.NotNil(t, err, "Index out of range")
+}
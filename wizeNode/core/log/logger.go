@@ -4,15 +4,16 @@ package log
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/syslog"
 	"os"
+	"strings"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 // WARN: do not log in Go routines!
-// TODO: add output to file
 // TODO: add Trace level
 // TODO: add output to syslog
 // TODO: add output to network service
@@ -133,6 +134,43 @@ func init() {
 	}
 }
 
+/*
+* SetLevel enables messages of the level and higher ones: debug, info,
+* warn or fatal. Fatal messages are always logged
+ */
+func SetLevel(level string) error {
+	levels := []*toggledLogger{Debug, Info, Warn}
+	names := []string{"debug", "info", "warn"}
+
+	index := len(names)
+	for i, name := range names {
+		if strings.ToLower(level) == name {
+			index = i
+		}
+	}
+	if index == len(names) && strings.ToLower(level) != "fatal" {
+		return fmt.Errorf("Unknown log level %s", level)
+	}
+
+	for i, l := range levels {
+		l.Enabled = i >= index
+	}
+	return nil
+}
+
+// SetOutput redirects all loggers to the writer, colors are turned off
+func SetOutput(w io.Writer) {
+	ColorReset, ColorBlack, ColorGrey, ColorRed, ColorGreen, ColorYellow = "", "", "", "", "", ""
+	Debug.prefix = "DEBUG "
+	Info.prefix = "INFO  "
+	Warn.prefix = "WARN  "
+	Fatal.prefix = "FATAL "
+	for _, l := range []*toggledLogger{Debug, Info, Warn, Fatal} {
+		l.SetOutput(w)
+		l.postfix = ""
+	}
+}
+
 // SwitchToSyslog redirects the output of this logger to syslog.
 func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
 	w, err := syslog.New(p, ProgramName)
@@ -0,0 +1,419 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Services which can be provided by a node
+const (
+	// full node, can serve all blocks
+	ServiceNodeNetwork uint64 = 1 << iota
+	// node understands compact blocks
+	ServiceCompactBlocks
+	// node serves merkle blocks to light clients
+	ServiceMerkleBlocks
+	// node serves compact filters of blocks to light clients
+	ServiceCompactFilters
+	// pruned node, can serve only the last blocks
+	ServiceNodeNetworkLimited
+)
+
+// Services of a full node
+const DefaultServices = ServiceNodeNetwork | ServiceCompactBlocks | ServiceMerkleBlocks | ServiceCompactFilters
+
+// Services of a pruned node
+const PrunedServices = DefaultServices&^ServiceNodeNetwork | ServiceNodeNetworkLimited
+
+const (
+	newBucketCount = 64
+	newBucketSize  = 64
+	// count of new buckets addresses from one source group can fall into
+	newBucketsPerSource = 8
+	triedBucketCount    = 16
+	triedBucketSize     = 64
+
+	// addresses which were not seen during this time are removed
+	AddrMaxAge = 3 * 24 * time.Hour
+	// max count of addresses in one addr message
+	MaxAddrPerMessage = 1000
+	// percent of known addresses sent in reply to getaddr
+	getAddrPercent = 23
+	// max count of failed connection attempts for a new address
+	maxAddrAttempts = 3
+	// gossiped addresses are considered seen this time earlier than other node tells
+	addrTimePenalty = 2 * time.Hour
+)
+
+// NetAddress is a node address with services and time when it was seen last time
+type NetAddress struct {
+	Addr      NodeAddr
+	Services  uint64
+	Timestamp int64
+}
+
+// KnownAddress is an entry of address book
+type KnownAddress struct {
+	NetAddress
+	Attempts    int
+	LastAttempt int64
+	LastSuccess int64
+	Tried       bool
+}
+
+// AddrBook keeps addresses of other nodes. New addresses learned from
+// other nodes and tried addresses we have connected to are stored apart
+// in fixed count of buckets, so the book can't grow unlimited
+type AddrBook struct {
+	mutex sync.Mutex
+
+	key          []byte
+	index        map[string]*KnownAddress
+	newBuckets   [newBucketCount]map[string]*KnownAddress
+	triedBuckets [triedBucketCount]map[string]*KnownAddress
+	// addresses were changed since the book was saved
+	changed bool
+}
+
+// Creates an empty address book
+func NewAddrBook() *AddrBook {
+	book := &AddrBook{
+		key:   make([]byte, 32),
+		index: make(map[string]*KnownAddress),
+	}
+	rand.Read(book.key)
+
+	for i := range book.newBuckets {
+		book.newBuckets[i] = make(map[string]*KnownAddress)
+	}
+	for i := range book.triedBuckets {
+		book.triedBuckets[i] = make(map[string]*KnownAddress)
+	}
+
+	return book
+}
+
+// Returns count of addresses in the book
+func (b *AddrBook) Size() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.index)
+}
+
+// Returns copy of all addresses in the book. Used to save the book
+func (b *AddrBook) All() []KnownAddress {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	list := make([]KnownAddress, 0, len(b.index))
+	for _, ka := range b.index {
+		list = append(list, *ka)
+	}
+	return list
+}
+
+// Restores addresses saved with All
+func (b *AddrBook) Load(list []KnownAddress) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, item := range list {
+		ka := item
+		key := ka.Addr.String()
+		if _, ok := b.index[key]; ok {
+			continue
+		}
+		if ka.Tried {
+			b.addTried(&ka)
+		} else {
+			b.addNew(&ka, ka.Addr)
+		}
+	}
+	// loaded addresses are saved already
+	b.changed = false
+	b.expire(time.Now())
+}
+
+// Returns true if the book was changed since the last call, so it should be saved
+func (b *AddrBook) TakeChanged() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	changed := b.changed
+	b.changed = false
+	return changed
+}
+
+/*
+* Adds an address received from other node to the new table.
+* Returns true if the address was not known before
+ */
+func (b *AddrBook) AddAddress(addr NetAddress, source NodeAddr) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.addAddress(addr, source, time.Now(), 0)
+}
+
+/*
+* Adds list of addresses received from other node, source is the address
+* of the connection. Other node can't prove when it saw the addresses, so
+* their time is penalized unless the node tells about itself. Returns
+* added addresses
+ */
+func (b *AddrBook) AddAddresses(list []NetAddress, source NodeAddr) []NetAddress {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.expire(now)
+
+	added := []NetAddress{}
+	for _, addr := range list {
+		penalty := addrTimePenalty
+		if addr.Addr.Host == source.Host {
+			penalty = 0
+		}
+		if b.addAddress(addr, source, now, penalty) {
+			added = append(added, addr)
+		}
+	}
+	return added
+}
+
+// Marks an address as tried after successful connection
+func (b *AddrBook) MarkGood(addr NodeAddr, services uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	key := addr.String()
+	ka, ok := b.index[key]
+	if !ok {
+		ka = &KnownAddress{NetAddress: NetAddress{Addr: addr}}
+	}
+	// services from the handshake are the actual ones, e.g. the node may be pruned now
+	ka.Services = services
+	ka.Timestamp = now.Unix()
+	ka.LastSuccess = now.Unix()
+	ka.LastAttempt = now.Unix()
+	ka.Attempts = 0
+	b.changed = true
+
+	if ka.Tried {
+		return
+	}
+	if ok {
+		b.removeNew(ka)
+	}
+	b.addTried(ka)
+}
+
+// Returns services of a node, zero if the address is unknown
+func (b *AddrBook) Services(addr NodeAddr) uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if ka, ok := b.index[addr.String()]; ok {
+		return ka.Services
+	}
+	return 0
+}
+
+// Remembers failed connection attempt. New addresses are removed after few attempts
+func (b *AddrBook) MarkAttempt(addr NodeAddr) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ka, ok := b.index[addr.String()]
+	if !ok {
+		return
+	}
+	ka.Attempts++
+	ka.LastAttempt = time.Now().Unix()
+	b.changed = true
+
+	if !ka.Tried && ka.Attempts >= maxAddrAttempts {
+		b.removeNew(ka)
+		delete(b.index, addr.String())
+	}
+}
+
+/*
+* Returns random subset of fresh addresses to send them to other node.
+* Count of addresses is limited by percent of the book and max
+ */
+func (b *AddrBook) GetAddresses(max int) []NetAddress {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.expire(time.Now())
+
+	list := make([]NetAddress, 0, len(b.index))
+	for _, ka := range b.index {
+		list = append(list, ka.NetAddress)
+	}
+
+	count := len(list) * getAddrPercent / 100
+	if count < 1 {
+		count = len(list)
+	}
+	if count > max {
+		count = max
+	}
+
+	mrand.Shuffle(len(list), func(i, j int) {
+		list[i], list[j] = list[j], list[i]
+	})
+
+	return list[:count]
+}
+
+// Removes addresses which were not seen for a long time
+func (b *AddrBook) Expire() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.expire(time.Now())
+}
+
+func (b *AddrBook) addAddress(addr NetAddress, source NodeAddr, now time.Time, penalty time.Duration) bool {
+	if addr.Addr.Host == "" || addr.Addr.Port <= 0 {
+		return false
+	}
+	// addresses from the future are considered as seen now
+	if addr.Timestamp > now.Unix() || addr.Timestamp == 0 {
+		addr.Timestamp = now.Unix()
+	}
+	addr.Timestamp -= int64(penalty / time.Second)
+	if isStale(addr.Timestamp, now) {
+		return false
+	}
+
+	if ka, ok := b.index[addr.Addr.String()]; ok {
+		if addr.Timestamp > ka.Timestamp {
+			ka.Timestamp = addr.Timestamp
+			b.changed = true
+		}
+		if ka.Services|addr.Services != ka.Services {
+			ka.Services |= addr.Services
+			b.changed = true
+		}
+		return false
+	}
+
+	b.addNew(&KnownAddress{NetAddress: addr}, source)
+	return true
+}
+
+func (b *AddrBook) addNew(ka *KnownAddress, source NodeAddr) {
+	ka.Tried = false
+	bucket := b.newBuckets[b.newBucketIndex(ka.Addr, source)]
+
+	if len(bucket) >= newBucketSize {
+		b.evict(bucket)
+	}
+	bucket[ka.Addr.String()] = ka
+	b.index[ka.Addr.String()] = ka
+	b.changed = true
+}
+
+func (b *AddrBook) addTried(ka *KnownAddress) {
+	ka.Tried = true
+	bucket := b.triedBuckets[b.bucketIndex(triedBucketCount, ka.Addr.String())]
+
+	if len(bucket) >= triedBucketSize {
+		// the oldest tried address goes back to new table
+		oldest := oldestAddress(bucket)
+		delete(bucket, oldest.Addr.String())
+		b.addNew(oldest, oldest.Addr)
+	}
+	bucket[ka.Addr.String()] = ka
+	b.index[ka.Addr.String()] = ka
+	b.changed = true
+}
+
+func (b *AddrBook) removeNew(ka *KnownAddress) {
+	for _, bucket := range b.newBuckets {
+		delete(bucket, ka.Addr.String())
+	}
+}
+
+// Removes the oldest address from a full bucket
+func (b *AddrBook) evict(bucket map[string]*KnownAddress) {
+	oldest := oldestAddress(bucket)
+	delete(bucket, oldest.Addr.String())
+	delete(b.index, oldest.Addr.String())
+}
+
+func (b *AddrBook) expire(now time.Time) {
+	for _, bucket := range b.newBuckets {
+		for key, ka := range bucket {
+			if isStale(ka.Timestamp, now) {
+				delete(bucket, key)
+				delete(b.index, key)
+				b.changed = true
+			}
+		}
+	}
+	for _, bucket := range b.triedBuckets {
+		for key, ka := range bucket {
+			if isStale(ka.Timestamp, now) {
+				delete(bucket, key)
+				delete(b.index, key)
+				b.changed = true
+			}
+		}
+	}
+}
+
+// New bucket depends on groups of address and source, so one source can fill
+// only few buckets
+func (b *AddrBook) newBucketIndex(addr, source NodeAddr) int {
+	sourceBucket := b.bucketIndex(newBucketsPerSource, addrGroup(addr), addrGroup(source))
+	return b.bucketIndex(newBucketCount, addrGroup(source), strconv.Itoa(sourceBucket))
+}
+
+// Chooses a bucket by keyed hash of data, so other nodes can't predict it
+func (b *AddrBook) bucketIndex(count int, data ...string) int {
+	h := sha256.New()
+	h.Write(b.key)
+	for _, item := range data {
+		h.Write([]byte(item))
+	}
+	return int(binary.BigEndian.Uint32(h.Sum(nil)[:4]) % uint32(count))
+}
+
+func oldestAddress(bucket map[string]*KnownAddress) *KnownAddress {
+	var oldest *KnownAddress
+	for _, ka := range bucket {
+		if oldest == nil || ka.Timestamp < oldest.Timestamp {
+			oldest = ka
+		}
+	}
+	return oldest
+}
+
+func isStale(timestamp int64, now time.Time) bool {
+	return now.Sub(time.Unix(timestamp, 0)) > AddrMaxAge
+}
+
+// Returns network group of an address. Addresses from one source group
+// fall into limited count of new buckets
+func addrGroup(addr NodeAddr) string {
+	ip := net.ParseIP(addr.Host)
+	if ip == nil {
+		return addr.Host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
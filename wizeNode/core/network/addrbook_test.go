@@ -0,0 +1,135 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAddresses(count int, timestamp int64) []NetAddress {
+	list := []NetAddress{}
+	for i := 0; i < count; i++ {
+		addr := NodeAddr{fmt.Sprintf("10.%d.%d.%d", i/65536%256, i/256%256, i%256), 3000}
+		list = append(list, NetAddress{addr, ServiceNodeNetwork, timestamp})
+	}
+	return list
+}
+
+func TestAddrBookBounded(t *testing.T) {
+	book := NewAddrBook()
+	source := NodeAddr{"192.168.1.1", 3000}
+
+	added := book.AddAddresses(testAddresses(MaxAddrPerMessage, time.Now().Unix()), source)
+	assert.Equal(t, MaxAddrPerMessage, len(added), "All addresses are new")
+
+	// addresses of one group from one source fall into one new bucket
+	assert.Equal(t, newBucketSize, book.Size(), "Book size is limited")
+}
+
+func TestAddrBookExpire(t *testing.T) {
+	book := NewAddrBook()
+	source := NodeAddr{"192.168.1.1", 3000}
+	old := time.Now().Add(-AddrMaxAge - time.Hour).Unix()
+
+	added := book.AddAddresses(testAddresses(10, old), source)
+	assert.Equal(t, 0, len(added), "Stale addresses are ignored")
+
+	book.AddAddress(NetAddress{NodeAddr{"10.0.0.1", 3000}, 0, time.Now().Unix()}, source)
+	book.index["10.0.0.1:3000"].Timestamp = old
+	book.Expire()
+	assert.Equal(t, 0, book.Size(), "Stale address is removed")
+}
+
+func TestAddrBookPenalizesGossipedTime(t *testing.T) {
+	book := NewAddrBook()
+	source := NodeAddr{"192.168.1.1", 0}
+	now := time.Now().Unix()
+	penalty := int64(addrTimePenalty / time.Second)
+
+	list := []NetAddress{
+		{NodeAddr{"10.0.0.1", 3000}, 0, now},
+		{NodeAddr{"10.0.0.2", 3000}, 0, now + 3600},
+		{NodeAddr{"192.168.1.1", 3000}, 0, now},
+	}
+	book.AddAddresses(list, source)
+
+	assert.True(t, book.index["10.0.0.1:3000"].Timestamp <= now-penalty, "Gossiped time is penalized")
+	assert.True(t, book.index["10.0.0.2:3000"].Timestamp <= now-penalty, "Future time is clamped and penalized")
+	assert.True(t, book.index["192.168.1.1:3000"].Timestamp >= now, "Own address of the source is not penalized")
+}
+
+func TestAddrBookTried(t *testing.T) {
+	book := NewAddrBook()
+	addr := NodeAddr{"10.0.0.1", 3000}
+
+	book.AddAddress(NetAddress{addr, 0, time.Now().Unix()}, NodeAddr{"192.168.1.1", 3000})
+	book.MarkGood(addr, ServiceNodeNetwork)
+
+	list := book.All()
+	assert.Equal(t, 1, len(list), "Address is not duplicated")
+	assert.True(t, list[0].Tried, "Address is tried")
+	assert.Equal(t, ServiceNodeNetwork, list[0].Services, "Services are remembered")
+
+	for i := 0; i < maxAddrAttempts; i++ {
+		book.MarkAttempt(addr)
+	}
+	assert.Equal(t, 1, book.Size(), "Tried address is kept after failed attempts")
+}
+
+func TestAddrBookGetAddresses(t *testing.T) {
+	book := NewAddrBook()
+	now := time.Now().Unix()
+
+	for i, addr := range testAddresses(500, now) {
+		source := NodeAddr{fmt.Sprintf("172.%d.0.1", i%200), 3000}
+		book.AddAddress(addr, source)
+	}
+
+	size := book.Size()
+	addresses := book.GetAddresses(MaxAddrPerMessage)
+	assert.Equal(t, size*getAddrPercent/100, len(addresses), "Only part of the book is sent")
+
+	addresses = book.GetAddresses(10)
+	assert.Equal(t, 10, len(addresses), "Count of addresses is limited")
+}
+
+// Storage counting saves of the address book
+type countingStorage struct {
+	saves int
+}
+
+func (s *countingStorage) GetNodes() ([]NodeAddr, error)           { return nil, nil }
+func (s *countingStorage) AddNodeToKnown(addr NodeAddr)            {}
+func (s *countingStorage) RemoveNodeFromKnown(addr NodeAddr)       {}
+func (s *countingStorage) GetCountOfKnownNodes() (int, error)      { return 0, nil }
+func (s *countingStorage) GetAddresses() ([]KnownAddress, error)   { return nil, nil }
+func (s *countingStorage) SaveAddresses(list []KnownAddress) error { s.saves++; return nil }
+
+func TestAddrBookSavedWhenChanged(t *testing.T) {
+	storage := &countingStorage{}
+	n := &NodeNetwork{Storage: storage, AddrBook: NewAddrBook()}
+	addr := NetAddress{NodeAddr{"10.0.0.1", 3000}, ServiceNodeNetwork, time.Now().Unix()}
+	source := NodeAddr{"192.168.1.1", 3000}
+
+	n.SaveAddrBook()
+	assert.Equal(t, 0, storage.saves, "Empty book is not saved")
+
+	n.AddrBook.AddAddress(addr, source)
+	n.SaveAddrBook()
+	n.SaveAddrBook()
+	assert.Equal(t, 1, storage.saves, "Changed book is saved once")
+
+	n.AddrBook.AddAddress(addr, source)
+	n.SaveAddrBook()
+	assert.Equal(t, 1, storage.saves, "Known address doesn't change the book")
+
+	n.AddrBook.MarkGood(addr.Addr, ServiceNodeNetwork)
+	n.SaveAddrBook()
+	assert.Equal(t, 2, storage.saves, "Tried address is saved")
+
+	book := NewAddrBook()
+	book.Load(n.AddrBook.All())
+	assert.False(t, book.TakeChanged(), "Loaded book is not changed")
+}
@@ -0,0 +1,338 @@
+package network
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"wizeBlock/wizeNode/core/crypto"
+)
+
+// Max time for the secure handshake between two nodes
+const handshakeTimeout = 10 * time.Second
+
+// NodeIdentity is a static secp256k1 key pair of a node.
+// It is used to authenticate the node in the secure handshake
+type NodeIdentity struct {
+	PrivateKey *crypto.PrivateKey
+	PublicKey  []byte
+}
+
+// TransportSecurity configures encrypted connections between nodes.
+// If AllowedKeys is not empty only nodes with these public keys are accepted
+type TransportSecurity struct {
+	Identity    *NodeIdentity
+	AllowedKeys [][]byte
+}
+
+type handshakeInit struct {
+	EphemeralKey []byte
+}
+
+type handshakeReply struct {
+	EphemeralKey []byte
+	StaticKey    []byte
+	Signature    []byte
+}
+
+type handshakeFinish struct {
+	StaticKey []byte
+	Signature []byte
+}
+
+// Generates a new node identity
+func NewNodeIdentity() (*NodeIdentity, error) {
+	privKey, err := crypto.GenerateKey(nil, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NodeIdentity{privKey, crypto.SerializePublicKey(&privKey.PublicKey)}, nil
+}
+
+// Loads node identity from a file. A new identity is generated and saved
+// if the file doesn't exist
+func LoadNodeIdentity(file string) (*NodeIdentity, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		identity, err := NewNodeIdentity()
+		if err != nil {
+			return nil, err
+		}
+		privKey := fmt.Sprintf("%064x", identity.PrivateKey.D)
+		err = ioutil.WriteFile(file, []byte(privKey), 0600)
+		if err != nil {
+			return nil, err
+		}
+		return identity, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	privKeyBytes, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("Wrong node key file: %s", err)
+	}
+
+	privKey, err := crypto.GetPrivateKey(nil, privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NodeIdentity{privKey, crypto.SerializePublicKey(&privKey.PublicKey)}, nil
+}
+
+// Parses a list of hex encoded public keys of allowed nodes
+func ParseAllowedKeys(list []string) ([][]byte, error) {
+	keys := [][]byte{}
+
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, err := hex.DecodeString(item)
+		if err != nil || len(key) != 64 {
+			return nil, fmt.Errorf("Wrong node public key %s", item)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Check if a node with the public key can connect
+func (t *TransportSecurity) IsAllowed(key []byte) bool {
+	if len(t.AllowedKeys) == 0 {
+		return true
+	}
+
+	for _, allowed := range t.AllowedKeys {
+		if bytes.Equal(allowed, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Connects to a node. If security is set the secure handshake is done
+func DialNode(address NodeAddr, security *TransportSecurity) (*NodeConn, error) {
+	conn, err := DefaultTransport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return ConnectNode(conn, security)
+}
+
+// Starts talking to a node over established connection. If security
+// is set the secure handshake is done
+func ConnectNode(conn net.Conn, security *TransportSecurity) (*NodeConn, error) {
+	nc := NewNodeConn(conn)
+	if security != nil {
+		err := nc.handshake(security, true)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return nc, nil
+}
+
+// Accepts a connection from other node. If security is set the secure handshake is done
+func AcceptNode(conn net.Conn, security *TransportSecurity) (*NodeConn, error) {
+	nc := NewNodeConn(conn)
+	if security != nil {
+		err := nc.handshake(security, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nc, nil
+}
+
+/*
+* Makes the secure handshake. Both nodes exchange ephemeral keys and sign them
+* with static identity keys. Session keys are derived from ECDH of ephemeral keys
+ */
+func (c *NodeConn) handshake(security *TransportSecurity, initiator bool) error {
+	if security.Identity == nil {
+		return errors.New("Node identity is not set")
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	ephemeral, err := NewNodeIdentity()
+	if err != nil {
+		return err
+	}
+
+	var initKey, replyKey []byte
+	var peerKey, peerSignature []byte
+
+	if initiator {
+		err = c.writeHandshake(handshakeInit{ephemeral.PublicKey})
+		if err != nil {
+			return err
+		}
+
+		var reply handshakeReply
+		err = c.readHandshake(&reply)
+		if err != nil {
+			return err
+		}
+		initKey, replyKey = ephemeral.PublicKey, reply.EphemeralKey
+		peerKey, peerSignature = reply.StaticKey, reply.Signature
+
+		err = verifyHandshake(peerKey, peerSignature, "reply", initKey, replyKey)
+		if err != nil {
+			return err
+		}
+
+		signature, err := signHandshake(security.Identity, "finish", initKey, replyKey)
+		if err != nil {
+			return err
+		}
+		err = c.writeHandshake(handshakeFinish{security.Identity.PublicKey, signature})
+		if err != nil {
+			return err
+		}
+	} else {
+		var init handshakeInit
+		err = c.readHandshake(&init)
+		if err != nil {
+			return err
+		}
+		initKey, replyKey = init.EphemeralKey, ephemeral.PublicKey
+
+		signature, err := signHandshake(security.Identity, "reply", initKey, replyKey)
+		if err != nil {
+			return err
+		}
+		err = c.writeHandshake(handshakeReply{replyKey, security.Identity.PublicKey, signature})
+		if err != nil {
+			return err
+		}
+
+		var finish handshakeFinish
+		err = c.readHandshake(&finish)
+		if err != nil {
+			return err
+		}
+		peerKey, peerSignature = finish.StaticKey, finish.Signature
+
+		err = verifyHandshake(peerKey, peerSignature, "finish", initKey, replyKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !security.IsAllowed(peerKey) {
+		return fmt.Errorf("Node %x is not allowed", peerKey)
+	}
+
+	peerEphemeral := replyKey
+	if !initiator {
+		peerEphemeral = initKey
+	}
+	secret, err := crypto.ECDH(ephemeral.PrivateKey, peerEphemeral)
+	if err != nil {
+		return err
+	}
+
+	initCipher, err := newSessionCipher(secret, "init", initKey, replyKey)
+	if err != nil {
+		return err
+	}
+	replyCipher, err := newSessionCipher(secret, "reply", initKey, replyKey)
+	if err != nil {
+		return err
+	}
+
+	if initiator {
+		c.sendCipher, c.recvCipher = initCipher, replyCipher
+	} else {
+		c.sendCipher, c.recvCipher = replyCipher, initCipher
+	}
+	c.PeerKey = peerKey
+
+	return nil
+}
+
+func (c *NodeConn) writeHandshake(data interface{}) error {
+	payload, err := GobEncode(data)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(payload)
+}
+
+func (c *NodeConn) readHandshake(data interface{}) error {
+	payload, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(data)
+}
+
+// Hash of the handshake transcript which is signed by a node
+func handshakeHash(role string, initKey, replyKey []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{[]byte("wize-handshake-" + role), initKey, replyKey}, []byte{}))
+	return hash[:]
+}
+
+func signHandshake(identity *NodeIdentity, role string, initKey, replyKey []byte) ([]byte, error) {
+	r, s, err := crypto.Sign(rand.Reader, identity.PrivateKey, handshakeHash(role, initKey, replyKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.SerializeSignature(r, s), nil
+}
+
+func verifyHandshake(staticKey, signature []byte, role string, initKey, replyKey []byte) error {
+	pubKey, err := crypto.ParsePublicKey(staticKey)
+	if err != nil {
+		return err
+	}
+	if len(signature) != 64 {
+		return errors.New("Wrong handshake signature")
+	}
+
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !crypto.Verify(pubKey, handshakeHash(role, initKey, replyKey), r, s) {
+		return errors.New("Handshake signature verification failed")
+	}
+
+	return nil
+}
+
+// Derives AES-GCM cipher for one direction of the session
+func newSessionCipher(secret []byte, direction string, initKey, replyKey []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(bytes.Join([][]byte{secret, []byte(direction), initKey, replyKey}, []byte{}))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
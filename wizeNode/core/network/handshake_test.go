@@ -0,0 +1,63 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSecurity(t *testing.T, allowed ...[]byte) *TransportSecurity {
+	identity, err := NewNodeIdentity()
+	if err != nil {
+		t.Fatalf("Error: %+v\n", err)
+	}
+	return &TransportSecurity{Identity: identity, AllowedKeys: allowed}
+}
+
+func TestSecureHandshake(t *testing.T) {
+	client := testSecurity(t)
+	server := testSecurity(t, client.Identity.PublicKey)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	accepted := make(chan *NodeConn)
+	go func() {
+		conn, err := AcceptNode(c2, server)
+		assert.Nil(t, err, "Server handshake is done")
+		accepted <- conn
+	}()
+
+	conn := NewNodeConn(c1)
+	err := conn.handshake(client, true)
+	assert.Nil(t, err, "Client handshake is done")
+
+	serverConn := <-accepted
+	assert.Equal(t, server.Identity.PublicKey, conn.PeerKey, "Client knows server key")
+	assert.Equal(t, client.Identity.PublicKey, serverConn.PeerKey, "Server knows client key")
+
+	go conn.WriteMessage([]byte("version"))
+	msg, err := serverConn.ReadMessage()
+	assert.Nil(t, err, "Message is decrypted")
+	assert.Equal(t, "version", string(msg), "Message is same")
+}
+
+func TestSecureHandshakeNotAllowed(t *testing.T) {
+	other := testSecurity(t)
+	client := testSecurity(t)
+	server := testSecurity(t, other.Identity.PublicKey)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	go func() {
+		conn := NewNodeConn(c1)
+		conn.handshake(client, true)
+	}()
+
+	_, err := AcceptNode(c2, server)
+	c2.Close()
+	assert.NotNil(t, err, "Unknown node is rejected")
+}
@@ -26,6 +26,11 @@ func (n NodeAddr) String() string {
 	return n.Host + ":" + strconv.Itoa(n.Port)
 }
 
+// Light clients which don't accept connections have empty address
+func (n NodeAddr) IsEmpty() bool {
+	return n.Host == ""
+}
+
 // Compare to other node address if is same
 func (n NodeAddr) CompareToAddress(addr NodeAddr) bool {
 	h1 := strings.Trim(addr.Host, " ")
@@ -83,11 +88,33 @@ func BytesToCommand(bytes []byte) string {
 	return fmt.Sprintf("%s", command)
 }
 
-// Get command part from request string
+// Get command part from request string. Returns nil if request is too short
 func ExtractCommand(request []byte) []byte {
+	if len(request) < CommandLength {
+		return nil
+	}
 	return request[:CommandLength]
 }
 
+// Splits a request to command name and its data
+func ParseCommand(request []byte) (string, []byte, error) {
+	if len(request) < CommandLength {
+		return "", nil, fmt.Errorf("Request length %d is shorter than command", len(request))
+	}
+
+	command := BytesToCommand(request[:CommandLength])
+	if command == "" {
+		return "", nil, errors.New("Request has empty command")
+	}
+	for _, c := range command {
+		if c < 'a' || c > 'z' {
+			return "", nil, fmt.Errorf("Wrong command name %q", command)
+		}
+	}
+
+	return command, request[CommandLength:], nil
+}
+
 // Encode structure to bytes
 func GobEncode(data interface{}) ([]byte, error) {
 	var buff bytes.Buffer
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	client := NodeClient{}
+	request, _ := client.BuildCommandData("ping", &ComPing{NodeAddr{"127.0.0.1", 3000}, 1})
+
+	command, data, err := ParseCommand(request)
+	assert.Nil(t, err, "Request is parsed")
+	assert.Equal(t, "ping", command, "Command name")
+	assert.Equal(t, request[CommandLength:], data, "Command data")
+
+	_, _, err = ParseCommand([]byte("ping"))
+	assert.NotNil(t, err, "Short request is rejected")
+	_, _, err = ParseCommand(make([]byte, CommandLength))
+	assert.NotNil(t, err, "Empty command is rejected")
+	_, _, err = ParseCommand(append([]byte("PING\x01"), make([]byte, CommandLength)...))
+	assert.NotNil(t, err, "Wrong command name is rejected")
+}
+
+func FuzzParseCommand(f *testing.F) {
+	client := NodeClient{}
+	ping, _ := client.BuildCommandData("ping", &ComPing{NodeAddr{"127.0.0.1", 3000}, 1})
+	inv, _ := client.BuildCommandData("inv", &ComInv{NodeAddr{"127.0.0.1", 3000}, "tx", [][]byte{[]byte("tx")}})
+	f.Add(ping)
+	f.Add(inv)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, request []byte) {
+		command, data, err := ParseCommand(request)
+		if err != nil {
+			return
+		}
+		assert.NotEmpty(t, command, "Parsed command has name")
+
+		// data of any command is decoded without panic
+		payloads := []interface{}{
+			&ComAddr{}, &ComBlock{}, &ComBlockTxn{}, &ComCmpctBlock{}, &ComGetAddr{},
+			&ComGetBlocks{}, &ComGetBlockTxn{}, &ComGetData{}, &ComInv{}, &ComNotFound{},
+			&ComPing{}, &ComPong{}, &ComTx{}, &ComVersion{},
+		}
+		for _, payload := range payloads {
+			gob.NewDecoder(bytes.NewReader(data)).Decode(payload)
+		}
+	})
+}
@@ -2,10 +2,10 @@ package network
 
 import (
 	"bytes"
+	"encoding/gob"
 	"errors"
 	"fmt"
-	"io"
-	"net"
+	"time"
 
 	"wizeBlock/wizeNode/core/blockchain"
 	"wizeBlock/wizeNode/core/log"
@@ -13,17 +13,34 @@ import (
 
 // TODO: rethink with SendVersion
 // TODO: rethink with SendAddr
-// TODO: add NodeAuthStr and BuildCommandDataWithAuth
 // TODO: rethink with Data messages
 
+// Max count of headers in one message
+const MaxHeadersPerMessage = 2000
+
+// Max count of hashes in a block locator
+const MaxLocatorSize = 64
+
+// Max time to wait for answer to a request
+const RequestTimeout = 30 * time.Second
+
 type NodeClient struct {
 	WalletAddress string
 	NodeAddress   NodeAddr
 	Network       *NodeNetwork
+	Security      *TransportSecurity
+
+	// opens connections to other nodes, DefaultTransport is used if it is nil
+	Transport Transport
+	// addresses of nodes seen from this node, advertised ones are used if it is nil
+	Observed *ObservedAddrs
+	// services advertised in the handshake, DefaultServices if it is zero
+	Services uint64
 }
 
 type ComAddr struct {
-	AddrList []NodeAddr
+	AddrFrom NodeAddr
+	AddrList []NetAddress
 }
 
 type ComBlock struct {
@@ -31,14 +48,61 @@ type ComBlock struct {
 	Block    []byte
 }
 
+type ComBlockTxn struct {
+	AddrFrom     NodeAddr
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
+type ComCmpctBlock struct {
+	AddrFrom NodeAddr
+	Block    []byte
+}
+
+type ComGetAddr struct {
+	AddrFrom NodeAddr
+}
+
 type ComGetBlocks struct {
 	AddrFrom NodeAddr
 }
 
+type ComGetBlockTxn struct {
+	AddrFrom  NodeAddr
+	BlockHash []byte
+	Indexes   []int
+}
+
+type ComCFilters struct {
+	AddrFrom NodeAddr
+	Filters  []blockchain.BlockFilter
+}
+
+type ComGetCFilters struct {
+	AddrFrom    NodeAddr
+	BlockHashes [][]byte
+}
+
 type ComGetData struct {
 	AddrFrom NodeAddr
 	Type     string
-	ID       []byte
+	Items    [][]byte
+}
+
+type ComGetHeaders struct {
+	AddrFrom NodeAddr
+	Locator  [][]byte
+}
+
+type ComGetMerkleBlock struct {
+	AddrFrom  NodeAddr
+	BlockHash []byte
+	TxIDs     [][]byte
+}
+
+type ComHeaders struct {
+	AddrFrom NodeAddr
+	Headers  []blockchain.BlockHeader
 }
 
 type ComInv struct {
@@ -47,6 +111,26 @@ type ComInv struct {
 	Items    [][]byte
 }
 
+type ComMerkleBlock struct {
+	AddrFrom NodeAddr
+	Block    []byte
+}
+
+type ComNotFound struct {
+	AddrFrom NodeAddr
+	Type     string
+	Items    [][]byte
+}
+
+type ComPing struct {
+	AddrFrom NodeAddr
+	Nonce    uint64
+}
+
+type ComPong struct {
+	Nonce uint64
+}
+
 type ComTx struct {
 	AddFrom     NodeAddr
 	Transaction []byte
@@ -56,6 +140,7 @@ type ComVersion struct {
 	Version    int
 	BestHeight int
 	AddrFrom   NodeAddr
+	Services   uint64
 }
 
 // Set currrent node address , to include itin requests to other nodes
@@ -110,7 +195,7 @@ func (c *NodeClient) SendData(address NodeAddr, data []byte) error {
 	}
 
 	log.Debug.Printf("Sending %d bytes to %s", len(data), address)
-	conn, err := net.Dial(Protocol, address.String())
+	conn, err := c.Dial(address)
 	if err != nil {
 		log.Warn.Println("Dial error: ", err.Error())
 
@@ -119,12 +204,15 @@ func (c *NodeClient) SendData(address NodeAddr, data []byte) error {
 		// but this is not always good. we need something more smart here
 		// TODO this needs analysis. if removing of a node is good idea
 		//c.Network.RemoveNodeFromKnown(address)
+		if c.Network != nil && c.Network.AddrBook != nil {
+			c.Network.AddrBook.MarkAttempt(address)
+		}
 
 		return fmt.Errorf("%s is not available\n", address)
 	}
 	defer conn.Close()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	err = conn.WriteMessage(data)
 	if err != nil {
 		log.Warn.Printf("Send data error: %s", err)
 	}
@@ -134,8 +222,62 @@ func (c *NodeClient) SendData(address NodeAddr, data []byte) error {
 	return nil
 }
 
-func (c *NodeClient) SendAddr(address NodeAddr, addresses []NodeAddr) error {
-	nodes := ComAddr{addresses}
+/*
+* Sends request and reads answer from the same connection. Light clients
+* which don't accept connections send requests with empty address.
+* Returns command and payload of the answer
+ */
+func (c *NodeClient) Request(address NodeAddr, command string, data interface{}) (string, []byte, error) {
+	request, err := c.BuildCommandData(command, data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	conn, err := c.Dial(address)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(RequestTimeout))
+
+	err = conn.WriteMessage(request)
+	if err != nil {
+		return "", nil, err
+	}
+	response, err := conn.ReadMessage()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// node answers with false byte and message on errors
+	if len(response) > 0 && response[0] == 0 {
+		var message string
+		if gob.NewDecoder(bytes.NewReader(response[1:])).Decode(&message) == nil {
+			return "", nil, fmt.Errorf("Node %s: %s", address, message)
+		}
+	}
+	return ParseCommand(response)
+}
+
+// Connects to a node with the client transport
+func (c *NodeClient) Dial(address NodeAddr) (*NodeConn, error) {
+	transport := c.Transport
+	if transport == nil {
+		transport = DefaultTransport
+	}
+
+	conn, err := transport.Dial(c.Observed.Resolve(address))
+	if err != nil {
+		return nil, err
+	}
+	return ConnectNode(conn, c.Security)
+}
+
+func (c *NodeClient) SendAddr(address NodeAddr, addresses []NetAddress) error {
+	if len(addresses) > MaxAddrPerMessage {
+		addresses = addresses[:MaxAddrPerMessage]
+	}
+	nodes := ComAddr{c.NodeAddress, addresses}
 
 	request, err := c.BuildCommandData("addr", &nodes)
 	if err != nil {
@@ -156,6 +298,35 @@ func (c *NodeClient) SendBlock(address NodeAddr, block *blockchain.Block) error
 	return c.SendData(address, request)
 }
 
+func (c *NodeClient) SendBlockTxn(address NodeAddr, blockHash []byte, txs []*blockchain.Transaction) error {
+	data := ComBlockTxn{c.NodeAddress, blockHash, [][]byte{}}
+	for _, tx := range txs {
+		data.Transactions = append(data.Transactions, tx.Serialize())
+	}
+
+	request, err := c.BuildCommandData("blocktxn", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
+func (c *NodeClient) SendCmpctBlock(address NodeAddr, block *blockchain.Block) error {
+	compact, err := blockchain.NewCompactBlock(block).Serialize()
+	if err != nil {
+		return err
+	}
+	data := ComCmpctBlock{c.NodeAddress, compact}
+
+	request, err := c.BuildCommandData("cmpctblock", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
 func (c *NodeClient) SendInv(address NodeAddr, kind string, items [][]byte) error {
 	data := ComInv{c.NodeAddress, kind, items}
 
@@ -167,6 +338,17 @@ func (c *NodeClient) SendInv(address NodeAddr, kind string, items [][]byte) erro
 	return c.SendData(address, request)
 }
 
+func (c *NodeClient) SendGetAddr(address NodeAddr) error {
+	data := ComGetAddr{c.NodeAddress}
+
+	request, err := c.BuildCommandData("getaddr", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
 func (c *NodeClient) SendGetBlocks(address NodeAddr) error {
 	data := ComGetBlocks{c.NodeAddress}
 
@@ -178,8 +360,19 @@ func (c *NodeClient) SendGetBlocks(address NodeAddr) error {
 	return c.SendData(address, request)
 }
 
-func (c *NodeClient) SendGetData(address NodeAddr, kind string, id []byte) error {
-	data := ComGetData{c.NodeAddress, kind, id}
+func (c *NodeClient) SendGetBlockTxn(address NodeAddr, blockHash []byte, indexes []int) error {
+	data := ComGetBlockTxn{c.NodeAddress, blockHash, indexes}
+
+	request, err := c.BuildCommandData("getblocktxn", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
+func (c *NodeClient) SendGetData(address NodeAddr, kind string, items [][]byte) error {
+	data := ComGetData{c.NodeAddress, kind, items}
 
 	request, err := c.BuildCommandData("getdata", &data)
 	if err != nil {
@@ -189,6 +382,67 @@ func (c *NodeClient) SendGetData(address NodeAddr, kind string, id []byte) error
 	return c.SendData(address, request)
 }
 
+// Requests compact filters of the blocks
+func (c *NodeClient) SendGetCFilters(address NodeAddr, blockHashes [][]byte) error {
+	data := ComGetCFilters{c.NodeAddress, blockHashes}
+
+	request, err := c.BuildCommandData("getcfilters", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
+func (c *NodeClient) SendCFilters(address NodeAddr, filters []blockchain.BlockFilter) error {
+	data := ComCFilters{c.NodeAddress, filters}
+
+	request, err := c.BuildCommandData("cfilters", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
+// Requests merkle block with proofs of the transactions
+func (c *NodeClient) SendGetMerkleBlock(address NodeAddr, blockHash []byte, txIDs [][]byte) error {
+	data := ComGetMerkleBlock{c.NodeAddress, blockHash, txIDs}
+
+	request, err := c.BuildCommandData("getmerkle", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
+func (c *NodeClient) SendMerkleBlock(address NodeAddr, block *blockchain.MerkleBlock) error {
+	merkle, err := block.Serialize()
+	if err != nil {
+		return err
+	}
+	data := ComMerkleBlock{c.NodeAddress, merkle}
+
+	request, err := c.BuildCommandData("merkleblock", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
+func (c *NodeClient) SendNotFound(address NodeAddr, kind string, items [][]byte) error {
+	data := ComNotFound{c.NodeAddress, kind, items}
+
+	request, err := c.BuildCommandData("notfound", &data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendData(address, request)
+}
+
 func (c *NodeClient) SendTx(address NodeAddr, tnx *blockchain.Transaction) error {
 	data := ComTx{c.NodeAddress, tnx.Serialize()}
 
@@ -201,7 +455,11 @@ func (c *NodeClient) SendTx(address NodeAddr, tnx *blockchain.Transaction) error
 }
 
 func (c *NodeClient) SendVersion(address NodeAddr, bestHeight int) error {
-	data := ComVersion{NodeVersion, bestHeight, c.NodeAddress}
+	services := c.Services
+	if services == 0 {
+		services = DefaultServices
+	}
+	data := ComVersion{NodeVersion, bestHeight, c.NodeAddress, services}
 
 	request, err := c.BuildCommandData("version", &data)
 	if err != nil {
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+)
+
+const (
+	// Every message frame starts with magic bytes of the network and data length
+	frameHeaderLength = 8
+	// Max size of a message. It should fit the max block with command name
+	MaxMessageSize = 4 * 1024 * 1024
+	// Encrypted frame is longer than the message by size of AEAD tag
+	frameOverhead = 16
+)
+
+// NodeConn is a connection between two nodes which transfers framed messages.
+// After a secure handshake all frames are encrypted and PeerKey holds
+// the authenticated public key of the other node
+type NodeConn struct {
+	net.Conn
+	PeerKey []byte
+
+	sendCipher cipher.AEAD
+	recvCipher cipher.AEAD
+	sendNonce  uint64
+	recvNonce  uint64
+}
+
+// Wraps a network connection to exchange framed messages
+func NewNodeConn(conn net.Conn) *NodeConn {
+	return &NodeConn{Conn: conn}
+}
+
+// Returns true if messages are encrypted
+func (c *NodeConn) IsSecure() bool {
+	return c.sendCipher != nil
+}
+
+// Writes one message to the connection
+func (c *NodeConn) WriteMessage(data []byte) error {
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("Message size %d is over limit %d", len(data), MaxMessageSize)
+	}
+
+	if c.sendCipher != nil {
+		data = c.sendCipher.Seal(nil, frameNonce(c.sendNonce), data, nil)
+		c.sendNonce++
+	}
+
+	frame := make([]byte, frameHeaderLength, frameHeaderLength+len(data))
+	binary.BigEndian.PutUint32(frame, chaincfg.Active.Magic)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+	frame = append(frame, data...)
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Reads one message from the connection
+func (c *NodeConn) ReadMessage() ([]byte, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return nil, err
+	}
+
+	// nodes of other networks are rejected
+	if magic := binary.BigEndian.Uint32(header); magic != chaincfg.Active.Magic {
+		return nil, fmt.Errorf("Wrong network magic %08x", magic)
+	}
+
+	// length is checked before allocation, so a peer can't exhaust memory
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > MaxMessageSize+frameOverhead {
+		return nil, fmt.Errorf("Message size %d is over limit %d", length, MaxMessageSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, data); err != nil {
+		return nil, err
+	}
+
+	if c.recvCipher != nil {
+		plain, err := c.recvCipher.Open(nil, frameNonce(c.recvNonce), data, nil)
+		if err != nil {
+			return nil, errors.New("Message authentication failed")
+		}
+		c.recvNonce++
+		data = plain
+	}
+
+	return data, nil
+}
+
+// Builds AEAD nonce from a frame counter
+func frameNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/chaincfg"
+)
+
+func TestNodeConnMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go NewNodeConn(client).WriteMessage([]byte("message"))
+
+	data, err := NewNodeConn(server).ReadMessage()
+	assert.Nil(t, err, "Message is read")
+	assert.Equal(t, []byte("message"), data, "Message is not changed")
+}
+
+func TestNodeConnOtherNetwork(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		frame := make([]byte, frameHeaderLength)
+		binary.BigEndian.PutUint32(frame, chaincfg.TestNetParams.Magic)
+		binary.BigEndian.PutUint32(frame[4:], 0)
+		client.Write(frame)
+	}()
+
+	_, err := NewNodeConn(server).ReadMessage()
+	assert.NotNil(t, err, "Message of other network is rejected")
+}
+
+func TestNodeConnSizeLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	err := NewNodeConn(client).WriteMessage(make([]byte, MaxMessageSize+1))
+	assert.NotNil(t, err, "Big message is not sent")
+
+	go func() {
+		frame := make([]byte, frameHeaderLength)
+		binary.BigEndian.PutUint32(frame, chaincfg.Active.Magic)
+		binary.BigEndian.PutUint32(frame[4:], 0xffffffff)
+		client.Write(frame)
+	}()
+
+	_, err = NewNodeConn(server).ReadMessage()
+	assert.NotNil(t, err, "Big message is rejected before reading")
+}
+
+func FuzzNodeConnReadMessage(f *testing.F) {
+	frame := make([]byte, frameHeaderLength)
+	binary.BigEndian.PutUint32(frame, chaincfg.Active.Magic)
+	binary.BigEndian.PutUint32(frame[4:], 7)
+	f.Add(append(frame, []byte("message")...))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		message, err := NewNodeConn(server).ReadMessage()
+		if err == nil {
+			assert.True(t, len(message) <= MaxMessageSize+frameOverhead, "Message fits the limit")
+		}
+	})
+}
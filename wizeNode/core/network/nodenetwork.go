@@ -4,13 +4,22 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"strings"
+	"sync"
+	"time"
 
+	"wizeBlock/wizeNode/core/chaincfg"
 	"wizeBlock/wizeNode/core/log"
 )
 
 // TODO: rethink with LoadInitialNodes and Genesis
 
-const InitialNodesList = "files/initialnodes.json"
+const InitialNodesList = "initialnodes.json"
+
+// Max count of nodes a node talks to
+const MaxKnownNodes = 125
+
+// Interval of saving changed address book
+const AddrBookSaveInterval = time.Minute
 
 // Interface for extra storage for a nodes
 type NodeNetworkStorage interface {
@@ -18,12 +27,20 @@ type NodeNetworkStorage interface {
 	AddNodeToKnown(addr NodeAddr)
 	RemoveNodeFromKnown(addr NodeAddr)
 	GetCountOfKnownNodes() (int, error)
+	GetAddresses() ([]KnownAddress, error)
+	SaveAddresses(list []KnownAddress) error
 }
 
 // This manages list of known nodes by a node
+// and address book of other nodes learned from network.
+// Nodes list is changed by handlers and the peer monitor concurrently,
+// so it should be accessed only with methods
 type NodeNetwork struct {
-	Nodes   []NodeAddr
-	Storage NodeNetworkStorage
+	Nodes    []NodeAddr
+	Storage  NodeNetworkStorage
+	AddrBook *AddrBook
+
+	mutex sync.RWMutex
 }
 
 type NodesListJSON struct {
@@ -48,20 +65,63 @@ func (n *NodeNetwork) LoadNodes() error {
 		return err
 	}
 
-	for _, node := range nodes {
-		n.Nodes = append(n.Nodes, node)
+	n.mutex.Lock()
+	n.Nodes = append(n.Nodes, nodes...)
+	n.mutex.Unlock()
+
+	if n.AddrBook != nil {
+		addresses, err := n.Storage.GetAddresses()
+		if err != nil {
+			return err
+		}
+		n.AddrBook.Load(addresses)
 	}
 
 	return nil
 }
 
+// Saves address book to storage if it was changed since the last save
+func (n *NodeNetwork) SaveAddrBook() error {
+	if n.Storage == nil || n.AddrBook == nil || !n.AddrBook.TakeChanged() {
+		return nil
+	}
+
+	return n.Storage.SaveAddresses(n.AddrBook.All())
+}
+
+/*
+* Saves changed address book periodically until stop channel is closed.
+* The book is saved the last time on stop, so addresses learned since the
+* last save are not lost
+ */
+func (n *NodeNetwork) RunAddrBookSaver(stop chan struct{}) {
+	ticker := time.NewTicker(AddrBookSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			if err := n.SaveAddrBook(); err != nil {
+				log.Warn.Printf("Failed to save address book: %s", err)
+			}
+			return
+		case <-ticker.C:
+			if err := n.SaveAddrBook(); err != nil {
+				log.Warn.Printf("Failed to save address book: %s", err)
+			}
+		}
+	}
+}
+
 // Set nodes list. This can be used to do initial nodes loading from  config or so
 func (n *NodeNetwork) SetNodes(nodes []NodeAddr, replace bool) {
+	n.mutex.Lock()
 	if replace {
-		n.Nodes = nodes
+		n.Nodes = append([]NodeAddr{}, nodes...)
 	} else {
 		n.Nodes = append(n.Nodes, nodes...)
 	}
+	n.mutex.Unlock()
 
 	if n.Storage != nil {
 		// remember what is not yet remembered
@@ -75,7 +135,7 @@ func (n *NodeNetwork) SetNodes(nodes []NodeAddr, replace bool) {
 // Accepts genesis block hash. It will be compared to the hash in JSON doc
 func (n *NodeNetwork) LoadInitialNodes(exceptAddr NodeAddr) error {
 	//response, err := http.Get(InitialNodesList)
-	jsondoc, err := ioutil.ReadFile(InitialNodesList)
+	jsondoc, err := ioutil.ReadFile(chaincfg.DataPath(InitialNodesList))
 	if err != nil {
 		log.Warn.Printf("Failed with reading initial nodes: %+v", err)
 		return err
@@ -102,7 +162,15 @@ func (n *NodeNetwork) LoadInitialNodes(exceptAddr NodeAddr) error {
 
 	log.Info.Printf("Initial nodes: %+v", nodes)
 
+	n.mutex.Lock()
 	n.Nodes = append(n.Nodes, nodes.Nodes...)
+	n.mutex.Unlock()
+
+	if n.AddrBook != nil {
+		for _, node := range nodes.Nodes {
+			n.AddrBook.AddAddress(NetAddress{Addr: node}, node)
+		}
+	}
 
 	if n.Storage != nil {
 		// remember loaded nodes in local storage
@@ -115,19 +183,27 @@ func (n *NodeNetwork) LoadInitialNodes(exceptAddr NodeAddr) error {
 	return nil
 }
 
+// Returns a copy of known nodes list
 func (n *NodeNetwork) GetNodes() []NodeAddr {
-	return n.Nodes
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return append([]NodeAddr{}, n.Nodes...)
 }
 
 // Returns number of known nodes
 func (n *NodeNetwork) GetCountOfKnownNodes() int {
-	l := len(n.Nodes)
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
 
-	return l
+	return len(n.Nodes)
 }
 
 // Check if node address is known
 func (n *NodeNetwork) CheckIsKnown(addr NodeAddr) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
 	exists := false
 
 	for _, node := range n.Nodes {
@@ -145,6 +221,7 @@ func (n *NodeNetwork) CheckIsKnown(addr NodeAddr) bool {
 * Returns true if was added
  */
 func (n *NodeNetwork) AddNodeToKnown(addr NodeAddr) bool {
+	n.mutex.Lock()
 	exists := false
 
 	for _, node := range n.Nodes {
@@ -153,9 +230,15 @@ func (n *NodeNetwork) AddNodeToKnown(addr NodeAddr) bool {
 			break
 		}
 	}
+	if !exists && len(n.Nodes) >= MaxKnownNodes {
+		n.mutex.Unlock()
+		log.Debug.Printf("Too many known nodes, skip %s", addr)
+		return false
+	}
 	if !exists {
 		n.Nodes = append(n.Nodes, addr)
 	}
+	n.mutex.Unlock()
 
 	if n.Storage != nil {
 		n.Storage.AddNodeToKnown(addr)
@@ -166,6 +249,7 @@ func (n *NodeNetwork) AddNodeToKnown(addr NodeAddr) bool {
 
 // Removes a node from known
 func (n *NodeNetwork) RemoveNodeFromKnown(addr NodeAddr) {
+	n.mutex.Lock()
 	updatedlist := []NodeAddr{}
 
 	for _, node := range n.Nodes {
@@ -175,6 +259,7 @@ func (n *NodeNetwork) RemoveNodeFromKnown(addr NodeAddr) {
 	}
 
 	n.Nodes = updatedlist
+	n.mutex.Unlock()
 
 	if n.Storage != nil {
 		n.Storage.RemoveNodeFromKnown(addr)
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// resolves host names of advertised addresses, replaced in tests
+var lookupHost = net.LookupHost
+
+const (
+	// MaxObservedAddrs limits count of remembered observed addresses
+	MaxObservedAddrs = 1000
+	// ObservedAddrTTL is how long an observed address is used after the node was seen
+	ObservedAddrTTL = 24 * time.Hour
+)
+
+/*
+* ObservedAddrs keeps addresses of nodes as they are seen by this node.
+* A node behind NAT or docker networking may advertise a host which is
+* not reachable from here (e.g. a container name). Then the host its
+* connection comes from is used to send messages to the node.
+* Addresses are remembered only for nodes authenticated by the secure
+* handshake: every identity key owns one advertised address and can't
+* replace an address owned by another key, so a peer can't redirect
+* messages sent to other nodes
+ */
+type ObservedAddrs struct {
+	mutex sync.RWMutex
+	addrs map[string]*observedAddr
+	// advertised address owned by an identity key
+	owners map[string]string
+}
+
+type observedAddr struct {
+	addr     NodeAddr
+	owner    string
+	lastSeen time.Time
+}
+
+func NewObservedAddrs() *ObservedAddrs {
+	return &ObservedAddrs{
+		addrs:  make(map[string]*observedAddr),
+		owners: make(map[string]string),
+	}
+}
+
+/*
+* Learn checks the address advertised by a node against the host its
+* connection comes from and returns the address to reach the node.
+* The advertised one is kept if it resolves to the observed host or to
+* a public IP, otherwise the observed host with the advertised port is used.
+* It is remembered for later messages only if peerKey of the connection is known
+ */
+func (o *ObservedAddrs) Learn(advertised NodeAddr, observedHost string, peerKey []byte) NodeAddr {
+	if o == nil || advertised.IsEmpty() || observedHost == "" || isReachable(advertised.Host, observedHost) {
+		return advertised
+	}
+
+	observed := NodeAddr{Host: observedHost, Port: advertised.Port}
+	if len(peerKey) == 0 {
+		return observed
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.learn(advertised.String(), observed, string(peerKey), time.Now())
+	return observed
+}
+
+func (o *ObservedAddrs) learn(advertised string, observed NodeAddr, owner string, now time.Time) {
+	o.expire(now)
+
+	entry, ok := o.addrs[advertised]
+	if ok && entry.owner != owner {
+		return
+	}
+	// the key moved to other address
+	if previous, ok := o.owners[owner]; ok && previous != advertised {
+		delete(o.addrs, previous)
+	}
+	if !ok && len(o.addrs) >= MaxObservedAddrs {
+		o.evictOldest()
+	}
+
+	o.addrs[advertised] = &observedAddr{addr: observed, owner: owner, lastSeen: now}
+	o.owners[owner] = advertised
+}
+
+// Resolve returns the observed address of a node if it is known, otherwise the address itself
+func (o *ObservedAddrs) Resolve(address NodeAddr) NodeAddr {
+	if o == nil {
+		return address
+	}
+
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	entry, ok := o.addrs[address.String()]
+	if ok && time.Since(entry.lastSeen) < ObservedAddrTTL {
+		return entry.addr
+	}
+	return address
+}
+
+// Removes addresses of nodes not seen for ObservedAddrTTL
+func (o *ObservedAddrs) expire(now time.Time) {
+	for advertised, entry := range o.addrs {
+		if now.Sub(entry.lastSeen) >= ObservedAddrTTL {
+			o.remove(advertised)
+		}
+	}
+}
+
+func (o *ObservedAddrs) evictOldest() {
+	oldest := ""
+	for advertised, entry := range o.addrs {
+		if oldest == "" || entry.lastSeen.Before(o.addrs[oldest].lastSeen) {
+			oldest = advertised
+		}
+	}
+	o.remove(oldest)
+}
+
+func (o *ObservedAddrs) remove(advertised string) {
+	if entry, ok := o.addrs[advertised]; ok {
+		delete(o.owners, entry.owner)
+		delete(o.addrs, advertised)
+	}
+}
+
+// Checks the advertised host can be used to connect to a node seen from the observed host
+func isReachable(host, observedHost string) bool {
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	if host == observedHost {
+		return true
+	}
+
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		resolved, err := lookupHost(host)
+		if err != nil {
+			return false
+		}
+		ips = resolved
+	}
+
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		if ip == observedHost || parsed.Equal(net.ParseIP(observedHost)) {
+			return true
+		}
+		if parsed.IsGlobalUnicast() && !parsed.IsPrivate() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObservedAddrs(t *testing.T) {
+	defer func(lookup func(string) ([]string, error)) { lookupHost = lookup }(lookupHost)
+	lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "wize1":
+			return []string{"172.18.0.5"}, nil
+		case "wize.example":
+			return []string{"203.0.113.7"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	observed := NewObservedAddrs()
+	key1, key2 := []byte("key1"), []byte("key2")
+
+	addr := NodeAddr{"wize1", 3000}
+	assert.Equal(t, addr, observed.Learn(addr, "172.18.0.5", key1), "Host resolving to observed one is kept")
+
+	addr = NodeAddr{"wize.example", 3000}
+	assert.Equal(t, addr, observed.Learn(addr, "198.51.100.1", key1), "Public host is kept")
+
+	addr = NodeAddr{"192.168.1.5", 3000}
+	assert.Equal(t, NodeAddr{"198.51.100.1", 3000}, observed.Learn(addr, "198.51.100.1", key1), "Private host behind NAT is replaced")
+	assert.Equal(t, NodeAddr{"198.51.100.1", 3000}, observed.Resolve(addr), "Observed address is remembered")
+
+	// other identity can't take the address, a node without identity is not remembered
+	assert.Equal(t, NodeAddr{"172.18.0.9", 3000}, observed.Learn(addr, "172.18.0.9", key2), "Observed host is used to reply")
+	assert.Equal(t, NodeAddr{"172.18.0.9", 3000}, observed.Learn(addr, "172.18.0.9", nil), "Observed host is used to reply")
+	assert.Equal(t, NodeAddr{"198.51.100.1", 3000}, observed.Resolve(addr), "Address of other identity is not replaced")
+
+	addr2 := NodeAddr{"wize2", 3001}
+	assert.Equal(t, NodeAddr{"172.18.0.6", 3001}, observed.Learn(addr2, "172.18.0.6", nil), "Unknown host is replaced")
+	assert.Equal(t, addr2, observed.Resolve(addr2), "Address of not authenticated node is not remembered")
+
+	// identity owns only one address
+	observed.Learn(addr2, "172.18.0.6", key1)
+	assert.Equal(t, NodeAddr{"172.18.0.6", 3001}, observed.Resolve(addr2), "Identity moves to new address")
+	assert.Equal(t, addr, observed.Resolve(addr), "Old address of identity is forgotten")
+
+	// old addresses expire, count of addresses is limited
+	observed.learn(addr.String(), NodeAddr{"172.18.0.7", 3000}, "key2", time.Now().Add(-ObservedAddrTTL))
+	assert.Equal(t, addr, observed.Resolve(addr), "Expired address is not used")
+	for i := 0; i < MaxObservedAddrs+10; i++ {
+		observed.learn(NodeAddr{"wize", 4000 + i}.String(), NodeAddr{"172.18.1.1", 4000 + i}, fmt.Sprintf("key%d", i+10), time.Now())
+	}
+	assert.Equal(t, MaxObservedAddrs, len(observed.addrs), "Count of addresses is limited")
+
+	addr = NodeAddr{"127.0.0.1", 3002}
+	assert.Equal(t, addr, observed.Resolve(addr), "Not observed address is not changed")
+	assert.Equal(t, addr, (*ObservedAddrs)(nil).Resolve(addr), "Nil observed addresses don't change address")
+}
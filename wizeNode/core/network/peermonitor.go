@@ -0,0 +1,240 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"wizeBlock/wizeNode/core/log"
+)
+
+const (
+	// how often nodes are pinged
+	PingInterval = 30 * time.Second
+	// how long to wait for pong
+	PingTimeout = 10 * time.Second
+	// node is disconnected after this count of pings without pong
+	MaxMissedPings = 3
+)
+
+// PeerInfo is liveness information about other node
+type PeerInfo struct {
+	Addr        NodeAddr
+	Connected   bool
+	LastSeen    int64
+	LastPing    int64
+	Latency     int64 // round-trip time in milliseconds
+	MissedPings int
+}
+
+// PeerMonitor keeps persistent connections to known nodes and pings them.
+// Nodes which don't answer are disconnected
+type PeerMonitor struct {
+	Client  *NodeClient
+	Network *NodeNetwork
+
+	mutex sync.Mutex
+	peers map[string]*monitoredPeer
+}
+
+type monitoredPeer struct {
+	info PeerInfo
+	conn *NodeConn
+}
+
+// Creates a monitor of nodes known by the network
+func NewPeerMonitor(client *NodeClient, network *NodeNetwork) *PeerMonitor {
+	return &PeerMonitor{
+		Client:  client,
+		Network: network,
+		peers:   make(map[string]*monitoredPeer),
+	}
+}
+
+// Pings all known nodes until stop channel is closed
+func (m *PeerMonitor) Run(stop chan struct{}) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		m.PingAll()
+
+		select {
+		case <-stop:
+			m.closeAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pings all known nodes concurrently and waits for results
+func (m *PeerMonitor) PingAll() {
+	var wg sync.WaitGroup
+
+	m.forgetUnknown()
+	for _, addr := range m.Network.GetNodes() {
+		if addr.CompareToAddress(m.Client.NodeAddress) {
+			continue
+		}
+		wg.Add(1)
+		go func(addr NodeAddr) {
+			defer wg.Done()
+			m.ping(addr)
+		}(addr)
+	}
+
+	wg.Wait()
+}
+
+// Remembers that some message was received from a node. Only known nodes are monitored
+func (m *PeerMonitor) MarkSeen(addr NodeAddr) {
+	if !m.Network.CheckIsKnown(addr) {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.getPeer(addr).info.LastSeen = time.Now().Unix()
+}
+
+// Returns information about all monitored nodes
+func (m *PeerMonitor) GetPeers() []PeerInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := []PeerInfo{}
+	for _, peer := range m.peers {
+		list = append(list, peer.info)
+	}
+	return list
+}
+
+func (m *PeerMonitor) ping(addr NodeAddr) {
+	m.mutex.Lock()
+	peer := m.getPeer(addr)
+	conn := peer.conn
+	m.mutex.Unlock()
+
+	var err error
+	if conn == nil {
+		conn, err = m.Client.Dial(addr)
+	}
+
+	var rtt time.Duration
+	if err == nil {
+		rtt, err = m.sendPing(conn)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	peer.info.LastPing = time.Now().Unix()
+
+	if err != nil {
+		log.Debug.Printf("Ping %s failed: %s", addr, err)
+		if conn != nil {
+			conn.Close()
+		}
+		peer.conn = nil
+		peer.info.Connected = false
+		peer.info.MissedPings++
+
+		if peer.info.MissedPings >= MaxMissedPings {
+			log.Info.Printf("Node %s doesn't answer, disconnect it", addr)
+			delete(m.peers, addr.String())
+			m.Network.RemoveNodeFromKnown(addr)
+			if m.Network.AddrBook != nil {
+				m.Network.AddrBook.MarkAttempt(addr)
+			}
+		}
+		return
+	}
+
+	peer.conn = conn
+	peer.info.Connected = true
+	peer.info.MissedPings = 0
+	peer.info.LastSeen = time.Now().Unix()
+	peer.info.Latency = int64(rtt / time.Millisecond)
+}
+
+// Sends ping with random nonce and waits for pong with the same nonce
+func (m *PeerMonitor) sendPing(conn *NodeConn) (time.Duration, error) {
+	nonce := mrand.Uint64()
+	request, err := m.Client.BuildCommandData("ping", &ComPing{m.Client.NodeAddress, nonce})
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(PingTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	err = conn.WriteMessage(request)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := conn.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	command, data, err := ParseCommand(response)
+	if err != nil || command != "pong" {
+		return 0, fmt.Errorf("Unexpected response")
+	}
+
+	var pong ComPong
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&pong)
+	if err != nil {
+		return 0, err
+	}
+	if pong.Nonce != nonce {
+		return 0, fmt.Errorf("Wrong pong nonce")
+	}
+
+	return rtt, nil
+}
+
+func (m *PeerMonitor) getPeer(addr NodeAddr) *monitoredPeer {
+	peer, ok := m.peers[addr.String()]
+	if !ok {
+		peer = &monitoredPeer{info: PeerInfo{Addr: addr}}
+		m.peers[addr.String()] = peer
+	}
+	return peer
+}
+
+// Stops monitoring of nodes removed from known ones
+func (m *PeerMonitor) forgetUnknown() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, peer := range m.peers {
+		if m.Network.CheckIsKnown(peer.info.Addr) {
+			continue
+		}
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+		delete(m.peers, key)
+	}
+}
+
+func (m *PeerMonitor) closeAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, peer := range m.peers {
+		if peer.conn != nil {
+			peer.conn.Close()
+			peer.conn = nil
+		}
+		peer.info.Connected = false
+	}
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a node which answers pings. Returns its address
+func testPongServer(t *testing.T, answer bool) (NodeAddr, net.Listener) {
+	ln, err := net.Listen(Protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %+v\n", err)
+	}
+
+	go func() {
+		for {
+			rawConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !answer {
+				rawConn.Close()
+				continue
+			}
+			go func() {
+				conn := NewNodeConn(rawConn)
+				defer conn.Close()
+				client := NodeClient{}
+				for {
+					request, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					var ping ComPing
+					gob.NewDecoder(bytes.NewReader(request[CommandLength:])).Decode(&ping)
+					response, _ := client.BuildCommandData("pong", &ComPong{ping.Nonce})
+					conn.WriteMessage(response)
+				}
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return NodeAddr{"127.0.0.1", addr.Port}, ln
+}
+
+func TestPeerMonitorPing(t *testing.T) {
+	addr, ln := testPongServer(t, true)
+	defer ln.Close()
+
+	network := &NodeNetwork{Nodes: []NodeAddr{addr}}
+	monitor := NewPeerMonitor(&NodeClient{NodeAddress: NodeAddr{"127.0.0.1", 1}}, network)
+
+	monitor.PingAll()
+	monitor.PingAll()
+	monitor.MarkSeen(NodeAddr{"10.0.0.1", 3000})
+
+	peers := monitor.GetPeers()
+	assert.Equal(t, 1, len(peers), "Known node is monitored, unknown one is not")
+	assert.True(t, peers[0].Connected, "Node is connected")
+	assert.Equal(t, 0, peers[0].MissedPings, "Node answers pings")
+	assert.NotEqual(t, int64(0), peers[0].LastSeen, "Last seen time is set")
+	monitor.closeAll()
+}
+
+func TestPeerMonitorDisconnect(t *testing.T) {
+	addr, ln := testPongServer(t, false)
+	defer ln.Close()
+
+	network := &NodeNetwork{Nodes: []NodeAddr{addr}}
+	monitor := NewPeerMonitor(&NodeClient{NodeAddress: NodeAddr{"127.0.0.1", 1}}, network)
+
+	for i := 0; i < MaxMissedPings; i++ {
+		monitor.PingAll()
+	}
+
+	assert.Equal(t, 0, len(monitor.GetPeers()), "Node is not monitored")
+	assert.Equal(t, 0, network.GetCountOfKnownNodes(), "Node is removed from known")
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	"wizeBlock/wizeNode/core/log"
+)
+
+const (
+	// host is banned when its misbehavior score reaches this value
+	BanThreshold = 100
+	// how long a host stays banned
+	BanDuration = 24 * time.Hour
+)
+
+/*
+* PeerScores counts misbehavior of other nodes by host. A host which sends
+* too many requests or broken messages is banned for some time
+ */
+type PeerScores struct {
+	mutex  sync.Mutex
+	scores map[string]int
+	banned map[string]time.Time
+
+	now func() time.Time
+}
+
+func NewPeerScores() *PeerScores {
+	return &PeerScores{
+		scores: make(map[string]int),
+		banned: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Adds points to the score of a host. Returns true if the host is banned
+func (p *PeerScores) Misbehaving(host string, points int, reason string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.scores[host] += points
+	score := p.scores[host]
+	log.Info.Printf("Host %s misbehaves: %s, score %d", host, reason, score)
+
+	if score < BanThreshold {
+		return false
+	}
+
+	delete(p.scores, host)
+	p.banned[host] = p.now().Add(BanDuration)
+	log.Warn.Printf("Host %s is banned until %s", host, p.banned[host].Format(time.RFC3339))
+	return true
+}
+
+// Returns true if connections from the host should be rejected
+func (p *PeerScores) IsBanned(host string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	until, ok := p.banned[host]
+	if !ok {
+		return false
+	}
+	if p.now().After(until) {
+		delete(p.banned, host)
+		return false
+	}
+	return true
+}
+
+// Returns current misbehavior score of a host
+func (p *PeerScores) Score(host string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.scores[host]
+}
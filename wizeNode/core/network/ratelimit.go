@@ -0,0 +1,187 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Points added to the score of a host for violation of limits
+const (
+	scoreTooManyConnections = 10
+	scoreTooManyMessages    = 10
+)
+
+// limits of hosts idle for this time are forgotten
+const peerLimitExpiration = 10 * time.Minute
+
+// Limits of inbound connections and messages
+type LimitConfig struct {
+	// inbound connections from all nodes
+	MaxConnections int
+	// inbound connections from one host
+	MaxPeerConnections int
+	// messages per second from one host and max burst of them
+	PeerMessageRate  float64
+	PeerMessageBurst int
+	// messages per second from all nodes and max burst of them
+	MessageRate  float64
+	MessageBurst int
+	// count of handlers which read blocks for other nodes at the same time
+	ReadWorkers int
+}
+
+var DefaultLimits = LimitConfig{
+	MaxConnections:     125,
+	MaxPeerConnections: 16,
+	PeerMessageRate:    50,
+	PeerMessageBurst:   200,
+	MessageRate:        500,
+	MessageBurst:       1000,
+	ReadWorkers:        4,
+}
+
+/*
+* Limiter counts inbound connections and messages of other nodes.
+* Violations of per host limits are added to the score of the host
+ */
+type Limiter struct {
+	Config LimitConfig
+	Scores *PeerScores
+
+	mutex       sync.Mutex
+	connections int
+	peers       map[string]*peerLimit
+	messages    *tokenBucket
+
+	now func() time.Time
+}
+
+type peerLimit struct {
+	connections int
+	messages    *tokenBucket
+}
+
+func NewLimiter(config LimitConfig, scores *PeerScores) *Limiter {
+	l := &Limiter{
+		Config: config,
+		Scores: scores,
+		peers:  make(map[string]*peerLimit),
+		now:    time.Now,
+	}
+	l.messages = newTokenBucket(config.MessageRate, config.MessageBurst, l.now())
+	return l
+}
+
+// Registers a new connection from the host. Returns error if it should be closed
+func (l *Limiter) Connect(host string) error {
+	if l.Scores.IsBanned(host) {
+		return fmt.Errorf("Host %s is banned", host)
+	}
+
+	l.mutex.Lock()
+	if l.connections >= l.Config.MaxConnections {
+		l.mutex.Unlock()
+		return errors.New("Too many connections")
+	}
+
+	peer := l.getPeer(host)
+	if peer.connections >= l.Config.MaxPeerConnections {
+		l.mutex.Unlock()
+		l.Scores.Misbehaving(host, scoreTooManyConnections, "too many connections")
+		return fmt.Errorf("Too many connections from %s", host)
+	}
+
+	peer.connections++
+	l.connections++
+	l.mutex.Unlock()
+
+	return nil
+}
+
+// Unregisters a closed connection of the host
+func (l *Limiter) Disconnect(host string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if peer, ok := l.peers[host]; ok && peer.connections > 0 {
+		peer.connections--
+		l.connections--
+	}
+}
+
+// Counts a message from the host. Returns error if the message should be dropped
+func (l *Limiter) AllowMessage(host string) error {
+	l.mutex.Lock()
+	now := l.now()
+	peerAllowed := l.getPeer(host).messages.take(now)
+	allowed := peerAllowed && l.messages.take(now)
+	l.mutex.Unlock()
+
+	if !peerAllowed {
+		l.Scores.Misbehaving(host, scoreTooManyMessages, "too many messages")
+		return fmt.Errorf("Too many messages from %s", host)
+	}
+	if !allowed {
+		return errors.New("Node is busy")
+	}
+	return nil
+}
+
+// Returns count of inbound connections
+func (l *Limiter) Connections() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.connections
+}
+
+// Returns limits of a host. Mutex should be locked
+func (l *Limiter) getPeer(host string) *peerLimit {
+	peer, ok := l.peers[host]
+	if ok {
+		return peer
+	}
+
+	// forget hosts which didn't send anything for long time
+	now := l.now()
+	if len(l.peers) >= l.Config.MaxConnections {
+		for h, p := range l.peers {
+			if p.connections == 0 && now.Sub(p.messages.updated) > peerLimitExpiration {
+				delete(l.peers, h)
+			}
+		}
+	}
+
+	peer = &peerLimit{messages: newTokenBucket(l.Config.PeerMessageRate, l.Config.PeerMessageBurst, now)}
+	l.peers[host] = peer
+	return peer
+}
+
+// Token bucket refilled with rate tokens per second up to burst
+type tokenBucket struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate, float64(burst), float64(burst), now}
+}
+
+// Takes one token. Returns false if the bucket is empty
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.updated).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
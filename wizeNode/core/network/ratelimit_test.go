@@ -0,0 +1,62 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterConnections(t *testing.T) {
+	config := DefaultLimits
+	config.MaxConnections = 3
+	config.MaxPeerConnections = 2
+	limiter := NewLimiter(config, NewPeerScores())
+
+	assert.Nil(t, limiter.Connect("10.0.0.1"), "First connection")
+	assert.Nil(t, limiter.Connect("10.0.0.1"), "Second connection")
+	assert.NotNil(t, limiter.Connect("10.0.0.1"), "Connections of one host are limited")
+	assert.Equal(t, scoreTooManyConnections, limiter.Scores.Score("10.0.0.1"), "Violation is scored")
+
+	assert.Nil(t, limiter.Connect("10.0.0.2"), "Other host connects")
+	assert.NotNil(t, limiter.Connect("10.0.0.3"), "All connections are limited")
+	assert.Equal(t, 0, limiter.Scores.Score("10.0.0.3"), "Host is not guilty of global limit")
+
+	limiter.Disconnect("10.0.0.1")
+	assert.Equal(t, 2, limiter.Connections(), "Connection is closed")
+	assert.Nil(t, limiter.Connect("10.0.0.3"), "Host connects after other host disconnects")
+}
+
+func TestLimiterMessages(t *testing.T) {
+	config := DefaultLimits
+	config.PeerMessageRate = 1
+	config.PeerMessageBurst = 2
+	limiter := NewLimiter(config, NewPeerScores())
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	assert.Nil(t, limiter.AllowMessage("10.0.0.1"), "First message")
+	assert.Nil(t, limiter.AllowMessage("10.0.0.1"), "Burst of messages")
+	assert.NotNil(t, limiter.AllowMessage("10.0.0.1"), "Rate of messages is limited")
+	assert.Nil(t, limiter.AllowMessage("10.0.0.2"), "Other host is not limited")
+
+	now = now.Add(time.Second)
+	assert.Nil(t, limiter.AllowMessage("10.0.0.1"), "Message is allowed later")
+}
+
+func TestPeerScoresBan(t *testing.T) {
+	scores := NewPeerScores()
+	now := time.Now()
+	scores.now = func() time.Time { return now }
+
+	assert.False(t, scores.Misbehaving("10.0.0.1", BanThreshold-1, "test"), "Host is not banned yet")
+	assert.False(t, scores.IsBanned("10.0.0.1"), "Host can connect")
+	assert.True(t, scores.Misbehaving("10.0.0.1", 1, "test"), "Host is banned")
+	assert.True(t, scores.IsBanned("10.0.0.1"), "Banned host can't connect")
+
+	limiter := NewLimiter(DefaultLimits, scores)
+	assert.NotNil(t, limiter.Connect("10.0.0.1"), "Connection of banned host is rejected")
+
+	now = now.Add(BanDuration + time.Second)
+	assert.False(t, scores.IsBanned("10.0.0.1"), "Ban expires")
+}
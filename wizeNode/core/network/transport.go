@@ -0,0 +1,170 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+/*
+* Transport opens connections between nodes. TCPTransport is used by real
+* nodes, MemoryTransport connects nodes of one process without sockets
+ */
+type Transport interface {
+	// Opens connection to a node
+	Dial(address NodeAddr) (net.Conn, error)
+	// Starts accepting connections on the node address
+	Listen(address NodeAddr) (net.Listener, error)
+	// Returns host of the node on other side of a connection
+	PeerHost(conn net.Conn) string
+}
+
+// Transport used when other is not set
+var DefaultTransport Transport = TCPTransport{}
+
+// TCPTransport connects nodes over TCP
+type TCPTransport struct{}
+
+func (TCPTransport) Dial(address NodeAddr) (net.Conn, error) {
+	return net.Dial(Protocol, address.String())
+}
+
+func (TCPTransport) Listen(address NodeAddr) (net.Listener, error) {
+	return net.Listen(Protocol, address.String())
+}
+
+func (TCPTransport) PeerHost(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+/*
+* MemoryNetwork connects in-memory transports of nodes. Connections are
+* synchronous pipes, so there are no sockets, ports or timing of OS buffers
+ */
+type MemoryNetwork struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{listeners: make(map[string]*memoryListener)}
+}
+
+// Returns transport of a node with the address in the network
+func (n *MemoryNetwork) Transport(address NodeAddr) *MemoryTransport {
+	return &MemoryTransport{network: n, address: address}
+}
+
+// MemoryTransport is a transport of one node in a memory network
+type MemoryTransport struct {
+	network *MemoryNetwork
+	address NodeAddr
+}
+
+func (t *MemoryTransport) Dial(address NodeAddr) (net.Conn, error) {
+	t.network.mutex.Lock()
+	ln, ok := t.network.listeners[address.String()]
+	t.network.mutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Node %s is not listening", address)
+	}
+
+	local, remote := net.Pipe()
+	localConn := &memoryConn{local, memoryAddr(t.address.String()), memoryAddr(address.String())}
+	remoteConn := &memoryConn{remote, memoryAddr(address.String()), memoryAddr(t.address.String())}
+
+	select {
+	case ln.conns <- remoteConn:
+		return localConn, nil
+	case <-ln.closed:
+		return nil, fmt.Errorf("Node %s is not listening", address)
+	}
+}
+
+func (t *MemoryTransport) Listen(address NodeAddr) (net.Listener, error) {
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+
+	if _, ok := t.network.listeners[address.String()]; ok {
+		return nil, fmt.Errorf("Address %s is already in use", address)
+	}
+
+	ln := &memoryListener{
+		network: t.network,
+		address: address,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	t.network.listeners[address.String()] = ln
+	return ln, nil
+}
+
+func (t *MemoryTransport) PeerHost(conn net.Conn) string {
+	var addr NodeAddr
+	if err := addr.LoadFromString(conn.RemoteAddr().String()); err != nil {
+		return ""
+	}
+	return addr.Host
+}
+
+type memoryListener struct {
+	network *MemoryNetwork
+	address NodeAddr
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("Listener is closed")
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		l.network.mutex.Lock()
+		delete(l.network.listeners, l.address.String())
+		l.network.mutex.Unlock()
+
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(l.address.String())
+}
+
+// Pipe connection which knows addresses of both nodes
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,52 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	memory := NewMemoryNetwork()
+	serverAddr := NodeAddr{"10.0.0.1", 3000}
+	clientAddr := NodeAddr{"10.0.0.2", 3000}
+	server := memory.Transport(serverAddr)
+	client := memory.Transport(clientAddr)
+
+	_, err := client.Dial(serverAddr)
+	assert.NotNil(t, err, "Node is not listening yet")
+
+	ln, err := server.Listen(serverAddr)
+	assert.Nil(t, err, "Node listens")
+	_, err = server.Listen(serverAddr)
+	assert.NotNil(t, err, "Address is in use")
+
+	accepted := make(chan *NodeConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- NewNodeConn(conn)
+	}()
+
+	conn, err := client.Dial(serverAddr)
+	assert.Nil(t, err, "Node is connected")
+	remote := <-accepted
+	assert.Equal(t, "10.0.0.2", server.PeerHost(remote), "Server knows host of client")
+	assert.Equal(t, "10.0.0.1", client.PeerHost(conn), "Client knows host of server")
+
+	go NewNodeConn(conn).WriteMessage([]byte("hello"))
+	message, err := remote.ReadMessage()
+	assert.Nil(t, err, "Message is read")
+	assert.Equal(t, []byte("hello"), message, "Message is received")
+
+	conn.Close()
+	remote.Close()
+	ln.Close()
+	_, err = client.Dial(serverAddr)
+	assert.NotNil(t, err, "Node doesn't listen after close")
+	_, err = ln.Accept()
+	assert.NotNil(t, err, "Closed listener doesn't accept")
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// how often queued transactions are announced
+	TxTrickleInterval = 5 * time.Second
+	// max count of items in one inv message
+	MaxInvPerMessage = 1000
+)
+
+/*
+* InvTrickler collects announcements of transactions for every node and
+* sends them in batches on a timer instead of one connection per transaction
+ */
+type InvTrickler struct {
+	Client *NodeClient
+
+	mutex  sync.Mutex
+	queues map[string]*invQueue
+}
+
+type invQueue struct {
+	addr   NodeAddr
+	items  [][]byte
+	queued map[string]bool
+}
+
+// Creates a trickler which sends inv with the client
+func NewInvTrickler(client *NodeClient) *InvTrickler {
+	return &InvTrickler{
+		Client: client,
+		queues: make(map[string]*invQueue),
+	}
+}
+
+// Sends queued announcements until stop channel is closed
+func (t *InvTrickler) Run(stop chan struct{}) {
+	ticker := time.NewTicker(TxTrickleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			t.Flush()
+		}
+	}
+}
+
+// Queues announcement of a transaction to a node. Duplicates are skipped
+func (t *InvTrickler) Queue(addr NodeAddr, txID []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	queue, ok := t.queues[addr.String()]
+	if !ok {
+		queue = &invQueue{addr: addr, queued: make(map[string]bool)}
+		t.queues[addr.String()] = queue
+	}
+
+	key := hex.EncodeToString(txID)
+	if queue.queued[key] {
+		return
+	}
+	queue.queued[key] = true
+	queue.items = append(queue.items, txID)
+}
+
+// Returns count of transactions queued for a node
+func (t *InvTrickler) Pending(addr NodeAddr) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if queue, ok := t.queues[addr.String()]; ok {
+		return len(queue.items)
+	}
+	return 0
+}
+
+// Sends one inv with queued transactions to every node. Items over
+// the message limit stay in the queue for the next time
+func (t *InvTrickler) Flush() {
+	type batch struct {
+		addr  NodeAddr
+		items [][]byte
+	}
+	batches := []batch{}
+
+	t.mutex.Lock()
+	for key, queue := range t.queues {
+		count := len(queue.items)
+		if count > MaxInvPerMessage {
+			count = MaxInvPerMessage
+		}
+		items := queue.items[:count]
+		for _, item := range items {
+			delete(queue.queued, hex.EncodeToString(item))
+		}
+		queue.items = queue.items[count:]
+		if len(queue.items) == 0 {
+			delete(t.queues, key)
+		}
+		if len(items) > 0 {
+			batches = append(batches, batch{queue.addr, items})
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, b := range batches {
+		t.Client.SendInv(b.addr, "tx", b.items)
+	}
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a node which passes received inv messages to the channel
+func testInvServer(t *testing.T) (NodeAddr, net.Listener, chan ComInv) {
+	ln, err := net.Listen(Protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %+v\n", err)
+	}
+
+	received := make(chan ComInv, 10)
+	go func() {
+		for {
+			rawConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn := NewNodeConn(rawConn)
+			request, err := conn.ReadMessage()
+			conn.Close()
+			if err != nil {
+				continue
+			}
+			var inv ComInv
+			gob.NewDecoder(bytes.NewReader(request[CommandLength:])).Decode(&inv)
+			received <- inv
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return NodeAddr{"127.0.0.1", addr.Port}, ln, received
+}
+
+func TestInvTrickler(t *testing.T) {
+	addr, ln, received := testInvServer(t)
+	defer ln.Close()
+
+	trickler := NewInvTrickler(&NodeClient{NodeAddress: NodeAddr{"127.0.0.1", 1}})
+	for i := 0; i < MaxInvPerMessage+10; i++ {
+		trickler.Queue(addr, []byte(fmt.Sprintf("tx%d", i)))
+	}
+	trickler.Queue(addr, []byte("tx0"))
+	assert.Equal(t, MaxInvPerMessage+10, trickler.Pending(addr), "Duplicates are not queued")
+
+	trickler.Flush()
+	inv := <-received
+	assert.Equal(t, "tx", inv.Type, "Transactions are announced")
+	assert.Equal(t, MaxInvPerMessage, len(inv.Items), "Batch is limited")
+	assert.Equal(t, 10, trickler.Pending(addr), "Rest of items wait for next time")
+
+	trickler.Flush()
+	inv = <-received
+	assert.Equal(t, 10, len(inv.Items), "Rest of items are announced")
+	assert.Equal(t, 0, trickler.Pending(addr), "Queue is empty")
+}
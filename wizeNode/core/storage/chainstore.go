@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"bytes"
+)
+
+const (
+	blocksBucket = "blocks"
+	utxoBucket   = "chainstate"
+	indexPrefix  = "index_"
+)
+
+// key of the tip hash in blocks bucket
+var tipKey = []byte("l")
+
+/*
+* ChainStore keeps blocks, the tip, the UTXO set and indexes of a blockchain.
+* Blocks and outputs are kept serialized, so any Store can be used for it
+ */
+type ChainStore interface {
+	// View runs fn with a consistent view of the chain
+	View(fn func(r ChainReader) error) error
+	// Update runs fn in a batch, all its changes are saved or none if fn fails
+	Update(fn func(b ChainBatch) error) error
+	Close() error
+}
+
+// ChainReader reads chain data. Returned values are valid only inside a view or a batch
+type ChainReader interface {
+	// Block returns a serialized block, nil if it is not found
+	Block(hash []byte) []byte
+	// ForEachBlock calls fn for all saved blocks, including ones out of the best chain
+	ForEachBlock(fn func(hash, block []byte) error) error
+	// Tip returns hash of the last block, nil if the chain is empty
+	Tip() []byte
+	// UTXO returns a serialized unspent output by its outpoint key, nil if it is spent
+	UTXO(outpoint []byte) []byte
+	ForEachUTXO(fn func(outpoint, entry []byte) error) error
+	// Index returns a value of a named index, e.g. transactions by ID
+	Index(name string, key []byte) []byte
+	ForEachIndex(name string, fn func(key, value []byte) error) error
+}
+
+// ChainBatch changes chain data, it sees its own changes
+type ChainBatch interface {
+	ChainReader
+
+	PutBlock(hash, block []byte) error
+	// DeleteBlock removes a block body, e.g. when the chain is pruned
+	DeleteBlock(hash []byte) error
+	SetTip(hash []byte) error
+	PutUTXO(outpoint, entry []byte) error
+	DeleteUTXO(outpoint []byte) error
+	// ClearUTXO removes the whole UTXO set, e.g. before reindex
+	ClearUTXO() error
+	PutIndex(name string, key, value []byte) error
+	DeleteIndex(name string, key []byte) error
+	ClearIndex(name string) error
+}
+
+// NewChainStore keeps chain data in the store
+func NewChainStore(store Store) ChainStore {
+	return &chainStore{store}
+}
+
+// OpenBoltChainStore opens the chain DB file
+func OpenBoltChainStore(path string) (ChainStore, error) {
+	store, err := OpenBolt(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return NewChainStore(store), nil
+}
+
+// NewMemoryChainStore creates an empty chain store in memory
+func NewMemoryChainStore() ChainStore {
+	return NewChainStore(NewMemoryStore())
+}
+
+type chainStore struct {
+	store Store
+}
+
+func (s *chainStore) View(fn func(r ChainReader) error) error {
+	return s.store.View(func(tx Tx) error {
+		return fn(chainTx{tx})
+	})
+}
+
+func (s *chainStore) Update(fn func(b ChainBatch) error) error {
+	return s.store.Update(func(tx Tx) error {
+		return fn(chainTx{tx})
+	})
+}
+
+func (s *chainStore) Close() error {
+	return s.store.Close()
+}
+
+type chainTx struct {
+	tx Tx
+}
+
+func (t chainTx) Block(hash []byte) []byte {
+	return t.tx.Get(blocksBucket, hash)
+}
+
+func (t chainTx) ForEachBlock(fn func(hash, block []byte) error) error {
+	return t.tx.ForEach(blocksBucket, func(k, v []byte) error {
+		if bytes.Equal(k, tipKey) {
+			return nil
+		}
+		return fn(k, v)
+	})
+}
+
+func (t chainTx) Tip() []byte {
+	return t.tx.Get(blocksBucket, tipKey)
+}
+
+func (t chainTx) UTXO(outpoint []byte) []byte {
+	return t.tx.Get(utxoBucket, outpoint)
+}
+
+func (t chainTx) ForEachUTXO(fn func(outpoint, entry []byte) error) error {
+	return t.tx.ForEach(utxoBucket, fn)
+}
+
+func (t chainTx) Index(name string, key []byte) []byte {
+	return t.tx.Get(indexPrefix+name, key)
+}
+
+func (t chainTx) ForEachIndex(name string, fn func(key, value []byte) error) error {
+	return t.tx.ForEach(indexPrefix+name, fn)
+}
+
+func (t chainTx) PutBlock(hash, block []byte) error {
+	return t.tx.Put(blocksBucket, hash, block)
+}
+
+func (t chainTx) DeleteBlock(hash []byte) error {
+	return t.tx.Delete(blocksBucket, hash)
+}
+
+func (t chainTx) SetTip(hash []byte) error {
+	return t.tx.Put(blocksBucket, tipKey, hash)
+}
+
+func (t chainTx) PutUTXO(outpoint, entry []byte) error {
+	return t.tx.Put(utxoBucket, outpoint, entry)
+}
+
+func (t chainTx) DeleteUTXO(outpoint []byte) error {
+	return t.tx.Delete(utxoBucket, outpoint)
+}
+
+func (t chainTx) ClearUTXO() error {
+	return t.tx.DeleteBucket(utxoBucket)
+}
+
+func (t chainTx) PutIndex(name string, key, value []byte) error {
+	return t.tx.Put(indexPrefix+name, key, value)
+}
+
+func (t chainTx) DeleteIndex(name string, key []byte) error {
+	return t.tx.Delete(indexPrefix+name, key)
+}
+
+func (t chainTx) ClearIndex(name string) error {
+	return t.tx.DeleteBucket(indexPrefix + name)
+}
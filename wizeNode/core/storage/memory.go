@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+/*
+* MemoryStore keeps data in maps and is used by tests. Changes of an update
+* are collected aside and applied only when it succeeds, updates are run
+* one by one like in Bolt. Committed buckets are copied on write, so a
+* transaction reads the buckets it started with
+ */
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	writer  sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryStore) View(fn func(tx Tx) error) error {
+	return fn(&memoryTx{buckets: s.snapshot()})
+}
+
+func (s *MemoryStore) Update(fn func(tx Tx) error) error {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+
+	tx := &memoryTx{
+		buckets:  s.snapshot(),
+		writable: true,
+		writes:   make(map[string]map[string][]byte),
+		cleared:  make(map[string]bool),
+	}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	buckets := make(map[string]map[string][]byte, len(tx.buckets))
+	for bucket, b := range tx.buckets {
+		if !tx.cleared[bucket] {
+			buckets[bucket] = b
+		}
+	}
+	for bucket, writes := range tx.writes {
+		b := make(map[string][]byte, len(buckets[bucket])+len(writes))
+		for key, value := range buckets[bucket] {
+			b[key] = value
+		}
+		for key, value := range writes {
+			if value == nil {
+				delete(b, key)
+			} else {
+				b[key] = value
+			}
+		}
+		buckets[bucket] = b
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.buckets = buckets
+	return nil
+}
+
+// Returns committed buckets, they are never changed
+func (s *MemoryStore) snapshot() map[string]map[string][]byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.buckets
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Changes of a memory transaction, nil value is a deleted key
+type memoryTx struct {
+	buckets  map[string]map[string][]byte
+	writable bool
+	writes   map[string]map[string][]byte
+	cleared  map[string]bool
+}
+
+func (t *memoryTx) Get(bucket string, key []byte) []byte {
+	if value, ok := t.writes[bucket][string(key)]; ok {
+		return value
+	}
+	if t.cleared[bucket] {
+		return nil
+	}
+	return t.buckets[bucket][string(key)]
+}
+
+// Returns the bucket with changes of the transaction
+func (t *memoryTx) bucket(bucket string) map[string][]byte {
+	b := make(map[string][]byte)
+	if !t.cleared[bucket] {
+		for key, value := range t.buckets[bucket] {
+			b[key] = value
+		}
+	}
+	for key, value := range t.writes[bucket] {
+		if value == nil {
+			delete(b, key)
+		} else {
+			b[key] = value
+		}
+	}
+	return b
+}
+
+func (t *memoryTx) ForEach(bucket string, fn func(key, value []byte) error) error {
+	b := t.bucket(bucket)
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		err := fn([]byte(key), b[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTx) Last(bucket string) ([]byte, []byte) {
+	var last string
+	b := t.bucket(bucket)
+	if len(b) == 0 {
+		return nil, nil
+	}
+	for key := range b {
+		if key > last {
+			last = key
+		}
+	}
+	return []byte(last), b[last]
+}
+
+func (t *memoryTx) Put(bucket string, key, value []byte) error {
+	if !t.writable {
+		return errors.New("Transaction is read-only")
+	}
+	if t.writes[bucket] == nil {
+		t.writes[bucket] = make(map[string][]byte)
+	}
+	t.writes[bucket][string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memoryTx) Delete(bucket string, key []byte) error {
+	if !t.writable {
+		return errors.New("Transaction is read-only")
+	}
+	if t.writes[bucket] == nil {
+		t.writes[bucket] = make(map[string][]byte)
+	}
+	t.writes[bucket][string(key)] = nil
+	return nil
+}
+
+func (t *memoryTx) DeleteBucket(bucket string) error {
+	if !t.writable {
+		return errors.New("Transaction is read-only")
+	}
+	t.cleared[bucket] = true
+	delete(t.writes, bucket)
+	return nil
+}
@@ -0,0 +1,31 @@
+package storage
+
+/*
+* Store is a key-value storage with named buckets. Nodes keep the chain,
+* the nodes list and the light chain in stores, so the DB engine is used
+* only by implementations of this package (Bolt and memory ones)
+ */
+type Store interface {
+	// View runs a read-only transaction
+	View(fn func(tx Tx) error) error
+	// Update runs a transaction which changes are saved only if fn returns nil
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+/*
+* Tx is a transaction of a store. Values returned by a transaction are
+* valid only until it ends, they should be copied to be used later.
+* Buckets are created on the first write, missing buckets are empty
+ */
+type Tx interface {
+	Get(bucket string, key []byte) []byte
+	// ForEach calls fn for every key of the bucket in ascending order
+	ForEach(bucket string, fn func(key, value []byte) error) error
+	// Last returns the greatest key of the bucket, nil if it is empty
+	Last(bucket string) (key, value []byte)
+
+	Put(bucket string, key, value []byte) error
+	Delete(bucket string, key []byte) error
+	DeleteBucket(bucket string) error
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs the test with Bolt and memory stores
+func testStores(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("bolt", func(t *testing.T) {
+		store, err := OpenBolt(filepath.Join(t.TempDir(), "test.db"), 0)
+		if err != nil {
+			t.Fatalf("Error: %+v\n", err)
+		}
+		defer store.Close()
+		test(t, store)
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+}
+
+func TestStore(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		err := store.Update(func(tx Tx) error {
+			assert.Nil(t, tx.Get("numbers", []byte("1")), "Missing bucket is empty")
+			tx.Put("numbers", []byte("3"), []byte("three"))
+			tx.Put("numbers", []byte("1"), []byte("one"))
+			tx.Put("numbers", []byte("2"), []byte("two"))
+			assert.Equal(t, []byte("one"), tx.Get("numbers", []byte("1")), "Batch sees own changes")
+			return tx.Delete("numbers", []byte("2"))
+		})
+		assert.Nil(t, err, "Update is saved")
+
+		store.View(func(tx Tx) error {
+			keys := []string{}
+			tx.ForEach("numbers", func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+			assert.Equal(t, []string{"1", "3"}, keys, "Keys are in ascending order")
+
+			k, v := tx.Last("numbers")
+			assert.Equal(t, []byte("3"), k, "Last key")
+			assert.Equal(t, []byte("three"), v, "Last value")
+			assert.NotNil(t, tx.Put("numbers", []byte("4"), []byte("four")), "View can't change data")
+			return nil
+		})
+
+		err = store.Update(func(tx Tx) error {
+			tx.DeleteBucket("numbers")
+			tx.Put("numbers", []byte("4"), []byte("four"))
+			return errors.New("failed")
+		})
+		assert.NotNil(t, err, "Update fails")
+		store.View(func(tx Tx) error {
+			assert.Equal(t, []byte("one"), tx.Get("numbers", []byte("1")), "Failed update is not saved")
+			assert.Nil(t, tx.Get("numbers", []byte("4")), "Failed update is not saved")
+			return nil
+		})
+
+		store.Update(func(tx Tx) error {
+			return tx.DeleteBucket("numbers")
+		})
+		store.View(func(tx Tx) error {
+			k, _ := tx.Last("numbers")
+			assert.Nil(t, k, "Deleted bucket is empty")
+			return nil
+		})
+	})
+}
+
+func TestMemoryStoreViewIsConsistent(t *testing.T) {
+	store := NewMemoryStore()
+	store.Update(func(tx Tx) error {
+		tx.Put("numbers", []byte("1"), []byte("one"))
+		return tx.Put("numbers", []byte("2"), []byte("two"))
+	})
+
+	store.View(func(tx Tx) error {
+		assert.Equal(t, []byte("one"), tx.Get("numbers", []byte("1")), "View reads saved value")
+
+		// update committed during the view doesn't wait for it and isn't seen by it
+		err := store.Update(func(tx Tx) error {
+			tx.Put("numbers", []byte("1"), []byte("first"))
+			return tx.Delete("numbers", []byte("2"))
+		})
+		assert.Nil(t, err, "Update is saved")
+
+		assert.Equal(t, []byte("one"), tx.Get("numbers", []byte("1")), "View reads the same value")
+		assert.Equal(t, []byte("two"), tx.Get("numbers", []byte("2")), "View reads deleted value")
+		return nil
+	})
+
+	store.View(func(tx Tx) error {
+		assert.Equal(t, []byte("first"), tx.Get("numbers", []byte("1")), "New view reads changed value")
+		assert.Nil(t, tx.Get("numbers", []byte("2")), "New view doesn't read deleted value")
+		return nil
+	})
+}
+
+func TestChainStore(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		chain := NewChainStore(store)
+
+		err := chain.Update(func(b ChainBatch) error {
+			b.PutBlock([]byte("hash"), []byte("block"))
+			b.SetTip([]byte("hash"))
+			b.PutUTXO([]byte("tx1"), []byte("outs1"))
+			b.PutUTXO([]byte("tx2"), []byte("outs2"))
+			b.PutIndex("txs", []byte("tx1"), []byte("hash"))
+			return b.DeleteUTXO([]byte("tx1"))
+		})
+		assert.Nil(t, err, "Batch is saved")
+
+		chain.View(func(r ChainReader) error {
+			assert.Equal(t, []byte("block"), r.Block([]byte("hash")), "Block is saved")
+			assert.Equal(t, []byte("hash"), r.Tip(), "Tip is saved")
+			assert.Nil(t, r.UTXO([]byte("tx1")), "Spent outputs are removed")
+			assert.Equal(t, []byte("outs2"), r.UTXO([]byte("tx2")), "Unspent outputs are kept")
+			assert.Equal(t, []byte("hash"), r.Index("txs", []byte("tx1")), "Index is saved")
+			return nil
+		})
+
+		chain.Update(func(b ChainBatch) error {
+			b.DeleteBlock([]byte("hash"))
+			return b.ClearUTXO()
+		})
+		count := 0
+		chain.View(func(r ChainReader) error {
+			return r.ForEachUTXO(func(txID, outputs []byte) error {
+				count++
+				return nil
+			})
+		})
+		assert.Equal(t, 0, count, "UTXO set is cleared")
+		chain.View(func(r ChainReader) error {
+			assert.Nil(t, r.Block([]byte("hash")), "Block is deleted")
+			return nil
+		})
+	})
+}
@@ -0,0 +1,44 @@
+package wallet
+
+import (
+	"fmt"
+
+	"wizeBlock/wizeNode/core/crypto"
+)
+
+/*
+* FilterMatcher checks compact block filters against addresses and outputs
+* of a wallet. A matched block probably pays to or spends from the wallet
+* and should be downloaded, other blocks can be skipped
+ */
+type FilterMatcher struct {
+	elements [][]byte
+}
+
+// NewFilterMatcher creates a matcher of the addresses
+func NewFilterMatcher(addresses []string) (*FilterMatcher, error) {
+	m := &FilterMatcher{}
+	for _, address := range addresses {
+		if !crypto.ValidateAddress(address) {
+			return nil, fmt.Errorf("Address %s is not valid", address)
+		}
+		m.AddPubKeyHash(crypto.GetPubKeyHash(address))
+	}
+
+	return m, nil
+}
+
+// Watches outputs paying to the pubkey hash
+func (m *FilterMatcher) AddPubKeyHash(pubKeyHash []byte) {
+	m.elements = append(m.elements, pubKeyHash)
+}
+
+// Watches spending of the transaction output
+func (m *FilterMatcher) AddOutpoint(txID []byte, vout int) {
+	m.elements = append(m.elements, crypto.OutpointFilterElement(txID, vout))
+}
+
+// Returns true if the filter of the block probably matches watched elements
+func (m *FilterMatcher) Match(blockHash, filter []byte) (bool, error) {
+	return crypto.MatchGCSFilter(filter, crypto.BlockFilterKey(blockHash), m.elements)
+}
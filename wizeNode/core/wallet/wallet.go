@@ -27,7 +27,7 @@ func CreateWallet(privateKey []byte) (*Wallet, error) {
 		fmt.Printf("Cant generate keys: %s", err)
 		return nil, err
 	}
-	public := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	public := crypto.SerializePublicKey(&private.PublicKey)
 	wallet := Wallet{*private, public}
 
 	return &wallet, nil
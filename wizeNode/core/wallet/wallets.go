@@ -8,12 +8,15 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+
+	"wizeBlock/wizeNode/core/chaincfg"
 )
 
 // FIXME: wallet.dat should be only for central nodes (masternode?) and miner nodes(?)
 // NOW: admin (master) wallet/address
 // NOW: miner wallet/address
-const walletFile = "files/wallet%s/wallet.dat"
+const walletFile = "wallet%s/wallet.dat"
 
 // USECASE: just for deprecated functions like
 // REST: deprecatedWalletCreate
@@ -32,7 +35,7 @@ type Wallets struct {
 func NewWallets(nodeID string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
-	wallets.walletFile = walletFile
+	wallets.walletFile = chaincfg.Active.DataDir + walletFile
 
 	err := wallets.LoadFromFile(nodeID)
 
@@ -116,6 +119,11 @@ func (ws Wallets) SaveToFile(nodeID string) {
 		log.Panic(err)
 	}
 
+	err = os.MkdirAll(filepath.Dir(walletFile), 0700)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
 	if err != nil {
 		log.Panic(err)
@@ -0,0 +1,517 @@
+package node
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"wizeBlock/wizeNode/core/blockchain"
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/crypto"
+	"wizeBlock/wizeNode/core/log"
+	"wizeBlock/wizeNode/core/network"
+	"wizeBlock/wizeNode/core/wallet"
+)
+
+// How often a light node syncs with full nodes
+const lightSyncInterval = 10 * time.Second
+
+/*
+* LightNode keeps only block headers and transactions of watched addresses.
+* It doesn't accept connections: headers, compact filters and matched
+* blocks are requested from full nodes and answers are read from the same
+* connection. Transactions are signed by owners of the addresses like with
+* prepare/sign API of full nodes
+ */
+type LightNode struct {
+	NodeID  string
+	Network network.NodeNetwork
+	Client  *network.NodeClient
+
+	apiAddr string
+	rest    *LightRestServer
+
+	chain *blockchain.LightChain
+	// only one sync runs at a time
+	syncMutex sync.Mutex
+
+	// guards pending and prepared transactions
+	mutex sync.Mutex
+	// sent transactions not found in blocks yet, their inputs are not spent again
+	pending     map[string]blockchain.Transaction
+	preparedTxs map[string]*PreparedTransaction
+}
+
+// Creates a light node watching the addresses and addresses of the node wallet
+func NewLightNode(nodeID, apiAddr string, watch []string) (*LightNode, error) {
+	chain, err := blockchain.NewLightChain(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := append([]string{}, watch...)
+	wallets, err := wallet.NewWallets(nodeID)
+	if err == nil {
+		addresses = append(addresses, wallets.GetAddresses()...)
+	}
+	err = chain.Watch(addresses)
+	if err != nil {
+		chain.Close()
+		return nil, err
+	}
+
+	node := &LightNode{
+		NodeID:      nodeID,
+		apiAddr:     apiAddr,
+		chain:       chain,
+		pending:     make(map[string]blockchain.Transaction),
+		preparedTxs: make(map[string]*PreparedTransaction),
+	}
+	node.Network.SetExtraManager(NodesListStorage{chaincfg.DataPath("db%s/", nodeID)})
+	node.Client = &network.NodeClient{Network: &node.Network}
+	node.rest = NewLightRestServer(node, apiAddr)
+
+	return node, nil
+}
+
+/*
+* Sets full nodes to sync with. If the list is empty nodes are loaded from
+* local storage or from the initial nodes list
+ */
+func (node *LightNode) InitNetwork(list []network.NodeAddr) {
+	if len(list) > 0 {
+		node.Network.SetNodes(list, true)
+		return
+	}
+
+	node.Network.LoadNodes()
+	if node.Network.GetCountOfKnownNodes() == 0 {
+		node.Network.LoadInitialNodes(network.NodeAddr{})
+	}
+}
+
+// Enables encrypted and authenticated connections with full nodes
+func (node *LightNode) SetupSecurity(allowedKeys []string) error {
+	identity, err := LoadNodeIdentity(node.NodeID)
+	if err != nil {
+		return err
+	}
+
+	keys, err := network.ParseAllowedKeys(allowedKeys)
+	if err != nil {
+		return err
+	}
+
+	node.Client.Security = &network.TransportSecurity{
+		Identity:    identity,
+		AllowedKeys: keys,
+	}
+	return nil
+}
+
+// Sets transport used to talk with full nodes
+func (node *LightNode) SetTransport(transport network.Transport) {
+	node.Client.Transport = transport
+}
+
+// Syncs headers and wallet transactions with the first full node which answers
+func (node *LightNode) Sync() error {
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	err := errors.New("There are no known full nodes")
+	for _, peer := range node.Network.GetNodes() {
+		err = node.syncHeaders(peer)
+		if err == nil {
+			err = node.scanBlocks(peer)
+		}
+		if err == nil {
+			node.dropConfirmed()
+			return nil
+		}
+		log.Warn.Printf("Sync with %s failed: %s", peer, err)
+	}
+	return err
+}
+
+// Returns sum of unspent outputs of a watched address
+func (node *LightNode) Balance(address string) (int, error) {
+	if !node.chain.IsWatched(address) {
+		return 0, fmt.Errorf("Address %s is not watched", address)
+	}
+
+	outputs, err := node.chain.UnspentOutputs(crypto.GetPubKeyHash(address))
+	if err != nil {
+		return 0, err
+	}
+
+	balance := 0
+	for _, out := range outputs {
+		balance += out.Output.Value
+	}
+	return balance, nil
+}
+
+/*
+* Builds transaction from unspent outputs of a watched address which are not
+* spent by pending transactions. Returns hashes the owner of the address signs
+ */
+func (node *LightNode) Prepare(from, to string, amount int, pubKey []byte) (*blockchain.TransactionToSign, error) {
+	if !crypto.ValidateAddress(to) {
+		return nil, errors.New("Recipient address is not valid")
+	}
+	if !node.chain.IsWatched(from) {
+		return nil, fmt.Errorf("Address %s is not watched", from)
+	}
+	pubKeyHash := crypto.GetPubKeyHash(from)
+	if !bytes.Equal(crypto.HashPubKey(pubKey), pubKeyHash) {
+		return nil, errors.New("Public key doesn't match sender address")
+	}
+
+	outputs, err := node.chain.UnspentOutputs(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	spent := node.pendingOutpoints()
+	inputs := []blockchain.TXInput{}
+	prevTXs := make(map[string]blockchain.Transaction)
+	acc := 0
+	for _, out := range outputs {
+		if acc >= amount {
+			break
+		}
+		if spent[string(crypto.OutpointFilterElement(out.TxID, out.Index))] {
+			continue
+		}
+		prevTX, err := node.chain.FindTransaction(out.TxID)
+		if err != nil {
+			return nil, err
+		}
+		prevTXs[hex.EncodeToString(out.TxID)] = prevTX
+		inputs = append(inputs, blockchain.TXInput{out.TxID, out.Index, nil, pubKey, 0})
+		acc += out.Output.Value
+	}
+	if acc < amount {
+		return nil, errors.New("Not enough funds")
+	}
+
+	outs := []blockchain.TXOutput{*blockchain.NewTXOutput(amount, to)}
+	if acc > amount {
+		// a change
+		outs = append(outs, *blockchain.NewTXOutput(acc-amount, from))
+	}
+	tx := blockchain.Transaction{time.Now().UnixNano(), nil, inputs, outs, 0}
+	tx.ID = tx.Hash()
+
+	txToSign, err := tx.PrepareToSign(prevTXs)
+	if err != nil {
+		return nil, err
+	}
+	node.preparedTxs[hex.EncodeToString(txToSign.TxID)] = &PreparedTransaction{from, &tx}
+
+	return txToSign, nil
+}
+
+// Signs prepared transaction and sends it to full nodes
+func (node *LightNode) Sign(txid string, signatures []string) (*blockchain.Transaction, error) {
+	node.mutex.Lock()
+	prepared, ok := node.preparedTxs[txid]
+	delete(node.preparedTxs, txid)
+	node.mutex.Unlock()
+
+	if !ok {
+		return nil, errors.New("Could not get transaction by txid")
+	}
+	TxID, err := hex.DecodeString(txid)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := prepared.Transaction
+	if len(signatures) != len(tx.Vin) {
+		return nil, fmt.Errorf("Transaction has %d inputs, %d signatures are given", len(tx.Vin), len(signatures))
+	}
+	prevTXs := make(map[string]blockchain.Transaction)
+	for _, in := range tx.Vin {
+		prevTX, err := node.chain.FindTransaction(in.Txid)
+		if err != nil {
+			return nil, err
+		}
+		prevTXs[hex.EncodeToString(in.Txid)] = prevTX
+	}
+
+	err = tx.SignPrepared(&blockchain.TransactionWithSignatures{TxID, signatures}, prevTXs)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := tx.Verify(prevTXs)
+	if !valid || err != nil {
+		return nil, errors.New("Signatures are not valid")
+	}
+
+	node.mutex.Lock()
+	node.pending[hex.EncodeToString(tx.ID)] = *tx
+	node.mutex.Unlock()
+
+	sent := 0
+	for _, peer := range node.Network.GetNodes() {
+		if node.Client.SendTx(peer, tx) == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return nil, errors.New("Transaction is not sent, full nodes are not available")
+	}
+	log.Info.Printf("Transaction %x is sent to %d nodes", tx.ID, sent)
+
+	return tx, nil
+}
+
+// Syncs and serves REST API until the node is stopped
+func (node *LightNode) Run() {
+	log.Info.Printf("Light node %s, apiAddr: %s, watched addresses: %d", node.NodeID, node.apiAddr, len(node.chain.Watched()))
+
+	if err := node.rest.Start(); err != nil {
+		log.Fatal.Printf("Failed to start HTTP service: %s", err)
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM, os.Interrupt)
+	ticker := time.NewTicker(lightSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := node.Sync(); err != nil {
+			log.Warn.Printf("Sync failed: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-signalCh:
+			log.Info.Println("Stop light node")
+			node.rest.Close()
+			node.chain.Close()
+			return
+		}
+	}
+}
+
+// Requests headers after the best header of the light chain until the full node has no more
+func (node *LightNode) syncHeaders(peer network.NodeAddr) error {
+	for {
+		var payload network.ComHeaders
+		err := node.request(peer, "getheaders", &network.ComGetHeaders{Locator: node.chain.Locator()}, "headers", &payload)
+		if err != nil {
+			return err
+		}
+
+		added, err := node.chain.AddHeaders(payload.Headers)
+		if err != nil {
+			return err
+		}
+		if added > 0 {
+			log.Info.Printf("Synced %d headers from %s, height %d", added, peer, node.chain.Height())
+		}
+		if added == 0 || len(payload.Headers) < network.MaxHeadersPerMessage {
+			return nil
+		}
+	}
+}
+
+/*
+* Requests compact filters of blocks after the scanned height and downloads
+* blocks matching the watched addresses and their unspent outputs
+ */
+func (node *LightNode) scanBlocks(peer network.NodeAddr) error {
+	height := node.chain.Height()
+	scan, err := node.newWalletScan()
+	if err != nil {
+		return err
+	}
+
+	for from := node.chain.ScannedHeight() + 1; from <= height; from += network.MaxInvPerMessage {
+		headers := []blockchain.BlockHeader{}
+		hashes := [][]byte{}
+		for h := from; h <= height && h < from+network.MaxInvPerMessage; h++ {
+			header, err := node.chain.HeaderAt(h)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+			hashes = append(hashes, header.Hash)
+		}
+
+		var payload network.ComCFilters
+		err := node.request(peer, "getcfilters", &network.ComGetCFilters{BlockHashes: hashes}, "cfilters", &payload)
+		if err != nil {
+			return err
+		}
+		if len(payload.Filters) != len(headers) {
+			return fmt.Errorf("Node returned %d filters of %d", len(payload.Filters), len(headers))
+		}
+
+		found := []blockchain.WalletTransaction{}
+		for i, filter := range payload.Filters {
+			if !bytes.Equal(filter.BlockHash, hashes[i]) {
+				return fmt.Errorf("Node returned filter of other block %x", filter.BlockHash)
+			}
+			match, err := scan.matcher.Match(filter.BlockHash, filter.Filter)
+			if err != nil {
+				return err
+			}
+			if !match {
+				continue
+			}
+
+			block, err := node.getBlock(peer, headers[i])
+			if err != nil {
+				return err
+			}
+			found = append(found, scan.blockTransactions(block)...)
+		}
+
+		last := headers[len(headers)-1].Height
+		err = node.chain.AddScanned(last, found)
+		if err != nil {
+			return err
+		}
+		if len(found) > 0 {
+			log.Info.Printf("Found %d wallet transactions up to height %d", len(found), last)
+		}
+	}
+	return nil
+}
+
+// Downloads a block and checks it matches the header of the light chain
+func (node *LightNode) getBlock(peer network.NodeAddr, header blockchain.BlockHeader) (*blockchain.Block, error) {
+	var payload network.ComBlock
+	err := node.request(peer, "getdata", &network.ComGetData{Type: "block", Items: [][]byte{header.Hash}}, "block", &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := blockchain.DeserializeBlock(payload.Block)
+	if err != nil {
+		return nil, err
+	}
+	// header of received block has merkle root of its transactions
+	received := block.Header()
+	if !bytes.Equal(received.Hash, header.Hash) || received.Validate() != nil {
+		return nil, fmt.Errorf("Block %x doesn't match its header", header.Hash)
+	}
+	return block, nil
+}
+
+// Sends request to a full node and decodes its answer
+func (node *LightNode) request(peer network.NodeAddr, command string, data interface{}, answer string, payload interface{}) error {
+	command, response, err := node.Client.Request(peer, command, data)
+	if err != nil {
+		return err
+	}
+	if command != answer {
+		return fmt.Errorf("Unexpected answer %s from %s", command, peer)
+	}
+	return gob.NewDecoder(bytes.NewReader(response)).Decode(payload)
+}
+
+// Returns outpoints spent by pending transactions
+func (node *LightNode) pendingOutpoints() map[string]bool {
+	spent := make(map[string]bool)
+	for _, tx := range node.pending {
+		for _, in := range tx.Vin {
+			spent[string(crypto.OutpointFilterElement(in.Txid, in.Vout))] = true
+		}
+	}
+	return spent
+}
+
+// Forgets pending transactions found in blocks
+func (node *LightNode) dropConfirmed() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	for id, tx := range node.pending {
+		if _, err := node.chain.FindTransaction(tx.ID); err == nil {
+			delete(node.pending, id)
+		}
+	}
+}
+
+// State of scanning blocks for wallet transactions
+type walletScan struct {
+	pubKeyHashes map[string]bool
+	outpoints    map[string]bool
+	matcher      *wallet.FilterMatcher
+}
+
+// Returns scan matching the watched addresses and their unspent outputs
+func (node *LightNode) newWalletScan() (*walletScan, error) {
+	addresses := node.chain.Watched()
+	matcher, err := wallet.NewFilterMatcher(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := &walletScan{
+		pubKeyHashes: make(map[string]bool),
+		outpoints:    make(map[string]bool),
+		matcher:      matcher,
+	}
+	for _, address := range addresses {
+		pubKeyHash := crypto.GetPubKeyHash(address)
+		scan.pubKeyHashes[string(pubKeyHash)] = true
+
+		outputs, err := node.chain.UnspentOutputs(pubKeyHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, out := range outputs {
+			scan.addOutpoint(out.TxID, out.Index)
+		}
+	}
+	return scan, nil
+}
+
+func (scan *walletScan) addOutpoint(txID []byte, index int) {
+	scan.outpoints[string(crypto.OutpointFilterElement(txID, index))] = true
+	scan.matcher.AddOutpoint(txID, index)
+}
+
+// Returns transactions of the block paying to or spending from the wallet
+func (scan *walletScan) blockTransactions(block *blockchain.Block) []blockchain.WalletTransaction {
+	found := []blockchain.WalletTransaction{}
+
+	for _, tx := range block.Transactions {
+		relevant := false
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Vin {
+				if scan.outpoints[string(crypto.OutpointFilterElement(in.Txid, in.Vout))] {
+					relevant = true
+				}
+			}
+		}
+		for i, out := range tx.Vout {
+			if scan.pubKeyHashes[string(out.PubKeyHash)] {
+				relevant = true
+				// spending of the output is matched in next blocks
+				scan.addOutpoint(tx.ID, i)
+			}
+		}
+
+		if relevant {
+			found = append(found, blockchain.WalletTransaction{block.Hash, *tx})
+		}
+	}
+	return found
+}
@@ -0,0 +1,163 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/cors"
+	"github.com/urfave/negroni"
+)
+
+/*
+* LightRestServer provides subset of HTTP API of a full node for a light
+* node: balance of watched addresses and sending of transactions
+ */
+type LightRestServer struct {
+	node *LightNode
+	addr string
+	ln   net.Listener
+}
+
+func NewLightRestServer(node *LightNode, addr string) *LightRestServer {
+	return &LightRestServer{
+		node: node,
+		addr: addr,
+	}
+}
+
+// Start starts the service.
+func (s *LightRestServer) Start() error {
+	router := mux.NewRouter().StrictSlash(false)
+
+	router.HandleFunc("/", s.sayHello)
+	router.HandleFunc("/wallet/{hash}", s.getWallet).Methods("GET")
+
+	// send transaction steps: prepare/sign
+	router.HandleFunc("/prepare", s.prepare).Methods("POST")
+	router.HandleFunc("/sign", s.sign).Methods("POST")
+
+	corsHandler := cors.AllowAll().Handler(router)
+	n := negroni.Classic()
+	n.UseHandler(corsHandler)
+
+	server := http.Server{
+		Handler: n,
+		Addr:    s.addr,
+	}
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	go func() {
+		err := server.Serve(s.ln)
+		if err != nil {
+			log.Printf("HTTP serve: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// Close closes the service.
+func (s *LightRestServer) Close() {
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+func (s *LightRestServer) sayHello(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, "Hello wize light node "+s.node.NodeID)
+}
+
+func (s *LightRestServer) getWallet(w http.ResponseWriter, r *http.Request) {
+	balance, err := s.node.Balance(mux.Vars(r)["hash"])
+	if err != nil {
+		sendErrorMessage(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"credit":  balance,
+		"height":  s.node.chain.Height(),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (s *LightRestServer) prepare(w http.ResponseWriter, r *http.Request) {
+	var prepare Prepare
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "Failed to read the request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &prepare); err != nil {
+		sendErrorMessage(w, "Could not decode the request body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	if prepare.From == "" || prepare.To == "" || prepare.Amount <= 0 || prepare.From == prepare.To {
+		sendErrorMessage(w, "Please check your prepare request", http.StatusBadRequest)
+		return
+	}
+	pubKey, err := hex.DecodeString(prepare.PubKey)
+	if err != nil {
+		sendErrorMessage(w, "Public key is not valid", http.StatusBadRequest)
+		return
+	}
+
+	txToSign, err := s.node.Prepare(prepare.From, prepare.To, prepare.Amount, pubKey)
+	if err != nil {
+		sendErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"txid":    hex.EncodeToString(txToSign.TxID),
+		"hashes":  txToSign.HashesToSign,
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (s *LightRestServer) sign(w http.ResponseWriter, r *http.Request) {
+	var sign Sign
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "Failed to read the request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &sign); err != nil {
+		sendErrorMessage(w, "Could not decode the request body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	if sign.TxID == "" {
+		sendErrorMessage(w, "Please check your sign request", http.StatusBadRequest)
+		return
+	}
+	if sign.MineNow {
+		sendErrorMessage(w, "Light node doesn't mine blocks", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.node.Sign(sign.TxID, sign.Signatures)
+	if err != nil {
+		sendErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"txid":    hex.EncodeToString(tx.ID),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
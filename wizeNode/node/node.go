@@ -7,6 +7,7 @@ import (
 	"syscall"
 
 	"wizeBlock/wizeNode/core/blockchain"
+	"wizeBlock/wizeNode/core/chaincfg"
 	"wizeBlock/wizeNode/core/log"
 	"wizeBlock/wizeNode/core/network"
 )
@@ -19,6 +20,8 @@ import (
 // TODO: rethink with Blockchain and Transactions
 // TODO: rethink with MinerWalletAddress
 
+const nodeKeyFileName = "nodekey"
+
 // FIXME: deprecated in 0.3
 type PreparedTransaction struct {
 	From        string
@@ -30,14 +33,27 @@ type Node struct {
 	// FIXME: deprecated in 0.3
 	NodeID string
 
+	// address advertised to other nodes
 	NodeAddress network.NodeAddr
 	Network     network.NodeNetwork
 	Client      *network.NodeClient
 	Server      *NodeServer
+	Peers       *network.PeerMonitor
+	TxTrickler  *network.InvTrickler
+
+	// address the node server listens on, NodeAddress if it is not set
+	bindAddress network.NodeAddr
+	// addresses of nodes which advertise hosts not reachable from here
+	observed *network.ObservedAddrs
 
 	apiAddr string
 	rest    *RestServer
 
+	// nil when node connections are not encrypted
+	security *network.TransportSecurity
+	// connections with other nodes, TCP by default
+	transport network.Transport
+
 	// FIXME: NodeBlockchain, NodeTransactions
 	blockchain  *blockchain.Blockchain
 	preparedTxs map[string]*PreparedTransaction
@@ -48,13 +64,18 @@ func NewNode(nodeID string, nodeAddr network.NodeAddr, apiAddr, minerWalletAddre
 	newNode := &Node{
 		NodeID:      nodeID,
 		NodeAddress: nodeAddr,
+		bindAddress: nodeAddr,
+		observed:    network.NewObservedAddrs(),
 		apiAddr:     apiAddr,
+		transport:   network.DefaultTransport,
 		blockchain:  blockchain.NewBlockchain(nodeID),
 		preparedTxs: make(map[string]*PreparedTransaction),
 	}
 
 	newNode.Init()
 	newNode.InitNetwork([]network.NodeAddr{}, false)
+	newNode.Peers = network.NewPeerMonitor(newNode.Client, &newNode.Network)
+	newNode.TxTrickler = network.NewInvTrickler(newNode.Client)
 
 	// REST Server constructor
 	newNode.rest = NewRestServer(newNode, apiAddr)
@@ -67,8 +88,13 @@ func NewNode(nodeID string, nodeAddr network.NodeAddr, apiAddr, minerWalletAddre
 
 func (node *Node) Init() {
 
+	// Address book is shared by all clones of a node
+	if node.Network.AddrBook == nil {
+		node.Network.AddrBook = network.NewAddrBook()
+	}
+
 	// Nodes list storage
-	dataDir := fmt.Sprintf("files/db%s/", node.NodeID)
+	dataDir := chaincfg.DataPath("db%s/", node.NodeID)
 	node.Network.SetExtraManager(NodesListStorage{dataDir})
 	// load list of nodes from config
 	node.Network.SetNodes([]network.NodeAddr{}, true)
@@ -82,10 +108,95 @@ func (node *Node) InitClient() error {
 	}
 	client := network.NodeClient{}
 	client.Network = &node.Network
+	client.Security = node.security
+	client.Transport = node.transport
+	client.Observed = node.observed
+	client.Services = node.services()
 	node.Client = &client
 	return nil
 }
 
+// Returns services advertised to other nodes
+func (node *Node) services() uint64 {
+	if node.blockchain != nil && node.blockchain.Pruned() {
+		return network.PrunedServices
+	}
+	return network.DefaultServices
+}
+
+/*
+* Enables pruning: bodies of blocks older than the last depth blocks are
+* removed. The node advertises it is pruned and reports old blocks as not
+* found. Should be called before start
+ */
+func (node *Node) SetPruneDepth(depth int) error {
+	err := node.blockchain.SetPruneDepth(depth)
+	if err != nil {
+		return err
+	}
+	node.Client.Services = node.services()
+	return nil
+}
+
+// SetUTXOCacheSize sets the size limit of the in-memory UTXO cache in bytes
+func (node *Node) SetUTXOCacheSize(size int) {
+	node.blockchain.SetUTXOCacheSize(size)
+}
+
+/*
+* Enables encrypted and authenticated connections with other nodes.
+* Node identity key is loaded from data dir or generated on first run.
+* If allowedKeys list is not empty only these nodes are accepted
+ */
+func (node *Node) SetupSecurity(allowedKeys []string) error {
+	identity, err := LoadNodeIdentity(node.NodeID)
+	if err != nil {
+		return err
+	}
+
+	keys, err := network.ParseAllowedKeys(allowedKeys)
+	if err != nil {
+		return err
+	}
+
+	node.security = &network.TransportSecurity{
+		Identity:    identity,
+		AllowedKeys: keys,
+	}
+	node.Client.Security = node.security
+
+	log.Info.Printf("Secure transport is on. Node key: %x, allowed nodes: %d", identity.PublicKey, len(keys))
+	return nil
+}
+
+// Sets transport used to talk with other nodes. Should be called before start
+func (node *Node) SetTransport(transport network.Transport) {
+	node.transport = transport
+	node.Client.Transport = transport
+}
+
+/*
+* Sets address the node server listens on. NodeAddress is still advertised
+* to other nodes, so a node behind NAT or docker networking can bind to
+* a local interface and advertise its external address. Should be called before start
+ */
+func (node *Node) SetBindAddress(address network.NodeAddr) {
+	node.bindAddress = address
+}
+
+// Returns address the node server listens on
+func (node *Node) BindAddress() network.NodeAddr {
+	if node.bindAddress.IsEmpty() {
+		return node.NodeAddress
+	}
+	return node.bindAddress
+}
+
+// Loads identity key of a node from its data dir
+func LoadNodeIdentity(nodeID string) (*network.NodeIdentity, error) {
+	return network.LoadNodeIdentity(chaincfg.DataPath("db%s/%s", nodeID, nodeKeyFileName))
+}
+
 /*
 * Load list of other nodes addresses
  */
@@ -106,6 +217,20 @@ func (node *Node) InitNetwork(list []network.NodeAddr, force bool) error {
 	return nil
 }
 
+/*
+* Adds seed nodes from configuration to known nodes, the node itself is
+* skipped. Seeds are also put into the address book to share them
+ */
+func (node *Node) AddSeeds(seeds []network.NodeAddr) {
+	for _, seed := range seeds {
+		if seed.CompareToAddress(node.NodeAddress) {
+			continue
+		}
+		node.Network.AddNodeToKnown(seed)
+		node.Network.AddrBook.AddAddress(network.NetAddress{Addr: seed}, node.NodeAddress)
+	}
+}
+
 /*
  * Send own version to all known nodes
  */
@@ -114,7 +239,7 @@ func (node *Node) SendVersionToNodes(nodes []network.NodeAddr) {
 	bestHeight := node.blockchain.GetBestHeight()
 
 	if len(nodes) == 0 {
-		nodes = node.Network.Nodes
+		nodes = node.Network.GetNodes()
 	}
 
 	for _, n := range nodes {
@@ -126,19 +251,100 @@ func (node *Node) SendVersionToNodes(nodes []network.NodeAddr) {
 	}
 }
 
-func (node *Node) CheckAddressKnown(addr network.NodeAddr) {
+/*
+* Send getaddr to known nodes to learn more addresses
+ */
+func (node *Node) SendGetAddrToNodes() {
+	for _, n := range node.Network.GetNodes() {
+		if n.CompareToAddress(node.Client.NodeAddress) {
+			continue
+		}
+		node.Client.SendGetAddr(n)
+	}
+}
+
+func (node *Node) CheckAddressKnown(addr network.NodeAddr, services uint64) {
 	//log.Info.Printf("Check address known [%s]\n", addr)
 	//log.Info.Printf("All known nodes: %+v\n", node.Network.Nodes)
+	node.Network.AddrBook.MarkGood(addr, services)
+
 	if !node.Network.CheckIsKnown(addr) {
-		if len(node.Network.Nodes) > 0 {
-			log.Info.Printf("Send Addr %s to %s", node.Network.Nodes, addr)
-			node.Client.SendAddr(addr, node.Network.Nodes)
+		addresses := node.Network.AddrBook.GetAddresses(network.MaxAddrPerMessage)
+		if len(addresses) > 0 {
+			log.Info.Printf("Send %d addresses to %s", len(addresses), addr)
+			node.Client.SendAddr(addr, addresses)
 		} else {
-			log.Info.Printf("Don't Send Addr because Network Nodes is empty")
+			log.Info.Printf("Don't Send Addr because Address Book is empty")
 		}
 
-		node.Network.AddNodeToKnown(addr)
-		log.Info.Printf("Updated known nodes: %+v\n", node.Network.Nodes)
+		if node.Network.AddNodeToKnown(addr) {
+			// new node can know some more nodes
+			node.Client.SendGetAddr(addr)
+		}
+		log.Info.Printf("Updated known nodes: %+v\n", node.Network.GetNodes())
+	}
+}
+
+/*
+* Mines count blocks with coinbase to address right now. Valid transactions
+* from mempool are included into the first block. New blocks are announced
+* to known nodes. Returns hashes of the blocks
+ */
+func (node *Node) GenerateBlocks(count int, address string) ([][]byte, error) {
+	var hashes [][]byte
+
+	// blocks from other nodes are not added during generation
+	err := node.Server.chainWorkers.Do(func() error {
+		var err error
+		hashes, err = node.generateBlocks(count, address)
+		return err
+	})
+	return hashes, err
+}
+
+func (node *Node) generateBlocks(count int, address string) ([][]byte, error) {
+	hashes := [][]byte{}
+
+	for i := 0; i < count; i++ {
+		txs := []*blockchain.Transaction{blockchain.NewCoinbaseTX(address, "")}
+		if i == 0 {
+			for _, tx := range node.Server.mempool.Snapshot() {
+				tx := tx
+				check, err := node.blockchain.VerifyTransaction(&tx)
+				if check && err == nil {
+					txs = append(txs, &tx)
+					node.Server.mempool.Delete(tx.ID)
+				}
+			}
+		}
+
+		newBlock := node.blockchain.MineBlock(txs)
+		if newBlock == nil {
+			return hashes, fmt.Errorf("Failed to mine block %d", i+1)
+		}
+		hashes = append(hashes, newBlock.Hash)
+
+		log.Info.Printf("Generated block %x with %d tx", newBlock.Hash, len(txs))
+		node.AnnounceBlock(newBlock)
+	}
+
+	return hashes, nil
+}
+
+/*
+* Announces a new block to known nodes. Nodes which understand compact blocks
+* receive header and short IDs of transactions, other nodes receive inv
+ */
+func (node *Node) AnnounceBlock(block *blockchain.Block) {
+	for _, n := range node.Network.GetNodes() {
+		if n.CompareToAddress(node.Client.NodeAddress) {
+			continue
+		}
+		if node.Network.AddrBook.Services(n)&network.ServiceCompactBlocks != 0 {
+			node.Client.SendCmpctBlock(n, block)
+		} else {
+			node.Client.SendInv(n, "block", [][]byte{block.Hash})
+		}
 	}
 }
 
@@ -166,6 +372,12 @@ func (node *Node) Run() {
 		log.Fatal.Printf("Failed to start HTTP service: %s", err)
 	}
 
+	// ping other nodes, announce transactions and save address book while node is running
+	stopPeers := make(chan struct{})
+	go node.Peers.Run(stopPeers)
+	go node.TxTrickler.Run(stopPeers)
+	go node.Network.RunAddrBookSaver(stopPeers)
+
 	node.RunNodeServer()
 
 	// TODO: refactoring exits from all routines
@@ -176,8 +388,18 @@ func (node *Node) Run() {
 		if s == syscall.SIGTERM {
 			// FIXME
 			log.Info.Println("Stop servers")
+			if stopPeers != nil {
+				close(stopPeers)
+				stopPeers = nil
+			}
 			node.rest.Close()
 			node.Server.Stop()
+			// not flushed changes would be rolled forward on the next start anyway
+			if node.blockchain != nil {
+				if err := node.blockchain.FlushUTXO(); err != nil {
+					log.Warn.Printf("Failed to flush UTXO cache: %s", err)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,456 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"wizeBlock/wizeNode/core/blockchain"
+	"wizeBlock/wizeNode/core/crypto"
+	"wizeBlock/wizeNode/core/network"
+	"wizeBlock/wizeNode/core/wallet"
+)
+
+const convergeTimeout = 20 * time.Second
+
+func TestNodesSyncNewBlocks(t *testing.T) {
+	sim := NewSimulator(t, 3)
+	defer sim.Close()
+
+	sim.WaitConverged(convergeTimeout)
+
+	hashes := sim.Generate(0, 3)
+	sim.WaitConverged(convergeTimeout)
+	assert.Equal(t, hashes[2], sim.Tip(2), "Nodes have the last generated block")
+}
+
+func TestNodesSyncAfterPartition(t *testing.T) {
+	sim := NewSimulator(t, 3)
+	defer sim.Close()
+
+	conn, err := sim.Nodes[0].transport.Dial(sim.Nodes[1].NodeAddress)
+	if !assert.Nil(t, err, "Nodes are connected") {
+		return
+	}
+	sim.Partition([]int{0}, []int{1, 2})
+	_, err = conn.Write([]byte("version"))
+	assert.NotNil(t, err, "Connection between partitions is closed")
+	longest := sim.Generate(0, 3)
+	sim.Generate(1, 1)
+	sim.WaitConverged(convergeTimeout, 1, 2)
+	assert.False(t, sim.Converged(), "Partitioned nodes have different chains")
+
+	sim.Heal()
+	sim.WaitConverged(convergeTimeout)
+	assert.Equal(t, longest[2], sim.Tip(1), "The longest chain wins")
+}
+
+func TestNodesSyncWithLatencyAndDrops(t *testing.T) {
+	sim := NewSimulator(t, 3)
+	defer sim.Close()
+
+	sim.SetLatency(0, 2, 100*time.Millisecond)
+	sim.SetDropRate(0, 1, 1)
+	sim.Generate(0, 1)
+
+	sim.WaitConverged(convergeTimeout, 0, 2)
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, sim.Converged(0, 1), "Lost messages are not received")
+
+	sim.Heal()
+	sim.WaitConverged(convergeTimeout)
+}
+
+func TestHandleGetBlocksOverMemoryTransport(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	hashes := sim.Generate(0, 2)
+
+	// fake node which receives answers of the node
+	peerAddr := network.NodeAddr{"10.0.0.1", 3000}
+	peer := sim.Memory.Transport(peerAddr)
+	ln, err := peer.Listen(peerAddr)
+	assert.Nil(t, err, "Peer listens")
+	defer ln.Close()
+
+	client := &network.NodeClient{NodeAddress: peerAddr, Transport: peer}
+	go client.SendGetBlocks(sim.Nodes[0].NodeAddress)
+
+	var inv network.ComInv
+	for inv.Type != "block" {
+		conn, err := ln.Accept()
+		if !assert.Nil(t, err, "Node connects to peer") {
+			return
+		}
+		request, err := network.NewNodeConn(conn).ReadMessage()
+		conn.Close()
+		if err == nil && network.BytesToCommand(request[:network.CommandLength]) == "inv" {
+			gob.NewDecoder(bytes.NewReader(request[network.CommandLength:])).Decode(&inv)
+		}
+	}
+
+	assert.Equal(t, 3, len(inv.Items), "Node announces all blocks")
+	assert.Equal(t, hashes[1], inv.Items[0], "The newest block is first")
+}
+
+func TestMemoryNodesSyncNewBlocks(t *testing.T) {
+	sim := NewMemorySimulator(t, 3)
+	defer sim.Close()
+
+	sim.Generate(0, 2)
+	sim.WaitConverged(convergeTimeout)
+}
+
+func TestNodeUsesObservedAddress(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	// fake node behind NAT advertises a host not reachable from the node
+	advertised := network.NodeAddr{"wize1.invalid", 3000}
+	observed := network.NodeAddr{"10.0.0.3", 3000}
+	peer := sim.Memory.Transport(observed)
+	ln, err := peer.Listen(observed)
+	assert.Nil(t, err, "Peer listens")
+	defer ln.Close()
+
+	client := &network.NodeClient{NodeAddress: advertised, Transport: peer}
+	go client.SendVersion(sim.Nodes[0].NodeAddress, 100)
+
+	conn, err := ln.Accept()
+	if !assert.Nil(t, err, "Node connects to observed address") {
+		return
+	}
+	request, err := network.NewNodeConn(conn).ReadMessage()
+	conn.Close()
+	assert.Nil(t, err, "Node sends a message")
+	assert.Equal(t, "getblocks", network.BytesToCommand(request[:network.CommandLength]), "Node requests blocks")
+	assert.Equal(t, advertised, sim.Nodes[0].Client.Observed.Resolve(advertised), "Observed address of a node without identity key is not remembered")
+}
+
+func TestPrunedNodeReportsNotFound(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	sim.Generate(0, blockchain.MinPruneDepth+1)
+	genesis := sim.Nodes[0].blockchain.GetHeaders(nil, 1)[0].Hash
+	assert.Nil(t, sim.Nodes[0].SetPruneDepth(blockchain.MinPruneDepth), "Pruning is enabled")
+
+	peerAddr := network.NodeAddr{"10.0.0.4", 3000}
+	peer := sim.Memory.Transport(peerAddr)
+	ln, err := peer.Listen(peerAddr)
+	assert.Nil(t, err, "Peer listens")
+	defer ln.Close()
+
+	// reads messages of the node until the command comes
+	receive := func(command string, payload interface{}) {
+		for {
+			conn, err := ln.Accept()
+			if !assert.Nil(t, err, "Node connects to peer") {
+				return
+			}
+			request, err := network.NewNodeConn(conn).ReadMessage()
+			conn.Close()
+			if err == nil && network.BytesToCommand(request[:network.CommandLength]) == command {
+				gob.NewDecoder(bytes.NewReader(request[network.CommandLength:])).Decode(payload)
+				return
+			}
+		}
+	}
+
+	client := &network.NodeClient{NodeAddress: peerAddr, Transport: peer}
+	go client.SendVersion(sim.Nodes[0].NodeAddress, 0)
+	var version network.ComVersion
+	receive("version", &version)
+	assert.Equal(t, network.PrunedServices, version.Services, "Node advertises it is pruned")
+
+	go client.SendGetData(sim.Nodes[0].NodeAddress, "block", [][]byte{genesis})
+	var notFound network.ComNotFound
+	receive("notfound", &notFound)
+	assert.Equal(t, [][]byte{genesis}, notFound.Items, "Pruned block is not found")
+}
+
+func TestNodeBansFloodingPeer(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	limits := network.DefaultLimits
+	limits.PeerMessageRate = 0.1
+	limits.PeerMessageBurst = 5
+	sim.Nodes[0].Server.SetLimits(limits)
+
+	peerAddr := network.NodeAddr{"10.0.0.1", 3000}
+	client := &network.NodeClient{NodeAddress: peerAddr, Transport: sim.Memory.Transport(peerAddr)}
+	conn, err := client.Dial(sim.Nodes[0].NodeAddress)
+	if !assert.Nil(t, err, "Peer connects") {
+		return
+	}
+	defer conn.Close()
+
+	// every message over the limit closes connection, so peer reconnects
+	scores := sim.Nodes[0].Server.PeerScores()
+	for i := 0; i < 100 && !scores.IsBanned("10.0.0.1"); i++ {
+		request, _ := client.BuildCommandData("getaddr", &network.ComGetAddr{peerAddr})
+		if conn.WriteMessage(request) != nil {
+			conn.Close()
+			conn, err = client.Dial(sim.Nodes[0].NodeAddress)
+			if err != nil {
+				continue
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		conn.ReadMessage()
+	}
+
+	assert.True(t, scores.IsBanned("10.0.0.1"), "Flooding peer is banned")
+}
+
+func TestNodeChecksCompactBlockHeader(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	server := sim.Nodes[0].Server
+	bc := sim.Nodes[0].blockchain
+	genesis, _ := bc.GetBlock(bc.GetTip())
+
+	// transaction of the block is not in mempool, so the block waits for it
+	tx := &blockchain.Transaction{time.Now().UnixNano(), nil,
+		[]blockchain.TXInput{{genesis.Transactions[0].ID, 0, nil, sim.MinerPubKey, 0}},
+		[]blockchain.TXOutput{*blockchain.NewTXOutput(genesis.Transactions[0].Vout[0].Value, sim.Miner)}, 0}
+	tx.ID = tx.Hash()
+	bc.SignTransaction(tx, *sim.MinerKey)
+	block := blockchain.NewBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTX(sim.Miner, ""), tx}, genesis.Hash, 1)
+
+	peerAddr := network.NodeAddr{"10.0.0.5", 3000}
+	handle := func(block blockchain.Block) error {
+		compact, _ := blockchain.NewCompactBlock(&block).Serialize()
+		data, _ := network.GobEncode(&network.ComCmpctBlock{peerAddr, compact})
+		request := &NodeServerRequest{Node: server.CloneNode(), Server: server, Request: data, RequestIP: peerAddr.Host}
+		return request.handleCmpctBlock()
+	}
+
+	wrongNonce := *block
+	wrongNonce.Nonce++
+	assert.NotNil(t, handle(wrongNonce), "Header without proof-of-work is rejected")
+	wrongHeight := *block
+	wrongHeight.Height = 5
+	assert.NotNil(t, handle(wrongHeight), "Header not following its parent is rejected")
+	assert.Equal(t, 0, len(server.partialBlocks), "Rejected blocks are not kept")
+	assert.NotEqual(t, 0, server.PeerScores().Score(peerAddr.Host), "Peer sending wrong header is scored")
+
+	handle(*block)
+	assert.NotNil(t, server.takePartialBlock(block.Hash), "Valid block waits for transactions")
+
+	// count of waiting blocks is limited, old ones expire
+	for i := 0; i < maxPartialBlocks+5; i++ {
+		header := blockchain.BlockHeader{Hash: []byte{byte(i)}}
+		server.addPartialBlock(&partialBlock{&blockchain.PartialBlock{Header: header}, peerAddr, time.Now()})
+	}
+	assert.Equal(t, maxPartialBlocks, len(server.partialBlocks), "Count of waiting blocks is limited")
+	server.addPartialBlock(&partialBlock{&blockchain.PartialBlock{Header: block.Header()}, peerAddr, time.Now().Add(-2 * partialBlockTimeout)})
+	assert.Nil(t, server.takePartialBlock(block.Hash), "Expired block is dropped")
+}
+
+func TestMinerSkipsDoubleSpend(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	server := sim.Nodes[0].Server
+	server.minerAddress = sim.Miner
+	bc := sim.Nodes[0].blockchain
+	genesis, _ := bc.GetBlock(bc.GetTip())
+	spendGenesis := func() *blockchain.Transaction {
+		tx := &blockchain.Transaction{time.Now().UnixNano(), nil,
+			[]blockchain.TXInput{{genesis.Transactions[0].ID, 0, nil, sim.MinerPubKey, 0}},
+			[]blockchain.TXOutput{*blockchain.NewTXOutput(genesis.Transactions[0].Vout[0].Value, sim.Miner)}, 0}
+		tx.ID = tx.Hash()
+		bc.SignTransaction(tx, *sim.MinerKey)
+		return tx
+	}
+
+	peerAddr := network.NodeAddr{"10.0.0.6", 3000}
+	handle := func(tx *blockchain.Transaction) error {
+		data, _ := network.GobEncode(&network.ComTx{peerAddr, tx.Serialize()})
+		request := &NodeServerRequest{Node: server.CloneNode(), Server: server, Request: data, RequestIP: peerAddr.Host}
+		return request.handleTx()
+	}
+
+	// both transactions are in mempool when the block is mined
+	first := spendGenesis()
+	server.mempool.Add(*first)
+	assert.Nil(t, handle(spendGenesis()), "Transaction is accepted")
+	assert.Equal(t, 1, bc.GetBestHeight(), "Block is mined")
+	block, _ := bc.GetBlock(bc.GetTip())
+	assert.Equal(t, 2, len(block.Transactions), "Only one of conflicting transactions is mined")
+	assert.Equal(t, 0, server.mempool.Len(), "Conflicting transaction is dropped")
+
+	assert.NotNil(t, handle(spendGenesis()), "Transaction spending spent output is rejected")
+	assert.Equal(t, 1, bc.GetBestHeight(), "No block is mined for rejected transaction")
+}
+
+func TestMempoolIsReadWhileChanged(t *testing.T) {
+	pool := newTxPool()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			tx := blockchain.NewCoinbaseTX("address", "")
+			pool.Add(*tx)
+			if i%2 == 0 {
+				pool.Delete(tx.ID)
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		for id := range pool.Snapshot() {
+			txID, _ := hex.DecodeString(id)
+			pool.Get(txID)
+		}
+	}
+	<-done
+	assert.Equal(t, 50, pool.Len(), "Deleted transactions are not in the pool")
+}
+
+func TestLightClientGetsMerkleBlock(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	hashes := sim.Generate(0, 1)
+	block, _ := sim.Nodes[0].blockchain.GetBlock(hashes[0])
+	txID := block.Transactions[0].ID
+
+	peerAddr := network.NodeAddr{"10.0.0.1", 3000}
+	peer := sim.Memory.Transport(peerAddr)
+	ln, err := peer.Listen(peerAddr)
+	assert.Nil(t, err, "Peer listens")
+	defer ln.Close()
+
+	client := &network.NodeClient{NodeAddress: peerAddr, Transport: peer}
+	go client.SendGetMerkleBlock(sim.Nodes[0].NodeAddress, hashes[0], [][]byte{txID})
+
+	var payload network.ComMerkleBlock
+	for payload.Block == nil {
+		conn, err := ln.Accept()
+		if !assert.Nil(t, err, "Node connects to peer") {
+			return
+		}
+		request, err := network.NewNodeConn(conn).ReadMessage()
+		conn.Close()
+		if command, data, err := network.ParseCommand(request); err == nil && command == "merkleblock" {
+			gob.NewDecoder(bytes.NewReader(data)).Decode(&payload)
+		}
+	}
+
+	merkle, err := blockchain.DeserializeMerkleBlock(payload.Block)
+	assert.Nil(t, err, "Merkle block is received")
+	txs, err := merkle.Verify()
+	assert.Nil(t, err, "Merkle block is valid")
+	assert.Equal(t, txID, txs[0].ID, "Transaction is proved")
+}
+
+func TestLightClientMatchesCFilters(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	hashes := sim.Generate(0, 2)
+
+	peerAddr := network.NodeAddr{"10.0.0.1", 3000}
+	peer := sim.Memory.Transport(peerAddr)
+	ln, err := peer.Listen(peerAddr)
+	assert.Nil(t, err, "Peer listens")
+	defer ln.Close()
+
+	client := &network.NodeClient{NodeAddress: peerAddr, Transport: peer}
+	go client.SendGetCFilters(sim.Nodes[0].NodeAddress, hashes)
+
+	var payload network.ComCFilters
+	for payload.Filters == nil {
+		conn, err := ln.Accept()
+		if !assert.Nil(t, err, "Node connects to peer") {
+			return
+		}
+		request, err := network.NewNodeConn(conn).ReadMessage()
+		conn.Close()
+		if command, data, err := network.ParseCommand(request); err == nil && command == "cfilters" {
+			gob.NewDecoder(bytes.NewReader(data)).Decode(&payload)
+		}
+	}
+	assert.Equal(t, 2, len(payload.Filters), "Filters of all blocks are received")
+
+	miner, err := wallet.NewFilterMatcher([]string{sim.Miner})
+	assert.Nil(t, err, "Matcher of miner address")
+	_, public := crypto.NewKeyPair()
+	other, err := wallet.NewFilterMatcher([]string{string(crypto.GetAddress(public))})
+	assert.Nil(t, err, "Matcher of other address")
+
+	for _, filter := range payload.Filters {
+		match, err := miner.Match(filter.BlockHash, filter.Filter)
+		assert.Nil(t, err, "Filter is valid")
+		assert.True(t, match, "Block pays to miner")
+		match, _ = other.Match(filter.BlockHash, filter.Filter)
+		assert.False(t, match, "Block doesn't touch other address")
+	}
+}
+
+func TestLightNodeSyncsWallet(t *testing.T) {
+	sim := NewMemorySimulator(t, 1)
+	defer sim.Close()
+
+	_, public := crypto.NewKeyPair()
+	other := string(crypto.GetAddress(public))
+	address := sim.Miner
+	sim.Generate(0, 2)
+
+	light, err := NewLightNode("light", "", []string{address})
+	if !assert.Nil(t, err, "Light node is created") {
+		return
+	}
+	defer light.chain.Close()
+	light.SetTransport(sim.Memory.Transport(network.NodeAddr{"10.0.0.2", 3000}))
+	light.InitNetwork([]network.NodeAddr{sim.Nodes[0].NodeAddress})
+
+	assert.Nil(t, light.Sync(), "Light node syncs with full node")
+	assert.Equal(t, sim.Nodes[0].blockchain.GetBestHeight(), light.chain.Height(), "All headers are synced")
+	balance, err := light.Balance(address)
+	assert.Nil(t, err, "Balance of watched address")
+	assert.Equal(t, sim.Nodes[0].blockchain.GetWalletBalance(address), balance, "Balance is the same as on full node")
+	_, err = light.Balance(other)
+	assert.NotNil(t, err, "Address is not watched")
+
+	txToSign, err := light.Prepare(address, other, 1, sim.MinerPubKey)
+	if !assert.Nil(t, err, "Transaction is prepared") {
+		return
+	}
+	signatures := []string{}
+	for _, hash := range txToSign.HashesToSign {
+		data, _ := hex.DecodeString(hash)
+		r, s, err := crypto.Sign(rand.Reader, sim.MinerKey, data)
+		assert.Nil(t, err, "Hash is signed")
+		signatures = append(signatures, hex.EncodeToString(crypto.SerializeSignature(r, s)))
+	}
+	_, err = light.Sign(hex.EncodeToString(txToSign.TxID), signatures)
+	assert.Nil(t, err, "Transaction is sent")
+
+	_, err = light.Prepare(address, other, balance, sim.MinerPubKey)
+	assert.NotNil(t, err, "Outputs of pending transaction are not spent again")
+
+	// the transaction reaches mempool of the full node asynchronously
+	deadline := time.Now().Add(convergeTimeout)
+	for time.Now().Before(deadline) {
+		sim.Generate(0, 1)
+		assert.Nil(t, light.Sync(), "Light node syncs new blocks")
+		if current, _ := light.Balance(address); current == balance-1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	current, _ := light.Balance(address)
+	assert.Equal(t, balance-1, current, "Sent transaction is found in a block")
+	assert.Equal(t, 0, len(light.pending), "Confirmed transaction is not pending")
+}
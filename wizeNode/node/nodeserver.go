@@ -1,9 +1,12 @@
 package node
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"wizeBlock/wizeNode/core/blockchain"
@@ -17,6 +20,22 @@ import (
 
 const timeFormat = "15:04:05.000000"
 
+// Connection is closed if other node sends nothing during this time
+const connIdleTimeout = 5 * time.Minute
+
+// Max time a handler waits for a free worker
+const workerWaitTimeout = 30 * time.Second
+
+// Points added to the score of a host which sends broken message
+const scoreBrokenMessage = 20
+
+const (
+	// max count of compact blocks waiting for missing transactions
+	maxPartialBlocks = 16
+	// compact block is dropped if missing transactions don't come in this time
+	partialBlockTimeout = time.Minute
+)
+
 type NodeServer struct {
 	Node        *Node
 	NodeAddress network.NodeAddr
@@ -25,11 +44,35 @@ type NodeServer struct {
 
 	// TODO: to redesign
 	blocksInTransit [][]byte
+	transitMutex    sync.Mutex
 	bc              *blockchain.Blockchain
-	mempool         map[string]blockchain.Transaction
+	mempool         *txPool
+
+	// blocks from compact blocks waiting for missing transactions
+	partialBlocks map[string]*partialBlock
+	partialMutex  sync.Mutex
+
+	// limits of inbound connections and messages
+	limiter *network.Limiter
+	// handlers which change the chain or mempool run one by one
+	chainWorkers *workerPool
+	// handlers which read blocks for other nodes
+	readWorkers *workerPool
+
+	// background validation of the UTXO snapshot the chain started from
+	snapshotMutex   sync.Mutex
+	snapshotRunning bool
+	snapshotFailed  bool
+
+	// open inbound connections, Stop closes them and waits for their handlers
+	connMutex sync.Mutex
+	conns     map[net.Conn]struct{}
+	handlers  sync.WaitGroup
+	stopped   bool
 
 	// TODO: to redesign
 	conn                net.Conn
+	ln                  net.Listener
 	StopMainChan        chan struct{}
 	StopMainConfirmChan chan struct{}
 }
@@ -40,7 +83,12 @@ func NewNodeServer(node *Node, minerAddress string) *NodeServer {
 		NodeAddress:         node.NodeAddress,
 		minerAddress:        minerAddress,
 		blocksInTransit:     [][]byte{},
-		mempool:             make(map[string]blockchain.Transaction),
+		mempool:             newTxPool(),
+		partialBlocks:       make(map[string]*partialBlock),
+		conns:               make(map[net.Conn]struct{}),
+		limiter:             network.NewLimiter(network.DefaultLimits, network.NewPeerScores()),
+		chainWorkers:        newWorkerPool(1),
+		readWorkers:         newWorkerPool(network.DefaultLimits.ReadWorkers),
 		bc:                  node.blockchain,
 		StopMainChan:        make(chan struct{}),
 		StopMainConfirmChan: make(chan struct{}),
@@ -64,7 +112,7 @@ func NewNodeServer(node *Node, minerAddress string) *NodeServer {
 func (s *NodeServer) Start(serverStartResult chan string) error {
 	log.Info.Println("Prepare Node Server to start ", s.NodeAddress)
 
-	ln, err := net.Listen(network.Protocol, s.Node.NodeAddress.String())
+	ln, err := s.Node.transport.Listen(s.Node.BindAddress())
 	if err != nil {
 		serverStartResult <- err.Error()
 		//close(s.StopMainConfirmChan)
@@ -73,14 +121,16 @@ func (s *NodeServer) Start(serverStartResult chan string) error {
 		return err
 	}
 	defer ln.Close()
+	s.ln = ln
 
 	s.Node.Client.SetNodeAddress(s.NodeAddress)
 
-	log.Info.Printf("Node Server [%s] was started, knownNodes: %v",
-		s.Node.NodeAddress, s.Node.Network.Nodes)
+	log.Info.Printf("Node Server [%s] was started on [%s], knownNodes: %v",
+		s.Node.NodeAddress, s.Node.BindAddress(), s.Node.Network.GetNodes())
 	//s.bc = s.node.blockchain
 
 	s.Node.SendVersionToNodes([]network.NodeAddr{})
+	s.Node.SendGetAddrToNodes()
 
 	// notify node about server started fine
 	serverStartResult <- ""
@@ -116,39 +166,241 @@ func (s *NodeServer) Start(serverStartResult chan string) error {
 			break
 		}
 
-		go s.handleConnection(conn)
+		host := s.Node.transport.PeerHost(conn)
+		if err := s.limiter.Connect(host); err != nil {
+			log.Debug.Printf("Connection from %s is rejected: %s", host, err)
+			conn.Close()
+			continue
+		}
+
+		if !s.trackConn(conn) {
+			s.limiter.Disconnect(host)
+			conn.Close()
+			break
+		}
+
+		go func() {
+			defer s.untrackConn(conn)
+			defer s.limiter.Disconnect(host)
+			s.handleConnection(conn, host)
+		}()
 	}
 
 	return nil
 }
 
+/*
+* Stops the server. Open connections are closed and the chain is closed after
+* their handlers complete, so a handler doesn't use the closed database
+ */
 func (s *NodeServer) Stop() {
-	if s.bc != nil && s.bc.Db != nil {
-		s.bc.Db.Close()
+	s.connMutex.Lock()
+	s.stopped = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMutex.Unlock()
+
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.handlers.Wait()
+	if s.bc != nil {
+		s.bc.Close()
+	}
+}
+
+// Remembers an accepted connection. Returns false if the server is stopped
+func (s *NodeServer) trackConn(conn net.Conn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+// Forgets a connection when its handler completes
+func (s *NodeServer) untrackConn(conn net.Conn) {
+	s.connMutex.Lock()
+	delete(s.conns, conn)
+	s.connMutex.Unlock()
+
+	s.handlers.Done()
+}
+
+// Removes transactions from mempool which inputs are spent or unknown
+func (s *NodeServer) dropUnminable() {
+	for id, tx := range s.mempool.Snapshot() {
+		err := s.bc.CheckTransactionInputs(&tx)
+		if err != nil {
+			log.Info.Printf("Transaction [%s] is removed from mempool: %s", id, err)
+			s.mempool.Delete(tx.ID)
+		}
+	}
+}
+
+// Replaces list of blocks which should be requested during sync
+func (s *NodeServer) setBlocksInTransit(hashes [][]byte) {
+	s.transitMutex.Lock()
+	defer s.transitMutex.Unlock()
+
+	s.blocksInTransit = hashes
+}
+
+// Removes the next block to request from the list. Returns nil if sync is done
+func (s *NodeServer) nextBlockInTransit() []byte {
+	s.transitMutex.Lock()
+	defer s.transitMutex.Unlock()
+
+	if len(s.blocksInTransit) == 0 {
+		return nil
+	}
+	blockHash := s.blocksInTransit[0]
+	s.blocksInTransit = s.blocksInTransit[1:]
+	return blockHash
+}
+
+/*
+* Keeps a compact block until its missing transactions come. Expired blocks
+* are dropped, and the oldest one when there are too many of them
+ */
+func (s *NodeServer) addPartialBlock(pending *partialBlock) {
+	s.partialMutex.Lock()
+	defer s.partialMutex.Unlock()
+
+	oldest := ""
+	for key, other := range s.partialBlocks {
+		if time.Since(other.received) > partialBlockTimeout {
+			delete(s.partialBlocks, key)
+		} else if oldest == "" || other.received.Before(s.partialBlocks[oldest].received) {
+			oldest = key
+		}
+	}
+	key := hex.EncodeToString(pending.block.Header.Hash)
+	if _, ok := s.partialBlocks[key]; !ok && len(s.partialBlocks) >= maxPartialBlocks {
+		delete(s.partialBlocks, oldest)
+	}
+	s.partialBlocks[key] = pending
+}
+
+// Removes the compact block waiting for transactions. Returns nil if there is none or it is expired
+func (s *NodeServer) takePartialBlock(hash []byte) *partialBlock {
+	s.partialMutex.Lock()
+	defer s.partialMutex.Unlock()
+
+	key := hex.EncodeToString(hash)
+	pending, ok := s.partialBlocks[key]
+	if !ok {
+		return nil
+	}
+	delete(s.partialBlocks, key)
+	if time.Since(pending.received) > partialBlockTimeout {
+		return nil
 	}
+	return pending
+}
+
+/*
+* Validates historical blocks of the UTXO snapshot in background. It is
+* started after received blocks until all blocks below the snapshot come
+ */
+func (s *NodeServer) checkSnapshot() {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	if s.snapshotRunning || s.snapshotFailed || !s.bc.SnapshotPending() {
+		return
+	}
+	s.snapshotRunning = true
+
+	go func() {
+		err := s.bc.ValidateSnapshot()
+
+		s.snapshotMutex.Lock()
+		defer s.snapshotMutex.Unlock()
+		s.snapshotRunning = false
+
+		switch err {
+		case nil:
+			log.Info.Println("UTXO snapshot is validated with historical blocks")
+		case blockchain.ErrMissingHistory:
+		default:
+			s.snapshotFailed = true
+			log.Warn.Printf("UTXO snapshot is not valid: %s", err)
+		}
+	}()
+}
+
+// Sets limits of inbound connections and messages. Should be called before start
+func (s *NodeServer) SetLimits(config network.LimitConfig) {
+	s.limiter = network.NewLimiter(config, s.limiter.Scores)
+	s.readWorkers = newWorkerPool(config.ReadWorkers)
+}
+
+// Returns misbehavior scores of other nodes
+func (s *NodeServer) PeerScores() *network.PeerScores {
+	return s.limiter.Scores
 }
 
-func (s *NodeServer) readRequest(conn net.Conn) (command string, databuffer []byte, err error) {
-	request, err := ioutil.ReadAll(conn)
+func (s *NodeServer) readRequest(conn *network.NodeConn, host string) (command string, databuffer []byte, err error) {
+	request, err := conn.ReadMessage()
 	if err != nil {
-		log.Warn.Printf("NodeServer read request error: %s", err)
+		// other node closes connection when it has no more commands
+		if err != io.EOF {
+			log.Warn.Printf("NodeServer read request error: %s", err)
+		}
 		return
 	}
 
-	command = network.BytesToCommand(request[:network.CommandLength])
-	databuffer = request[network.CommandLength:]
+	command, databuffer, err = network.ParseCommand(request)
+	if err != nil {
+		s.limiter.Scores.Misbehaving(host, scoreBrokenMessage, err.Error())
+	}
 	return
 }
 
-func (s *NodeServer) handleConnection(conn net.Conn) {
+func (s *NodeServer) handleConnection(rawConn net.Conn, host string) {
+	conn, err := network.AcceptNode(rawConn, s.Node.security)
+	if err != nil {
+		log.Warn.Printf("Handshake with %s failed: %s", rawConn.RemoteAddr(), err)
+		rawConn.Close()
+		return
+	}
+	if conn.IsSecure() {
+		log.Debug.Printf("Secure connection with node %x", conn.PeerKey)
+	}
+	defer conn.Close()
+
+	// connection can be kept open by other node to send more commands
+	for {
+		conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
+		if !s.handleCommand(conn, host) {
+			return
+		}
+	}
+}
+
+// Reads and handles one command. Returns false if connection should be closed
+func (s *NodeServer) handleCommand(conn *network.NodeConn, host string) bool {
 	starttime := time.Now().UnixNano()
 	log.Debug.Println("New command. Start reading")
 
-	command, request, err := s.readRequest(conn)
+	command, request, err := s.readRequest(conn, host)
+	if err == io.EOF {
+		return false
+	}
 	if err != nil {
 		s.sendErrorBack(conn, fmt.Errorf("Network Data Reading Error: "+err.Error()))
-		conn.Close()
-		return
+		return false
+	}
+
+	if err := s.limiter.AllowMessage(host); err != nil {
+		s.sendErrorBack(conn, err)
+		return false
 	}
 
 	log.Debug.Printf("Received %s command", command)
@@ -162,9 +414,8 @@ func (s *NodeServer) handleConnection(conn net.Conn) {
 	requestObj.Node = s.CloneNode()
 	requestObj.Request = request[:]
 	requestObj.Server = s
-	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		requestObj.RequestIP = addr.IP.String()
-	}
+	requestObj.RequestIP = host
+	requestObj.PeerKey = conn.PeerKey
 	request = nil
 
 	log.Debug.Printf("RequestObj: %+v\n", requestObj)
@@ -173,16 +424,40 @@ func (s *NodeServer) handleConnection(conn net.Conn) {
 	switch command {
 	case "addr":
 		rerr = requestObj.handleAddr()
+	case "blocktxn":
+		rerr = s.chainWorkers.Do(requestObj.handleBlockTxn)
+	case "cfilters":
+		rerr = requestObj.handleCFilters()
+	case "cmpctblock":
+		rerr = s.chainWorkers.Do(requestObj.handleCmpctBlock)
+	case "getaddr":
+		rerr = requestObj.handleGetAddr()
 	case "block":
-		rerr = requestObj.handleBlock()
+		rerr = s.chainWorkers.Do(requestObj.handleBlock)
+	case "headers":
+		rerr = requestObj.handleHeaders()
 	case "inv":
 		rerr = requestObj.handleInv()
 	case "getblocks":
-		rerr = requestObj.handleGetBlocks()
+		rerr = s.readWorkers.Do(requestObj.handleGetBlocks)
+	case "getblocktxn":
+		rerr = s.readWorkers.Do(requestObj.handleGetBlockTxn)
+	case "getcfilters":
+		rerr = s.readWorkers.Do(requestObj.handleGetCFilters)
 	case "getdata":
-		rerr = requestObj.handleGetData()
+		rerr = s.readWorkers.Do(requestObj.handleGetData)
+	case "getheaders":
+		rerr = s.readWorkers.Do(requestObj.handleGetHeaders)
+	case "getmerkle":
+		rerr = s.readWorkers.Do(requestObj.handleGetMerkleBlock)
+	case "merkleblock":
+		rerr = requestObj.handleMerkleBlock()
+	case "notfound":
+		rerr = requestObj.handleNotFound()
+	case "ping":
+		rerr = requestObj.handlePing()
 	case "tx":
-		rerr = requestObj.handleTx()
+		rerr = s.chainWorkers.Do(requestObj.handleTx)
 	case "version":
 		rerr = requestObj.handleVersion()
 	default:
@@ -198,33 +473,31 @@ func (s *NodeServer) handleConnection(conn net.Conn) {
 		}
 	}
 
-	// TODO: add sending response
-	//	if requestObj.HasResponse && requestObj.Response != nil && rerr == nil {
-	//		// send this response back
-	//		// first byte is bool true to indicate request was success
-	//		dataresponse := append([]byte{1}, requestObj.Response...)
-	//		log.Info.Printf("Responding %d bytes\n", len(dataresponse))
-	//		_, err := conn.Write(dataresponse)
-	//		if err != nil {
-	//			log.Warn.Println("Sending response error: ", err.Error())
-	//		}
-	//	}
+	if requestObj.HasResponse && requestObj.Response != nil && rerr == nil {
+		// send this response back
+		log.Debug.Printf("Responding %d bytes\n", len(requestObj.Response))
+		err := conn.WriteMessage(requestObj.Response)
+		if err != nil {
+			log.Warn.Println("Sending response error: ", err.Error())
+			return false
+		}
+	}
 
 	duration := time.Since(time.Unix(0, starttime))
 	ms := duration.Nanoseconds() / int64(time.Millisecond)
 	log.Debug.Printf("Complete processing %s command. Time: %d ms\n", command, ms)
 
-	conn.Close()
+	return true
 }
 
-func (s *NodeServer) sendErrorBack(conn net.Conn, err error) {
+func (s *NodeServer) sendErrorBack(conn *network.NodeConn, err error) {
 	log.Info.Println("Sending back error message: ", err.Error())
 
 	payload, err := network.GobEncode(err.Error())
 	if err == nil {
 		dataresponse := append([]byte{0}, payload...)
 		log.Info.Printf("Responding %d bytes as error message\n", len(dataresponse))
-		_, err = conn.Write(dataresponse)
+		err = conn.WriteMessage(dataresponse)
 		if err != nil {
 			log.Warn.Println("Sending response error: ", err.Error())
 		}
@@ -240,16 +513,112 @@ func (s *NodeServer) CloneNode() *Node {
 
 	// FIXME: should we just clone not create new object?
 	//node := NewNode(originnode.NodeID, originnode.NodeAddress, originnode.apiAddr, s.minerAddress)
+	// nodes are copied without storing them again, so the clone doesn't touch the nodes DB
+	nodes := originnode.Network.GetNodes()
 	node := Node{
 		NodeID:      originnode.NodeID,
 		NodeAddress: originnode.NodeAddress,
-		blockchain:  originnode.blockchain,
+		bindAddress: originnode.bindAddress,
+		observed:    originnode.observed,
+		Network: network.NodeNetwork{
+			Nodes:    nodes,
+			AddrBook: originnode.Network.AddrBook,
+			Storage:  originnode.Network.Storage,
+		},
+		blockchain: originnode.blockchain,
+		security:   originnode.security,
+		transport:  originnode.transport,
 	}
 
-	node.Init()
+	node.InitClient()
 	node.Client.SetNodeAddress(s.NodeAddress)
-	// set list of nodes and skip loading default if this is empty list
-	node.InitNetwork(originnode.Network.Nodes, true)
 
 	return &node
 }
+
+/*
+* Bounded pool of workers for heavy handlers. When all workers are busy
+* the handler waits, so other node can't start unlimited work and its
+* next messages are not read until the handler completes
+ */
+type workerPool struct {
+	slots chan struct{}
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &workerPool{make(chan struct{}, size)}
+}
+
+// Runs the handler when a worker is free
+func (p *workerPool) Do(handler func() error) error {
+	timer := time.NewTimer(workerWaitTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		return errors.New("Node is busy")
+	}
+	defer func() { <-p.slots }()
+
+	return handler()
+}
+
+/*
+* Mempool of transactions waiting to be mined, keyed by hex ID. It is
+* changed by handlers on the chain worker and read by other handlers
+* at the same time, so it is guarded by a mutex
+ */
+type txPool struct {
+	mutex sync.RWMutex
+	txs   map[string]blockchain.Transaction
+}
+
+func newTxPool() *txPool {
+	return &txPool{txs: make(map[string]blockchain.Transaction)}
+}
+
+func (p *txPool) Add(tx blockchain.Transaction) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.txs[hex.EncodeToString(tx.ID)] = tx
+}
+
+// Returns a transaction by ID, false if it is not in the pool
+func (p *txPool) Get(id []byte) (blockchain.Transaction, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	tx, ok := p.txs[hex.EncodeToString(id)]
+	return tx, ok
+}
+
+func (p *txPool) Delete(id []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.txs, hex.EncodeToString(id))
+}
+
+func (p *txPool) Len() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return len(p.txs)
+}
+
+// Returns a copy of the pool, it can be used while the pool is changed
+func (p *txPool) Snapshot() map[string]blockchain.Transaction {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	txs := make(map[string]blockchain.Transaction, len(p.txs))
+	for id, tx := range p.txs {
+		txs[id] = tx
+	}
+	return txs
+}
@@ -3,7 +3,6 @@ package node
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -13,9 +12,11 @@ import (
 )
 
 // TODO: rethink with handleVersion
-// TODO: rethink with handleAddr
 // TODO: rethink with Data messages
 
+// Count of known nodes a node tries to keep
+const targetKnownNodes = 8
+
 type NodeServerRequest struct {
 	Node        *Node
 	Server      *NodeServer
@@ -23,6 +24,8 @@ type NodeServerRequest struct {
 	RequestIP   string
 	HasResponse bool
 	Response    []byte
+	// identity key of the node, if the connection is secure
+	PeerKey []byte
 }
 
 func (self *NodeServerRequest) Init() {
@@ -30,6 +33,24 @@ func (self *NodeServerRequest) Init() {
 	self.Response = nil
 }
 
+/*
+* Sends answer to a request. Light clients which don't accept connections
+* send requests with empty address and receive answer in the same connection
+ */
+func (self *NodeServerRequest) reply(addr network.NodeAddr, command string, data interface{}) error {
+	response, err := self.Node.Client.BuildCommandData(command, data)
+	if err != nil {
+		return err
+	}
+
+	if addr.IsEmpty() {
+		self.HasResponse = true
+		self.Response = response
+		return nil
+	}
+	return self.Node.Client.SendData(addr, response)
+}
+
 // Reads and parses request from network data
 func (self *NodeServerRequest) parseRequestData(payload interface{}) error {
 	var buff bytes.Buffer
@@ -52,32 +73,37 @@ func (self *NodeServerRequest) handleAddr() error {
 		return err
 	}
 
-	// TODO: check this logic
-	//KnownNodes = append(KnownNodes, payload.AddrList...)
-	//nanonow := time.Now().Format(timeFormat)
-	//fmt.Printf("nodeID: %s, %s: There are %d known nodes now!\n", s.nodeID, nanonow, len(KnownNodes))
-	//for _, node := range KnownNodes {
-	//	s.Node.Client.SendGetBlocks(node, s.nodeAddress)
-	//}
+	if len(payload.AddrList) > network.MaxAddrPerMessage {
+		return fmt.Errorf("Too many addresses: %d", len(payload.AddrList))
+	}
+
+	log.Info.Printf("Node: %p, Received %d addresses from %s", self.Node, len(payload.AddrList), payload.AddrFrom)
+
+	// addresses are bucketed by the connection address, AddrFrom is told by the other node
+	book := self.Server.Node.Network.AddrBook
+	added := book.AddAddresses(payload.AddrList, network.NodeAddr{Host: self.RequestIP})
 
-	log.Info.Printf("Node: %p, Received Addr %+v", self.Node, payload.AddrList)
+	nanonow := time.Now().Format(timeFormat)
+	log.Info.Printf("NodeID: %s, %s: There are %d addresses in book, %d known nodes now\n",
+		self.Node.NodeID, nanonow, book.Size(), self.Server.Node.Network.GetCountOfKnownNodes())
 
-	// TODO: check this logic
+	// connect to new found nodes if we know not enough nodes
 	addednodes := []network.NodeAddr{}
-	for _, node := range payload.AddrList {
-		if self.Server.Node.Network.AddNodeToKnown(node) {
-			addednodes = append(addednodes, node)
+	for _, addr := range added {
+		if self.Server.Node.Network.GetCountOfKnownNodes()+len(addednodes) >= targetKnownNodes {
+			break
+		}
+		if addr.Addr.CompareToAddress(self.Node.Client.NodeAddress) ||
+			self.Server.Node.Network.CheckIsKnown(addr.Addr) {
+			continue
 		}
+		addednodes = append(addednodes, addr.Addr)
 	}
 
-	nanonow := time.Now().Format(timeFormat)
-	log.Info.Printf("NodeID: %s, %s: There are %d known nodes now: %+v!\n",
-		self.Node.NodeID, nanonow, len(self.Node.Network.Nodes), self.Node.Network.Nodes)
-
 	if len(addednodes) > 0 {
 		log.Info.Printf("Send Versions to new nodes %+v\n", addednodes)
 
-		// send own version to all new found nodes. maybe they have some more blocks
+		// send own version to new found nodes. maybe they have some more blocks
 		// and they will add me to known nodes after this
 		self.Node.SendVersionToNodes(addednodes)
 	}
@@ -85,6 +111,19 @@ func (self *NodeServerRequest) handleAddr() error {
 	return nil
 }
 
+func (self *NodeServerRequest) handleGetAddr() error {
+	var payload network.ComGetAddr
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	addresses := self.Server.Node.Network.AddrBook.GetAddresses(network.MaxAddrPerMessage)
+	log.Debug.Printf("Send %d addresses to %s", len(addresses), payload.AddrFrom)
+
+	return self.Node.Client.SendAddr(payload.AddrFrom, addresses)
+}
+
 // OLDTODO: проверять остаток на балансе с учетом незамайненых транзакций,
 //          во избежание двойного использования выходов
 func (self *NodeServerRequest) handleBlock() error {
@@ -95,26 +134,185 @@ func (self *NodeServerRequest) handleBlock() error {
 	}
 
 	blockData := payload.Block
-	block := blockchain.DeserializeBlock(blockData)
+	block, err := blockchain.DeserializeBlock(blockData)
+	if err != nil {
+		return err
+	}
 
 	nanonow := time.Now().Format(timeFormat)
 	log.Debug.Printf("nodeID: %s, %s: Received a new block!\n", self.Node.NodeID, nanonow)
-	self.Server.bc.AddBlock(block)
 
+	// proof-of-work is checked before anything is stored for the block
+	err = block.Header().Validate()
+	if err != nil {
+		self.Server.limiter.Scores.Misbehaving(self.RequestIP, scoreBrokenMessage, err.Error())
+		return err
+	}
+	err = self.Server.bc.CheckBlockTimestamp(block)
+	if err != nil {
+		log.Warn.Printf("Block is rejected: %s", err)
+		return err
+	}
+	// the block is connected and fully validated when all its ancestors are received
+	err = self.Server.bc.AddBlock(block)
+	if err != nil {
+		log.Warn.Printf("Block is rejected: %s", err)
+		return err
+	}
+
+	self.Server.takePartialBlock(block.Hash)
 	log.Debug.Printf("nodeID: %s, %s: Added block %x\n", self.Node.NodeID, nanonow, block.Hash)
+	self.Server.checkSnapshot()
 
 	// OLDTODO: add validation of block
-	if len(self.Server.blocksInTransit) > 0 {
-		blockHash := self.Server.blocksInTransit[0]
-		self.Node.Client.SendGetData(payload.AddrFrom, "block", blockHash)
+	if blockHash := self.Server.nextBlockInTransit(); blockHash != nil {
+		self.Node.Client.SendGetData(payload.AddrFrom, "block", [][]byte{blockHash})
+	}
 
-		self.Server.blocksInTransit = self.Server.blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{self.Server.bc}
-		// OLDTODO: use UTXOSet.Update() instead UTXOSet.Reindex
-		UTXOSet.Reindex()
+	return nil
+}
+
+// Block from compact block waiting for missing transactions
+type partialBlock struct {
+	block    *blockchain.PartialBlock
+	from     network.NodeAddr
+	received time.Time
+}
+
+/*
+* Reconstructs a block from compact block and mempool. Only missing
+* transactions are requested from the node which sent the block
+ */
+func (self *NodeServerRequest) handleCmpctBlock() error {
+	var payload network.ComCmpctBlock
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	compact, err := blockchain.DeserializeCompactBlock(payload.Block)
+	if err != nil {
+		return err
 	}
+	hash := compact.Header.Hash
 
+	if _, err := self.Server.bc.GetBlock(hash); err == nil {
+		log.Debug.Printf("Compact block %x is known already", hash)
+		return nil
+	}
+	// we have missed some blocks, so sync them
+	parent, err := self.Server.bc.GetBlock(compact.Header.PrevBlockHash)
+	if err != nil {
+		log.Debug.Printf("Parent of compact block %x is unknown, request blocks", hash)
+		return self.Node.Client.SendGetBlocks(payload.AddrFrom)
+	}
+	// header is checked before anything is stored or requested for the block
+	err = compact.Header.Validate()
+	if err == nil && compact.Header.Height != parent.Height+1 {
+		err = fmt.Errorf("Compact block %x has height %d after parent of height %d", hash, compact.Header.Height, parent.Height)
+	}
+	if err != nil {
+		self.Server.limiter.Scores.Misbehaving(self.RequestIP, scoreBrokenMessage, err.Error())
+		return err
+	}
+
+	partial, err := compact.Reconstruct(self.Server.mempool.Snapshot())
+	if err != nil {
+		return err
+	}
+
+	if !partial.IsComplete() {
+		log.Debug.Printf("Compact block %x: %d of %d tx are missing", hash, len(partial.Missing), len(partial.Transactions))
+
+		self.Server.addPartialBlock(&partialBlock{partial, payload.AddrFrom, time.Now()})
+
+		return self.Node.Client.SendGetBlockTxn(payload.AddrFrom, hash, partial.Missing)
+	}
+
+	return self.acceptPartialBlock(partial, payload.AddrFrom)
+}
+
+// Sends transactions of a block requested by a node reconstructing compact block
+func (self *NodeServerRequest) handleGetBlockTxn() error {
+	var payload network.ComGetBlockTxn
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	block, err := self.Server.bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		return err
+	}
+
+	txs := []*blockchain.Transaction{}
+	for _, index := range payload.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			return fmt.Errorf("Wrong transaction index %d of block %x", index, payload.BlockHash)
+		}
+		txs = append(txs, block.Transactions[index])
+	}
+
+	return self.Node.Client.SendBlockTxn(payload.AddrFrom, payload.BlockHash, txs)
+}
+
+// Completes a block from compact block with missing transactions
+func (self *NodeServerRequest) handleBlockTxn() error {
+	var payload network.ComBlockTxn
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	pending := self.Server.takePartialBlock(payload.BlockHash)
+	if pending == nil {
+		return fmt.Errorf("Unexpected transactions of block %x", payload.BlockHash)
+	}
+
+	txs := []*blockchain.Transaction{}
+	for _, data := range payload.Transactions {
+		tx, err := blockchain.DeserializeTransaction(data)
+		if err != nil {
+			return err
+		}
+		txs = append(txs, &tx)
+	}
+
+	err = pending.block.Fill(txs)
+	if err != nil {
+		return err
+	}
+
+	return self.acceptPartialBlock(pending.block, pending.from)
+}
+
+// Adds reconstructed block to the chain. If transactions don't match
+// the header because of short ID collision, full block is requested
+func (self *NodeServerRequest) acceptPartialBlock(partial *blockchain.PartialBlock, from network.NodeAddr) error {
+	block, err := partial.Block()
+	if err != nil {
+		log.Info.Printf("Compact block %x: %s. Request full block", partial.Header.Hash, err)
+		return self.Node.Client.SendGetData(from, "block", [][]byte{partial.Header.Hash})
+	}
+
+	err = self.Server.bc.CheckBlockTimestamp(block)
+	if err != nil {
+		log.Warn.Printf("Block is rejected: %s", err)
+		return err
+	}
+
+	err = self.Server.bc.AddBlock(block)
+	if err != nil {
+		log.Warn.Printf("Block is rejected: %s", err)
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		self.Server.mempool.Delete(tx.ID)
+	}
+
+	self.Server.takePartialBlock(block.Hash)
+	log.Debug.Printf("nodeID: %s: Added compact block %x\n", self.Node.NodeID, block.Hash)
 	return nil
 }
 
@@ -127,28 +325,39 @@ func (self *NodeServerRequest) handleInv() error {
 
 	nanonow := time.Now().Format(timeFormat)
 	log.Debug.Printf("nodeID: %s, %s: Received inventory with %d %s\n", self.Node.NodeID, nanonow, len(payload.Items), payload.Type)
-	log.Debug.Printf("len(mempool): %d\n", len(self.Server.mempool))
-
-	if payload.Type == "block" {
-		self.Server.blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		self.Node.Client.SendGetData(payload.AddrFrom, "block", blockHash)
-
-		newInTransit := [][]byte{}
-		for _, b := range self.Server.blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	log.Debug.Printf("len(mempool): %d\n", self.Server.mempool.Len())
+
+	if payload.Type == "block" && len(payload.Items) > 0 {
+		// blocks are listed from the newest, unknown ones are requested from the
+		// oldest, so they are connected when received and are not kept as orphans
+		unknown := [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if _, err := self.Server.bc.GetBlock(payload.Items[i]); err != nil {
+				unknown = append(unknown, payload.Items[i])
 			}
 		}
-		self.Server.blocksInTransit = newInTransit
+
+		if len(unknown) > 0 {
+			self.Server.setBlocksInTransit(unknown[1:])
+			self.Node.Client.SendGetData(payload.AddrFrom, "block", [][]byte{unknown[0]})
+		}
 	}
 
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
+		if len(payload.Items) > network.MaxInvPerMessage {
+			return fmt.Errorf("Too many transactions announced: %d", len(payload.Items))
+		}
 
-		if self.Server.mempool[hex.EncodeToString(txID)].ID == nil {
-			self.Node.Client.SendGetData(payload.AddrFrom, "tx", txID)
+		// request all unknown transactions at once
+		unknown := [][]byte{}
+		for _, txID := range payload.Items {
+			if _, ok := self.Server.mempool.Get(txID); !ok {
+				unknown = append(unknown, txID)
+			}
+		}
+
+		if len(unknown) > 0 {
+			return self.Node.Client.SendGetData(payload.AddrFrom, "tx", unknown)
 		}
 	}
 
@@ -175,26 +384,207 @@ func (self *NodeServerRequest) handleGetData() error {
 		return err
 	}
 
-	if payload.Type == "block" {
-		block, err := self.Server.bc.GetBlock([]byte(payload.ID))
+	if len(payload.Items) > network.MaxInvPerMessage {
+		return fmt.Errorf("Too many items requested: %d", len(payload.Items))
+	}
+	// answer to a light client is sent in the same connection
+	if payload.AddrFrom.IsEmpty() && len(payload.Items) != 1 {
+		return fmt.Errorf("Light client requested %d items, one item is allowed", len(payload.Items))
+	}
+
+	// items we don't have are reported with notfound
+	notFound := [][]byte{}
+
+	for _, id := range payload.Items {
+		switch payload.Type {
+		case "block":
+			block, err := self.Server.bc.GetBlock(id)
+			if err != nil {
+				notFound = append(notFound, id)
+				continue
+			}
+			err = self.reply(payload.AddrFrom, "block", &network.ComBlock{self.Node.Client.NodeAddress, block.Serialize()})
+			if err != nil {
+				return err
+			}
+
+		case "tx":
+			tx, ok := self.Server.mempool.Get(id)
+			if !ok {
+				notFound = append(notFound, id)
+				continue
+			}
+			err = self.reply(payload.AddrFrom, "tx", &network.ComTx{self.Node.Client.NodeAddress, tx.Serialize()})
+			if err != nil {
+				return err
+			}
+			// delete(mempool, txID)
+
+		default:
+			return fmt.Errorf("Unknown data type %s", payload.Type)
+		}
+	}
+
+	if len(notFound) > 0 {
+		return self.reply(payload.AddrFrom, "notfound", &network.ComNotFound{self.Node.Client.NodeAddress, payload.Type, notFound})
+	}
+
+	return nil
+}
+
+// Sends headers of the chain after the fork with the locator
+func (self *NodeServerRequest) handleGetHeaders() error {
+	var payload network.ComGetHeaders
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.Locator) > network.MaxLocatorSize {
+		return fmt.Errorf("Too long locator: %d", len(payload.Locator))
+	}
+
+	headers := self.Server.bc.GetHeaders(payload.Locator, network.MaxHeadersPerMessage)
+	return self.reply(payload.AddrFrom, "headers", &network.ComHeaders{self.Node.Client.NodeAddress, headers})
+}
+
+func (self *NodeServerRequest) handleHeaders() error {
+	var payload network.ComHeaders
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	// full nodes sync blocks, headers are only logged
+	log.Info.Printf("Received %d headers from %s", len(payload.Headers), payload.AddrFrom)
+	return nil
+}
+
+// Sends proofs of transactions of a block to a light client
+func (self *NodeServerRequest) handleGetMerkleBlock() error {
+	var payload network.ComGetMerkleBlock
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.TxIDs) > network.MaxInvPerMessage {
+		return fmt.Errorf("Too many transactions requested: %d", len(payload.TxIDs))
+	}
+
+	block, err := self.Server.bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		return self.reply(payload.AddrFrom, "notfound", &network.ComNotFound{self.Node.Client.NodeAddress, "merkleblock", [][]byte{payload.BlockHash}})
+	}
+
+	merkle, err := blockchain.NewMerkleBlock(&block, payload.TxIDs).Serialize()
+	if err != nil {
+		return err
+	}
+	return self.reply(payload.AddrFrom, "merkleblock", &network.ComMerkleBlock{self.Node.Client.NodeAddress, merkle})
+}
+
+func (self *NodeServerRequest) handleMerkleBlock() error {
+	var payload network.ComMerkleBlock
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	merkle, err := blockchain.DeserializeMerkleBlock(payload.Block)
+	if err != nil {
+		return err
+	}
+	txs, err := merkle.Verify()
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		log.Info.Printf("Transaction %x is proved in block %x", tx.ID, merkle.Header.Hash)
+	}
+	return nil
+}
+
+// Sends compact filters of the known blocks to a light client
+func (self *NodeServerRequest) handleGetCFilters() error {
+	var payload network.ComGetCFilters
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.BlockHashes) > network.MaxInvPerMessage {
+		return fmt.Errorf("Too many filters requested: %d", len(payload.BlockHashes))
+	}
+
+	filters := []blockchain.BlockFilter{}
+	missing := [][]byte{}
+	for _, hash := range payload.BlockHashes {
+		block, err := self.Server.bc.GetBlock(hash)
 		if err != nil {
-			return err
+			missing = append(missing, hash)
+			continue
 		}
+		filters = append(filters, *blockchain.NewBlockFilter(&block))
+	}
 
-		self.Node.Client.SendBlock(payload.AddrFrom, &block)
+	if len(filters) == 0 {
+		return self.reply(payload.AddrFrom, "notfound", &network.ComNotFound{self.Node.Client.NodeAddress, "cfilter", missing})
+	}
+	if len(missing) > 0 && !payload.AddrFrom.IsEmpty() {
+		self.Node.Client.SendNotFound(payload.AddrFrom, "cfilter", missing)
 	}
+	return self.reply(payload.AddrFrom, "cfilters", &network.ComCFilters{self.Node.Client.NodeAddress, filters})
+}
 
-	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := self.Server.mempool[txID]
+func (self *NodeServerRequest) handleCFilters() error {
+	var payload network.ComCFilters
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	for _, filter := range payload.Filters {
+		log.Info.Printf("Received filter of block %x, %d bytes", filter.BlockHash, len(filter.Filter))
+	}
+	return nil
+}
+
+func (self *NodeServerRequest) handleNotFound() error {
+	var payload network.ComNotFound
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
 
-		self.Node.Client.SendTx(payload.AddrFrom, &tx)
-		// delete(mempool, txID)
+	log.Debug.Printf("Node %s has not found %d %s", payload.AddrFrom, len(payload.Items), payload.Type)
+
+	// continue sync with the next block
+	if payload.Type == "block" {
+		if blockHash := self.Server.nextBlockInTransit(); blockHash != nil {
+			return self.Node.Client.SendGetData(payload.AddrFrom, "block", [][]byte{blockHash})
+		}
 	}
 
 	return nil
 }
 
+func (self *NodeServerRequest) handlePing() error {
+	var payload network.ComPing
+	err := self.parseRequestData(&payload)
+	if err != nil {
+		return err
+	}
+
+	self.Server.Node.Peers.MarkSeen(self.Node.observed.Resolve(payload.AddrFrom))
+
+	self.HasResponse = true
+	self.Response, err = self.Node.Client.BuildCommandData("pong", &network.ComPong{payload.Nonce})
+
+	return err
+}
+
 func (self *NodeServerRequest) handleTx() error {
 	var payload network.ComTx
 	err := self.parseRequestData(&payload)
@@ -203,35 +593,49 @@ func (self *NodeServerRequest) handleTx() error {
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		return err
+	}
 	log.Debug.Printf("handleTx: [%x] minerAddress: %s\n", tx.ID, self.Server.minerAddress)
 
+	// transaction which can't be mined in the next block is not accepted
+	err = self.Server.bc.CheckTransactionLocks(&tx)
+	if err == nil {
+		err = self.Server.bc.CheckTransactionInputs(&tx)
+	}
+	if err != nil {
+		log.Info.Printf("Transaction [%x] is rejected: %s", tx.ID, err)
+		return err
+	}
+
 	// TODO: mempool should be just for miners?
 	//if len(s.miningAddress) > 0 {
-	log.Debug.Printf("Added to pool %d Tx: [%x]\n", len(self.Server.mempool), tx.ID)
-	self.Server.mempool[hex.EncodeToString(tx.ID)] = tx
+	log.Debug.Printf("Added to pool %d Tx: [%x]\n", self.Server.mempool.Len(), tx.ID)
+	self.Server.mempool.Add(tx)
 	//}
 
 	//if s.nodeAddress == KnownNodes[0] {
-	if self.Node.Client.NodeAddress.CompareToAddress(self.Node.Network.Nodes[0]) {
-		log.Debug.Printf("nodeID: %s, knownNodes: %v\n", self.Node.NodeID, self.Node.Network.Nodes)
-		for _, node := range self.Node.Network.Nodes {
+	knownNodes := self.Node.Network.GetNodes()
+	if len(knownNodes) > 0 && self.Node.Client.NodeAddress.CompareToAddress(knownNodes[0]) {
+		log.Debug.Printf("nodeID: %s, knownNodes: %v\n", self.Node.NodeID, knownNodes)
+		for _, node := range knownNodes {
 			if !node.CompareToAddress(self.Node.Client.NodeAddress) &&
 				!node.CompareToAddress(payload.AddFrom) {
-				self.Node.Client.SendInv(node, "tx", [][]byte{tx.ID})
+				self.Server.Node.TxTrickler.Queue(node, tx.ID)
 			}
 		}
 	} else {
 		// OLDTODO: changing count of transaction for mining
-		log.Debug.Printf("minerAddress: %s, len(mempool): %d\n", self.Server.minerAddress, len(self.Server.mempool))
+		log.Debug.Printf("minerAddress: %s, len(mempool): %d\n", self.Server.minerAddress, self.Server.mempool.Len())
 		// FIXME: len of mempool?
-		if len(self.Server.mempool) >= 1 && len(self.Server.minerAddress) > 0 {
+		if self.Server.mempool.Len() >= 1 && len(self.Server.minerAddress) > 0 {
 		MineTransactions:
 			log.Debug.Println("MineTransactions...")
 			var txs []*blockchain.Transaction
 
-			for id := range self.Server.mempool {
-				tx := self.Server.mempool[id]
+			for _, tx := range self.Server.mempool.Snapshot() {
+				tx := tx
 				check, err := self.Server.bc.VerifyTransaction(&tx)
 				if check && err == nil {
 					txs = append(txs, &tx)
@@ -280,30 +684,31 @@ func (self *NodeServerRequest) handleTx() error {
 				}
 			*/
 
+			// coinbase is the first transaction of a block
 			cbTx := blockchain.NewCoinbaseTX(self.Server.minerAddress, "")
-			txs = append(txs, cbTx)
+			txs = append([]*blockchain.Transaction{cbTx}, txs...)
 
 			newBlock := self.Server.bc.MineBlock(txs)
-			UTXOSet := blockchain.UTXOSet{self.Server.bc}
-			// OLDTODO: use UTXOSet.Update() instead UTXOSet.Reindex
-			UTXOSet.Reindex()
+			if newBlock == nil {
+				log.Warn.Printf("Failed to mine block with %d tx", len(txs))
+				self.Server.dropUnminable()
+				return nil
+			}
 
 			nanonow := time.Now().Format(timeFormat)
 			log.Debug.Printf("nodeID: %s, %s: New block is mined!", self.Node.NodeID, nanonow)
-			log.Debug.Printf("New block with %d tx is mined!\n", len(txs))
+			log.Debug.Printf("New block with %d tx is mined!\n", len(newBlock.Transactions))
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(self.Server.mempool, txID)
+			for _, tx := range newBlock.Transactions {
+				self.Server.mempool.Delete(tx.ID)
 			}
+			// transactions spending the same outputs as mined ones can't be mined anymore
+			self.Server.dropUnminable()
 
-			for _, node := range self.Node.Network.Nodes {
-				if !node.CompareToAddress(self.Node.Client.NodeAddress) {
-					self.Node.Client.SendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
+			self.Node.AnnounceBlock(newBlock)
 
-			if len(self.Server.mempool) > 0 {
+			// skipped transactions are not mined again until a new one comes
+			if len(newBlock.Transactions) > 1 && self.Server.mempool.Len() > 0 {
 				goto MineTransactions
 			}
 		}
@@ -325,22 +730,35 @@ func (self *NodeServerRequest) handleVersion() error {
 	log.Info.Printf("Node: %p, Received Version [%d] Height from [%s]",
 		self.Node, payload.BestHeight, payload.AddrFrom)
 
-	if myBestHeight < foreignerBestHeight {
+	// the node may advertise a host not reachable from here, e.g. behind NAT
+	addrFrom := self.Node.observed.Learn(payload.AddrFrom, self.RequestIP, self.PeerKey)
+	if addrFrom != payload.AddrFrom {
+		log.Info.Printf("Node [%s] is reachable at observed address [%s]", payload.AddrFrom, addrFrom)
+	}
+
+	// blocks below the UTXO snapshot are requested from nodes of the same height too
+	snapshotPending := myBestHeight == foreignerBestHeight && self.Server.bc.SnapshotPending()
+	// pruned node keeps only the last blocks, older ones are requested from full nodes
+	pruned := payload.Services&network.ServiceNodeNetwork == 0 && payload.Services&network.ServiceNodeNetworkLimited != 0
+	if pruned && (foreignerBestHeight-myBestHeight > blockchain.MinPruneDepth || snapshotPending) {
+		log.Info.Printf("Node [%s] is pruned, blocks are not requested from it", addrFrom)
+	} else if myBestHeight < foreignerBestHeight || snapshotPending {
 		//log.Info.Printf("Request blocks from %s\n", payload.AddrFrom)
 
-		self.Node.Client.SendGetBlocks(payload.AddrFrom)
+		self.Node.Client.SendGetBlocks(addrFrom)
 
 	} else if myBestHeight > foreignerBestHeight {
 		//log.Info.Printf("Send my version back to %s\n", payload.AddrFrom)
 
-		self.Node.Client.SendVersion(payload.AddrFrom, myBestHeight)
+		self.Node.Client.SendVersion(addrFrom, myBestHeight)
 
 	} else {
 		//log.Info.Printf("Their blockchain is same as my for %s\n", payload.AddrFrom)
 	}
 
 	//log.Info.Printf("Check address known for %s\n", payload.AddrFrom)
-	self.Server.Node.CheckAddressKnown(payload.AddrFrom)
+	self.Server.Node.CheckAddressKnown(addrFrom, payload.Services)
+	self.Server.Node.Peers.MarkSeen(addrFrom)
 
 	return nil
 }
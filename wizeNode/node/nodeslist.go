@@ -1,17 +1,18 @@
 package node
 
 import (
-	"os"
+	"bytes"
+	"encoding/gob"
 	"time"
 
-	"github.com/boltdb/bolt"
-
 	//"wizeBlock/wizeNode/core/log"
 	"wizeBlock/wizeNode/core/network"
+	"wizeBlock/wizeNode/core/storage"
 )
 
 const nodesFileName = "nodeslist.db"
 const nodesBucket = "nodes"
+const addrBookBucket = "addrbook"
 
 type NodesListStorage struct {
 	DataDir string
@@ -26,17 +27,14 @@ func (s NodesListStorage) GetNodes() ([]network.NodeAddr, error) {
 	defer db.Close()
 
 	nodes := []network.NodeAddr{}
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(nodesBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	err = db.View(func(tx storage.Tx) error {
+		return tx.ForEach(nodesBucket, func(k, v []byte) error {
 			addr := string(v)
 			node := network.NodeAddr{}
 			node.LoadFromString(addr)
 			nodes = append(nodes, node)
-		}
-		return nil
+			return nil
+		})
 	})
 
 	if err != nil {
@@ -53,12 +51,11 @@ func (s NodesListStorage) AddNodeToKnown(addr network.NodeAddr) {
 	}
 	defer db.Close()
 
-	err = db.Update(func(txdb *bolt.Tx) error {
-		b := txdb.Bucket([]byte(nodesBucket))
+	err = db.Update(func(txdb storage.Tx) error {
 		addr := addr.String()
 		key := []byte(addr)
 
-		return b.Put(key, key)
+		return txdb.Put(nodesBucket, key, key)
 	})
 }
 
@@ -69,12 +66,11 @@ func (s NodesListStorage) RemoveNodeFromKnown(addr network.NodeAddr) {
 	}
 	defer db.Close()
 
-	err = db.Update(func(txdb *bolt.Tx) error {
-		b := txdb.Bucket([]byte(nodesBucket))
+	err = db.Update(func(txdb storage.Tx) error {
 		addr := addr.String()
 		key := []byte(addr)
 
-		return b.Delete(key)
+		return txdb.Delete(nodesBucket, key)
 	})
 }
 
@@ -87,15 +83,11 @@ func (s NodesListStorage) GetCountOfKnownNodes() (int, error) {
 	defer db.Close()
 
 	count := 0
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(nodesBucket))
-		c := b.Cursor()
-
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+	err = db.View(func(tx storage.Tx) error {
+		return tx.ForEach(nodesBucket, func(k, v []byte) error {
 			count++
-		}
-
-		return nil
+			return nil
+		})
 	})
 
 	if err != nil {
@@ -104,43 +96,60 @@ func (s NodesListStorage) GetCountOfKnownNodes() (int, error) {
 	return count, nil
 }
 
-func (s NodesListStorage) openDB() (*bolt.DB, error) {
-	f, err := s.getDbFile()
+func (s NodesListStorage) GetAddresses() ([]network.KnownAddress, error) {
+	db, err := s.openDB()
 	if err != nil {
 		return nil, err
 	}
+	defer db.Close()
+
+	addresses := []network.KnownAddress{}
+	err = db.View(func(tx storage.Tx) error {
+		return tx.ForEach(addrBookBucket, func(k, v []byte) error {
+			var addr network.KnownAddress
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&addr)
+			if err != nil {
+				// skip broken records
+				return nil
+			}
+			addresses = append(addresses, addr)
+			return nil
+		})
+	})
 
-	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 10 * time.Second})
 	if err != nil {
 		return nil, err
 	}
-
-	return db, nil
-
+	return addresses, nil
 }
 
-func (s NodesListStorage) getDbFile() (string, error) {
-	filePath := s.DataDir + nodesFileName
+func (s NodesListStorage) SaveAddresses(list []network.KnownAddress) error {
+	db, err := s.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
 
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		// create empty DB
-		db, err := bolt.Open(filePath, 0600, nil)
+	return db.Update(func(tx storage.Tx) error {
+		err := tx.DeleteBucket(addrBookBucket)
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		err = db.Update(func(tx *bolt.Tx) error {
-			_, err := tx.CreateBucket([]byte(nodesBucket))
+		for _, addr := range list {
+			data, err := network.GobEncode(addr)
+			if err != nil {
+				return err
+			}
+			err = tx.Put(addrBookBucket, []byte(addr.Addr.String()), data)
 			if err != nil {
 				return err
 			}
-			return nil
-		})
-		db.Close()
-
-		if err != nil {
-			return "", err
 		}
-	}
-	return filePath, nil
+		return nil
+	})
+}
+
+func (s NodesListStorage) openDB() (*storage.BoltStore, error) {
+	return storage.OpenBolt(s.DataDir+nodesFileName, 10*time.Second)
 }
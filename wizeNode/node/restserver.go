@@ -4,6 +4,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"path/filepath"
 
 	//"github.com/betacraft/yaag/middleware"
 	"github.com/betacraft/yaag/yaag"
@@ -19,6 +20,9 @@ import (
 // TODO: CORS refactoring
 // TODO: refactoring exits from all routines
 
+// APIDocDir is the dir of generated API documentation served at /doc/
+var APIDocDir = "./apidoc"
+
 // RestServer provides HTTP service.
 type RestServer struct {
 	node *Node
@@ -36,13 +40,13 @@ func NewRestServer(node *Node, addr string) *RestServer {
 
 // Start starts the service.
 func (s *RestServer) Start() error {
-	yaag.Init(&yaag.Config{On: true, DocTitle: "Gorilla Mux", DocPath: "./apidoc/apidoc.html"})
+	yaag.Init(&yaag.Config{On: true, DocTitle: "Gorilla Mux", DocPath: filepath.Join(APIDocDir, "apidoc.html")})
 
 	// Get the mux router object
 	router := mux.NewRouter().StrictSlash(false)
 
 	//router.Handle("/apidoc", http.FileServer(http.Dir("./apidoc")))
-	router.PathPrefix("/doc/").Handler(http.StripPrefix("/doc/", http.FileServer(http.Dir("./apidoc"))))
+	router.PathPrefix("/doc/").Handler(http.StripPrefix("/doc/", http.FileServer(http.Dir(APIDocDir))))
 
 	// TODO: what is middleware.HandleFunc() doing here?
 	//router.HandleFunc("/", middleware.HandleFunc(node.sayHello)).Methods("GET")
@@ -51,15 +55,25 @@ func (s *RestServer) Start() error {
 	// inner usage
 	router.HandleFunc("/blockchain/print", s.printBlockchain).Methods("GET")
 	router.HandleFunc("/block/{hash}", s.getBlock).Methods("GET")
+	// light clients: proof of transaction in a block
+	router.HandleFunc("/tx/{txid}/proof", s.getTxProof).Methods("GET")
+	// light clients: compact filter of a block
+	router.HandleFunc("/filter/{hash}", s.getBlockFilter).Methods("GET")
 
 	router.HandleFunc("/wallet/{hash}", s.getWallet).Methods("GET")
 
+	router.HandleFunc("/peers", s.getPeers).Methods("GET")
+
 	// send transaction steps: prepare/sign
 	router.HandleFunc("/prepare", s.prepare).Methods("POST")
 	router.HandleFunc("/sign", s.sign).Methods("POST")
 
 	router.HandleFunc("/state", s.echoHandler).Methods("POST")
 
+	// regtest: mining on demand and node time
+	router.HandleFunc("/generate", s.generate).Methods("POST")
+	router.HandleFunc("/setmocktime", s.setMockTime).Methods("POST")
+
 	// DEPRECATED: inner usage
 	//router.HandleFunc("/wallet/new", s.deprecatedWalletCreate).Methods("POST")
 	//router.HandleFunc("/wallets/list", s.deprecatedWalletsList).Methods("GET")
@@ -12,6 +12,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"wizeBlock/wizeNode/core/blockchain"
+	"wizeBlock/wizeNode/core/chaincfg"
 	"wizeBlock/wizeNode/core/crypto"
 	"wizeBlock/wizeNode/core/wallet"
 )
@@ -21,10 +22,12 @@ import (
 // TODO: actual and deprecated APIs
 
 type Prepare struct {
-	From   string
-	To     string
-	Amount int
-	PubKey string
+	From     string
+	To       string
+	Amount   int
+	PubKey   string
+	LockTime int64
+	Sequence uint32
 }
 
 type Sign struct {
@@ -34,12 +37,23 @@ type Sign struct {
 	MineNow    bool
 }
 
+type Generate struct {
+	Count   int
+	Address string
+}
+
+type MockTime struct {
+	Time int64
+}
+
 // DEPRECATED: inner usage
 type Send struct {
-	From    string
-	To      string
-	Amount  int
-	MineNow bool
+	From     string
+	To       string
+	Amount   int
+	MineNow  bool
+	LockTime int64
+	Sequence uint32
 }
 
 func (s *RestServer) sayHello(w http.ResponseWriter, r *http.Request) {
@@ -57,6 +71,14 @@ func (s *RestServer) getWallet(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
+func (s *RestServer) getPeers(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{
+		"success": true,
+		"peers":   s.node.Peers.GetPeers(),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
 // DEPRECATED: inner usage
 func (s *RestServer) deprecatedWalletsList(w http.ResponseWriter, r *http.Request) {
 	wallets, err := wallet.NewWallets(s.node.NodeID)
@@ -137,7 +159,7 @@ func (s *RestServer) deprecatedSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tx := blockchain.NewUTXOTransaction(wallet, to, amount, &UTXOSet)
+	tx := blockchain.NewUTXOTransaction(wallet, to, amount, send.LockTime, send.Sequence, &UTXOSet)
 
 	respsuccess := true
 
@@ -149,22 +171,21 @@ func (s *RestServer) deprecatedSend(w http.ResponseWriter, r *http.Request) {
 		cbTx := blockchain.NewCoinbaseTX(from, "")
 		txs := []*blockchain.Transaction{cbTx, tx}
 
+		// the block is mined without the transaction if it can't be mined
 		newBlock := s.node.blockchain.MineBlock(txs)
-		if newBlock != nil {
-			UTXOSet.Update(newBlock)
-		} else {
+		if newBlock == nil || len(newBlock.Transactions) < len(txs) {
 			respsuccess = false
 		}
 	} else {
 		// TODO: проверять остаток на балансе с учетом незамайненых транзакций,
 		// во избежание двойного использования выходов
-		knownNode0 := s.node.Network.Nodes[0]
+		knownNode0 := s.node.Network.GetNodes()[0]
 		s.node.Client.SendTx(knownNode0, tx)
 	}
 
 	//
 	if respsuccess {
-		for _, node := range s.node.Network.Nodes {
+		for _, node := range s.node.Network.GetNodes() {
 			fmt.Printf("node: %s\n", node)
 			if !node.CompareToAddress(currentNodeAddress) {
 				s.node.Client.SendVersion(node, s.node.blockchain.GetBestHeight())
@@ -226,7 +247,7 @@ func (s *RestServer) prepare(w http.ResponseWriter, r *http.Request) {
 
 	UTXOSet := blockchain.UTXOSet{s.node.blockchain}
 
-	tx, txToSign, err := blockchain.PrepareUTXOTransaction(from, to, amount, pubKey, &UTXOSet)
+	tx, txToSign, err := blockchain.PrepareUTXOTransaction(from, to, amount, pubKey, prepare.LockTime, prepare.Sequence, &UTXOSet)
 	if err != nil || tx == nil || txToSign == nil {
 		sendErrorMessage(w, "Could not prepare transaction", http.StatusInternalServerError)
 		return
@@ -328,16 +349,15 @@ func (s *RestServer) sign(w http.ResponseWriter, r *http.Request) {
 		cbTx := blockchain.NewCoinbaseTX(from, "")
 		txs := []*blockchain.Transaction{cbTx, tx}
 
+		// the block is mined without the transaction if it can't be mined
 		newBlock := s.node.blockchain.MineBlock(txs)
-		if newBlock != nil {
-			UTXOSet.Update(newBlock)
-		} else {
+		if newBlock == nil || len(newBlock.Transactions) < len(txs) {
 			respsuccess = false
 		}
 
 		// network update
 		if respsuccess {
-			for _, node := range s.node.Network.Nodes {
+			for _, node := range s.node.Network.GetNodes() {
 				fmt.Printf("node: %s\n", node)
 				if !node.CompareToAddress(currentNodeAddress) {
 					s.node.Client.SendVersion(node, s.node.blockchain.GetBestHeight())
@@ -350,7 +370,7 @@ func (s *RestServer) sign(w http.ResponseWriter, r *http.Request) {
 		// TODO: проверять остаток на балансе с учетом незамайненых транзакций,
 		// во избежание двойного использования выходов
 
-		knownNode0 := s.node.Network.Nodes[0]
+		knownNode0 := s.node.Network.GetNodes()[0]
 		fmt.Printf("Send Tx: %x, from %s, to: %s\n", tx.ID, knownNode0, currentNodeAddress)
 		s.node.Client.SendTx(knownNode0, tx)
 	}
@@ -364,6 +384,73 @@ func (s *RestServer) sign(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
+// regtest: mine blocks on demand
+func (s *RestServer) generate(w http.ResponseWriter, r *http.Request) {
+	if !chaincfg.Active.MineOnDemand {
+		sendErrorMessage(w, "Blocks can be generated only in regtest", http.StatusForbidden)
+		return
+	}
+
+	var generate Generate
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "Failed to read the request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &generate); err != nil {
+		sendErrorMessage(w, "Could not decode the request body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	if generate.Count <= 0 {
+		sendErrorMessage(w, "Count of blocks should be positive", http.StatusBadRequest)
+		return
+	}
+	if !crypto.ValidateAddress(generate.Address) {
+		sendErrorMessage(w, "Address is not valid", http.StatusBadRequest)
+		return
+	}
+
+	hashes, err := s.node.GenerateBlocks(generate.Count, generate.Address)
+	blocks := []string{}
+	for _, hash := range hashes {
+		blocks = append(blocks, hex.EncodeToString(hash))
+	}
+
+	resp := map[string]interface{}{
+		"success": err == nil,
+		"blocks":  blocks,
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// regtest: fix node time, zero returns real time
+func (s *RestServer) setMockTime(w http.ResponseWriter, r *http.Request) {
+	if !chaincfg.Active.MineOnDemand {
+		sendErrorMessage(w, "Time can be mocked only in regtest", http.StatusForbidden)
+		return
+	}
+
+	var mockTime MockTime
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "Failed to read the request body", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &mockTime); err != nil {
+		sendErrorMessage(w, "Could not decode the request body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	blockchain.SetMockTime(mockTime.Time)
+
+	resp := map[string]interface{}{
+		"success": true,
+		"time":    blockchain.Now().Unix(),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
 // inner usage
 func (s *RestServer) printBlockchain(w http.ResponseWriter, r *http.Request) {
 
@@ -436,6 +523,54 @@ func (s *RestServer) getBlock(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
+/*
+* Returns header of the block with the transaction and merkle proof of it,
+* so a light client can verify the transaction without trusting the node
+ */
+func (s *RestServer) getTxProof(w http.ResponseWriter, r *http.Request) {
+	txID, err := hex.DecodeString(mux.Vars(r)["txid"])
+	if err != nil {
+		sendErrorMessage(w, "Transaction ID is not valid", http.StatusBadRequest)
+		return
+	}
+
+	block, err := s.node.blockchain.FindTransactionBlock(txID)
+	if err != nil {
+		sendErrorMessage(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"proof":   blockchain.NewMerkleBlock(block, [][]byte{txID}),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+/*
+* Returns compact filter of the block. A light client matches it against
+* its addresses and outpoints to learn if the block is needed
+ */
+func (s *RestServer) getBlockFilter(w http.ResponseWriter, r *http.Request) {
+	hash, err := hex.DecodeString(mux.Vars(r)["hash"])
+	if err != nil {
+		sendErrorMessage(w, "Block hash is not valid", http.StatusBadRequest)
+		return
+	}
+
+	block, err := s.node.blockchain.GetBlock(hash)
+	if err != nil {
+		sendErrorMessage(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"filter":  blockchain.NewBlockFilter(&block),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	response, err := json.Marshal(payload)
 	if err != nil {
@@ -0,0 +1,383 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"wizeBlock/wizeNode/core/blockchain"
+	"wizeBlock/wizeNode/core/chaincfg"
+	"wizeBlock/wizeNode/core/crypto"
+	"wizeBlock/wizeNode/core/network"
+)
+
+/*
+* Simulator runs a network of nodes in one process. Nodes listen on loopback
+* ports or on in-memory transport and keep data in a temporary dir. Links
+* between nodes can be cut, delayed or lose messages. The regtest network
+* is used, so mining is instant
+ */
+type Simulator struct {
+	t     *testing.T
+	Nodes []*Node
+	// address receiving all mining rewards and the genesis emission
+	Miner string
+	// keys of the miner address to sign transactions
+	MinerKey    *crypto.PrivateKey
+	MinerPubKey []byte
+	// network of nodes with in-memory transport, nil for TCP
+	Memory *network.MemoryNetwork
+
+	params     chaincfg.Params
+	oldActive  *chaincfg.Params
+	mutex      sync.Mutex
+	links      map[string]*simLink
+	nodeByAddr map[string]int
+	// open connections between nodes, a partition closes them
+	conns map[*simConn]struct{}
+}
+
+// first port of nodes with in-memory transport
+const simMemoryPort = 20000
+
+// State of the link from one node to other
+type simLink struct {
+	down     bool
+	latency  time.Duration
+	dropRate float64
+}
+
+// Starts count nodes on loopback ports which know each other and share the genesis block
+func NewSimulator(t *testing.T, count int) *Simulator {
+	return newSimulator(t, count, nil)
+}
+
+// Starts count nodes connected with in-memory transport
+func NewMemorySimulator(t *testing.T, count int) *Simulator {
+	return newSimulator(t, count, network.NewMemoryNetwork())
+}
+
+func newSimulator(t *testing.T, count int, memory *network.MemoryNetwork) *Simulator {
+	s := &Simulator{
+		t:          t,
+		Memory:     memory,
+		params:     chaincfg.RegTestParams,
+		oldActive:  chaincfg.Active,
+		links:      make(map[string]*simLink),
+		nodeByAddr: make(map[string]int),
+		conns:      make(map[*simConn]struct{}),
+	}
+	s.params.DataDir = t.TempDir() + "/"
+	chaincfg.Active = &s.params
+
+	s.MinerKey, s.MinerPubKey = crypto.NewKeyPair()
+	s.Miner = string(crypto.GetAddress(s.MinerPubKey))
+
+	addrs := []network.NodeAddr{}
+	for i := 0; i < count; i++ {
+		addr := network.NodeAddr{"127.0.0.1", simMemoryPort + i}
+		if memory == nil {
+			addr.Port = freePort(t)
+		}
+		s.nodeByAddr[addr.String()] = i
+		addrs = append(addrs, addr)
+	}
+	s.createGenesis(addrs)
+
+	for i, addr := range addrs {
+		node := NewNode(strconv.Itoa(addr.Port), addr, "", "")
+		var transport network.Transport = network.TCPTransport{}
+		if memory != nil {
+			transport = memory.Transport(addr)
+		}
+		node.SetTransport(&simTransport{transport, s, i})
+
+		others := []network.NodeAddr{}
+		for _, other := range addrs {
+			if !other.CompareToAddress(addr) {
+				others = append(others, other)
+			}
+		}
+		node.InitNetwork(others, true)
+
+		result := make(chan string, 1)
+		go node.Server.Start(result)
+		if err := <-result; err != "" {
+			t.Fatalf("Failed to start node %d: %s", i, err)
+		}
+		s.Nodes = append(s.Nodes, node)
+	}
+
+	// now all nodes are listening, so they can learn each other
+	for _, node := range s.Nodes {
+		node.SendVersionToNodes(nil)
+	}
+
+	return s
+}
+
+/*
+* Stops all nodes and restores the active network. Servers wait for handlers
+* of received messages before closing databases
+ */
+func (s *Simulator) Close() {
+	s.mutex.Lock()
+	for a := range s.Nodes {
+		for b := range s.Nodes {
+			s.link(a, b).down = true
+		}
+	}
+	s.mutex.Unlock()
+	s.closeConns(func(c *simConn) bool { return true })
+
+	for _, node := range s.Nodes {
+		node.Server.Stop()
+	}
+	chaincfg.Active = s.oldActive
+}
+
+// Cuts all links between two groups of nodes and closes their connections
+func (s *Simulator) Partition(groupA, groupB []int) {
+	s.mutex.Lock()
+	inA := make(map[int]bool)
+	inB := make(map[int]bool)
+	for _, a := range groupA {
+		inA[a] = true
+		for _, b := range groupB {
+			inB[b] = true
+			s.link(a, b).down = true
+			s.link(b, a).down = true
+		}
+	}
+	s.mutex.Unlock()
+
+	s.closeConns(func(c *simConn) bool {
+		return inA[c.from] && inB[c.to] || inB[c.from] && inA[c.to]
+	})
+}
+
+// Closes open connections between nodes matching the filter
+func (s *Simulator) closeConns(match func(c *simConn) bool) {
+	s.mutex.Lock()
+	closed := []*simConn{}
+	for c := range s.conns {
+		if match(c) {
+			delete(s.conns, c)
+			closed = append(closed, c)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, c := range closed {
+		c.Conn.Close()
+	}
+}
+
+/*
+* Restores all links and removes latency and drops. Nodes exchange versions
+* as after reconnect, so they sync blocks missed during partition
+ */
+func (s *Simulator) Heal() {
+	s.mutex.Lock()
+	s.links = make(map[string]*simLink)
+	s.mutex.Unlock()
+
+	for _, node := range s.Nodes {
+		node.SendVersionToNodes(nil)
+	}
+}
+
+// Sets delay of every message sent from node a to node b and back
+func (s *Simulator) SetLatency(a, b int, latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.link(a, b).latency = latency
+	s.link(b, a).latency = latency
+}
+
+// Sets probability of losing a message sent from node a to node b
+func (s *Simulator) SetDropRate(a, b int, rate float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.link(a, b).dropRate = rate
+}
+
+// Mines blocks on a node
+func (s *Simulator) Generate(i, count int) [][]byte {
+	hashes, err := s.Nodes[i].GenerateBlocks(count, s.Miner)
+	if err != nil {
+		s.t.Fatalf("Failed to generate blocks: %s", err)
+	}
+	return hashes
+}
+
+// Returns tip of a node
+func (s *Simulator) Tip(i int) []byte {
+	return s.Nodes[i].blockchain.GetTip()
+}
+
+// Returns true if nodes have the same tip and UTXO set
+func (s *Simulator) Converged(nodes ...int) bool {
+	if len(nodes) == 0 {
+		for i := range s.Nodes {
+			nodes = append(nodes, i)
+		}
+	}
+
+	first := s.Nodes[nodes[0]].blockchain
+	tip := first.GetTip()
+	utxo := blockchain.UTXOSet{first}.Digest()
+
+	for _, i := range nodes[1:] {
+		bc := s.Nodes[i].blockchain
+		if !bytes.Equal(tip, bc.GetTip()) || !bytes.Equal(utxo, blockchain.UTXOSet{bc}.Digest()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fails the test if nodes don't converge during timeout
+func (s *Simulator) WaitConverged(timeout time.Duration, nodes ...int) {
+	deadline := time.Now().Add(timeout)
+	for !s.Converged(nodes...) {
+		if time.Now().After(deadline) {
+			for i, node := range s.Nodes {
+				s.t.Logf("Node %d: height %d, tip %x", i, node.blockchain.GetBestHeight(), node.blockchain.GetTip())
+			}
+			s.t.Fatalf("Nodes %v are not converged in %s", nodes, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Creates genesis block once and copies the chain to data dirs of all nodes
+func (s *Simulator) createGenesis(addrs []network.NodeAddr) {
+	firstID := strconv.Itoa(addrs[0].Port)
+	bc := blockchain.CreateBlockchain(s.Miner, firstID)
+	bc.Close()
+
+	for _, addr := range addrs[1:] {
+		nodeID := strconv.Itoa(addr.Port)
+		err := os.MkdirAll(chaincfg.DataPath("db%s", nodeID), 0700)
+		if err == nil {
+			err = copyFile(chaincfg.DataPath("db%s/wizebit.db", firstID), chaincfg.DataPath("db%s/wizebit.db", nodeID))
+		}
+		if err != nil {
+			s.t.Fatalf("Failed to copy genesis: %s", err)
+		}
+	}
+}
+
+// Returns state of a link. Mutex should be locked
+func (s *Simulator) link(from, to int) *simLink {
+	key := fmt.Sprintf("%d->%d", from, to)
+	link, ok := s.links[key]
+	if !ok {
+		link = &simLink{}
+		s.links[key] = link
+	}
+	return link
+}
+
+// Transport of a node which applies state of links
+type simTransport struct {
+	network.Transport
+	sim  *Simulator
+	from int
+}
+
+func (t *simTransport) Dial(address network.NodeAddr) (net.Conn, error) {
+	// links with nodes out of the simulator are not controlled
+	to, ok := t.sim.nodeByAddr[address.String()]
+	if !ok {
+		return t.Transport.Dial(address)
+	}
+
+	t.sim.mutex.Lock()
+	link := simLink{}
+	if l, ok := t.sim.links[fmt.Sprintf("%d->%d", t.from, to)]; ok {
+		link = *l
+	}
+	t.sim.mutex.Unlock()
+
+	if link.down {
+		return nil, fmt.Errorf("Link %d->%d is down", t.from, to)
+	}
+
+	conn, err := t.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// the link could be cut while dialing
+	t.sim.mutex.Lock()
+	defer t.sim.mutex.Unlock()
+	if t.sim.link(t.from, to).down {
+		conn.Close()
+		return nil, fmt.Errorf("Link %d->%d is down", t.from, to)
+	}
+	c := &simConn{conn, link, t.sim, t.from, to}
+	t.sim.conns[c] = struct{}{}
+	return c, nil
+}
+
+// Connection which delays or loses written messages
+type simConn struct {
+	net.Conn
+	link simLink
+
+	sim      *Simulator
+	from, to int
+}
+
+func (c *simConn) Close() error {
+	c.sim.mutex.Lock()
+	delete(c.sim.conns, c)
+	c.sim.mutex.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *simConn) Write(data []byte) (int, error) {
+	time.Sleep(c.link.latency)
+	if c.link.dropRate > 0 && rand.Float64() < c.link.dropRate {
+		return len(data), nil
+	}
+	return c.Conn.Write(data)
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen(network.Protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %+v\n", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}